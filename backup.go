@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/journal"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+const (
+	// Интервал между резервными копиями БД по-умолчанию.
+	backupIntervalHoursDefault = 24
+	// Количество хранимых резервных копий по-умолчанию.
+	backupKeepDefault = 7
+	// БД копируется по backupPagesPerStep страниц с паузой backupStepPause
+	// между шагами, чтобы бот и сборщик фильмов не ждали окончания
+	// копирования.
+	backupPagesPerStep = 256
+	backupStepPause    = time.Millisecond * 20
+	// Сборщик фильмов постоянно пишет в БД, из-за чего копирование
+	// начинается заново. После backupMaxRestarts повторов оставшаяся часть
+	// БД копируется за один шаг.
+	backupMaxRestarts = 10
+	// Формат времени в названиях файлов резервных копий. Время в UTC.
+	backupTimeFormat = "20060102-150405"
+)
+
+// backupJob периодически делает резервные копии БД dbName в папку cfg.Dir,
+// пока не будет отменён ctx. В папке хранится не больше cfg.Keep последних
+// копий, более старые копии удаляются.
+func backupJob(ctx context.Context, finished *sync.WaitGroup, cfg backupConfig, dbName string) {
+	goID := "[go backup]:"
+	journal.Info(goID, " started")
+	defer func() {
+		finished.Done()
+		journal.Info(goID, " finished")
+	}()
+
+	interval := time.Duration(cfg.IntervalHours) * time.Hour
+	if interval <= 0 {
+		interval = backupIntervalHoursDefault * time.Hour
+	}
+	keep := cfg.Keep
+	if keep <= 0 {
+		keep = backupKeepDefault
+	}
+
+	for {
+		journal.Info(goID, " sleeping for ", interval, " before next backup")
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		filename, err := backupDB(ctx, dbName, cfg.Dir)
+		if err != nil {
+			journal.Error(goID, " database backup failed: ", err)
+			continue
+		}
+		journal.Info(goID, " database backed up to ", filename)
+		err = rotateBackups(dbName, cfg.Dir, keep)
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
+	}
+}
+
+// backupName возвращает название файла резервной копии БД dbName, сделанной
+// во время t, например, database-20201016-150405.db.
+func backupName(dbName string, t time.Time) string {
+	base := filepath.Base(dbName)
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-" + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// backupDB делает резервную копию БД dbName в папку dir и возвращает путь к
+// файлу копии. Копия сначала пишется во временный файл, поэтому в папке не
+// бывает недописанных копий.
+func backupDB(ctx context.Context, dbName, dir string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.SetBusyTimeout(dbBusyTimeoutMS)
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir, backupName(dbName, time.Now()))
+	tmpFilename := filename + ".tmp"
+	err = conn.BackupToFile(ctx, tmpFilename, backupPagesPerStep, backupStepPause, backupMaxRestarts, func(remaining, pageCount int) {
+		journal.Trace("database backup: ", pageCount-remaining, "/", pageCount, " pages copied")
+	})
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return "", err
+	}
+	return filename, nil
+}
+
+// rotateBackups удаляет из папки dir резервные копии БД dbName, кроме keep
+// последних.
+func rotateBackups(dbName, dir string, keep int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Время в названиях копий записано так, что порядок названий совпадает
+	// с порядком создания копий.
+	base := filepath.Base(dbName)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+	var backups []string
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		_, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	sort.Strings(backups)
+
+	for len(backups) > keep {
+		journal.Info("removing old database backup ", backups[0])
+		err = os.Remove(filepath.Join(dir, backups[0]))
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
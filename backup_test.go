@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+func TestBackupDB(t *testing.T) {
+	dbName := testMigrationDB(t)
+	err := initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("INSERT INTO bot_state (name, value) VALUES ('test', 1);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backupDir := filepath.Join(filepath.Dir(dbName), "backups")
+	filename, err := backupDB(context.Background(), dbName, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(filename) != backupDir || filepath.Ext(filename) != ".db" {
+		t.Fatalf("Unexpected backup file %s", filename)
+	}
+
+	// Копия - это полноценная БД той же версии.
+	if version, pending := testSchemaVersion(t, filename); version != len(migrations) || pending != 0 {
+		t.Fatalf("Unexpected backup version %d with %d pending migrations", version, pending)
+	}
+	backup, err := sqlite.NewConn(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	stmt, err := backup.Prepare("SELECT value FROM bot_state WHERE name = 'test';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var value int64
+	err = stmt.QueryRow().Scan(&value)
+	if err != nil || value != 1 {
+		t.Fatalf("Unexpected bot state in backup %d (%v)", value, err)
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "movie-promo-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dbName := filepath.Join(dir, "database.db")
+
+	start := time.Date(2020, time.May, 7, 10, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, backupName(dbName, start.Add(time.Hour*time.Duration(i))))
+	}
+	// Файлы, которые не являются резервными копиями, не удаляются.
+	others := []string{"database.db", "database-notes.db", "other-20200101-000000.db"}
+	for _, name := range append(names, others...) {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = rotateBackups(dbName, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, f := range files {
+		left = append(left, f.Name())
+	}
+	expected := []string{"database-20200507-130000.db", "database-20200507-140000.db", "database-notes.db", "database.db", "other-20200101-000000.db"}
+	if !reflect.DeepEqual(left, expected) {
+		t.Fatalf("Unexpected files after rotation %v", left)
+	}
+}
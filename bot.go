@@ -6,7 +6,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -20,15 +22,20 @@ import (
 	"github.com/source-farm/movie-promo-bot/iso6391"
 	"github.com/source-farm/movie-promo-bot/journal"
 	"github.com/source-farm/movie-promo-bot/levenshtein"
+	"github.com/source-farm/movie-promo-bot/ngram"
 	"github.com/source-farm/movie-promo-bot/sqlite"
 	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+	"github.com/source-farm/movie-promo-bot/translit"
 )
 
 // Краткая информация о фильме.
 type titleInfo struct {
 	id            int64     // Значение поля id в таблице movie_detail.
+	movieID       int64     // Значение поля fk_movie_id в таблице movie_detail.
+	lang          string    // Язык названия и постера.
 	titleOriginal string    // Название фильма.
 	titleLower    string    // Название фильма в нижнем регистре.
+	titleKey      string    // Название фильма, приведённое к общему для кириллицы и латиницы виду (см. пакет translit).
 	releaseDate   time.Time // Время выхода фильма в кинотеатрах.
 	collectionID  int64     // Разные части одного фильма принадлежат одной коллекции.
 	editcost      int       // Стоимость приведения по алгоритму Левенштейна какого-либо фильма к titleOriginal. Чем меньше, тем лучше.
@@ -58,13 +65,19 @@ type Titles struct {
 	// Словарь из всех известных боту фильмов. Индексирование идёт по полю id
 	// таблицы movie_detail.
 	storage map[int64]titleInfo
-	mu      sync.RWMutex
-
-	titlesFetchStmt *sqlite.Stmt
+	// Индекс по n-граммам названий из storage, приведённых к общему для
+	// кириллицы и латиницы виду. Используется для отбора кандидатов, для
+	// которых считается расстояние Левенштейна.
+	index *ngram.Index
+	// Идентификаторы из storage для каждого фильма (поле fk_movie_id
+	// таблицы movie_detail), т.е. названия и постеры одного фильма на разных
+	// языках.
+	movies map[int64][]int64
+	mu     sync.RWMutex
 }
 
 // Загрузка из БД фильмов, которых ещё нет в t.
-func (t *Titles) loadNew() error {
+func (t *Titles) loadNew(ctx context.Context, conn *sqlite.Conn) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -76,15 +89,23 @@ func (t *Titles) loadNew() error {
 		}
 	}
 
-	rows, err := t.titlesFetchStmt.Query(maxID)
+	if t.movies == nil {
+		t.movies = map[int64][]int64{}
+	}
+
+	titlesStmt, err := conn.PrepareCached(titlesQuery)
+	if err != nil {
+		return err
+	}
+	rows, err := titlesStmt.QueryContext(ctx, maxID)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var id, collectionID int64
-		var title, releaseDateStr string
-		err = rows.Scan(&id, &title, &releaseDateStr, &collectionID)
+		var id, movieID, collectionID int64
+		var title, lang, releaseDateStr string
+		err = rows.Scan(&id, &movieID, &lang, &title, &releaseDateStr, &collectionID)
 		if err != nil {
 			return err
 		}
@@ -93,25 +114,42 @@ func (t *Titles) loadNew() error {
 			journal.Error(err)
 			releaseDate = time.Time{}
 		}
-		t.storage[id] = titleInfo{
+		tInfo := titleInfo{
 			id:            id,
+			movieID:       movieID,
+			lang:          lang,
 			titleOriginal: title,
 			titleLower:    strings.ToLower(title),
+			titleKey:      translit.Key(title),
 			releaseDate:   releaseDate,
 			collectionID:  collectionID,
 		}
+		t.storage[id] = tInfo
+		t.index.Add(id, tInfo.titleKey)
+		t.movies[movieID] = append(t.movies[movieID], id)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// bestMatches находит фильмы, которые лучше всего соответствуют фильму title.
+// bestMatches находит фильмы, которые лучше всего соответствуют запросу query.
+// Если в запросе указан год или диапазон годов, то рассматриваются только
+// фильмы, вышедшие в эти года. Если таких фильмов не нашлось, то год
+// считается частью названия фильма. fts - совпадения по полнотекстовому
+// индексу (см. ftsMatches), может быть nil.
 // Наилучшие соответствия находятся в начале возвращаемого слайса.
-func (t *Titles) bestMatches(title string) []titleInfo {
-	titleLower := strings.ToLower(strings.TrimSpace(title))
+func (t *Titles) bestMatches(query titleQuery, fts map[int64]float64) []titleInfo {
+	return rankMatches(t.levMatches(query, fts))
+}
+
+// levMatches находит не более 10 фильмов, ближайших к запросу query по
+// расстоянию Левенштейна (см. bestMatches). Фильмы упорядочены по
+// возрастанию editcost.
+func (t *Titles) levMatches(query titleQuery, fts map[int64]float64) []titleInfo {
+	titleLower := strings.ToLower(strings.TrimSpace(query.title))
 	if titleLower == "" {
 		return nil
 	}
@@ -119,25 +157,122 @@ func (t *Titles) bestMatches(title string) []titleInfo {
 	var titlesHeap titleInfoHeap
 	heap.Init(&titlesHeap)
 
-	// Находим 10 самых близких к фильму title фильмов по расстоянию Левенштейна.
-	t.mu.RLock()
-	for id, titleInfo := range t.storage {
-		levDist := levenshtein.Distance(titleLower, t.storage[id].titleLower, levInsCost, levDelCost, levSubCost)
-		titleInfo.editcost = levDist
+	scorer := newTitleScorer(titleLower, fts)
+	titleKey := scorer.titleKey
+
+	// Находим 10 самых близких к фильму title фильмов по расстоянию
+	// Левенштейна. Расстояние считается не для всех фильмов, а только для
+	// кандидатов, отобранных по индексу n-грамм.
+	// Названия, найденные по полнотекстовому индексу, тоже являются
+	// кандидатами, т.к. индекс n-грамм плохо находит названия по нескольким
+	// словам из них ("godfather part").
+	pushTitle := func(titleInfo titleInfo) {
+		if !query.yearMatches(titleInfo.releaseDate.Year()) {
+			return
+		}
+		titleInfo.editcost = scorer.editCost(titleInfo)
 		heap.Push(&titlesHeap, titleInfo)
 		if titlesHeap.Len() > 10 {
 			heap.Pop(&titlesHeap)
 		}
 	}
+	t.mu.RLock()
+	// Год проверяется ещё при отборе кандидатов, иначе фильм нужного года с
+	// распространённым названием может не попасть в maxTitleCandidates.
+	var keep func(id int64) bool
+	if query.hasYear() {
+		keep = func(id int64) bool {
+			return query.yearMatches(t.storage[id].releaseDate.Year())
+		}
+	}
+	candidates := t.index.CandidatesFunc(titleKey, maxTitleCandidates, keep)
+	seen := make(map[int64]struct{}, len(candidates))
+	for _, id := range candidates {
+		seen[id] = struct{}{}
+		pushTitle(t.storage[id])
+	}
+	for id := range fts {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		// В индексе есть и фильмы для взрослых, которых нет в t.storage.
+		if titleInfo, ok := t.storage[id]; ok {
+			seen[id] = struct{}{}
+			pushTitle(titleInfo)
+		}
+	}
+	// Если у title нет ни одной общей n-граммы ни с одним фильмом (например,
+	// title состоит из одной буквы), то перебираем все фильмы. Если общие
+	// n-граммы есть, но не у фильмов нужного года, то перебор не нужен.
+	if len(seen) == 0 && (keep == nil || len(t.index.Candidates(titleKey, 1)) == 0) {
+		for _, titleInfo := range t.storage {
+			pushTitle(titleInfo)
+		}
+	}
 	t.mu.RUnlock()
 
+	if titlesHeap.Len() == 0 && query.hasYear() {
+		return t.levMatches(query.withoutYear(), fts)
+	}
+
 	// titlesLevRanked должен содержать фильмы в порядке возрастания расстояния
 	// Левенштейна, т.е. самые близкие к title фильмы находятся в его начале.
 	titlesLevRanked := make([]titleInfo, titlesHeap.Len())
 	for i := len(titlesLevRanked) - 1; i >= 0; i-- {
 		titlesLevRanked[i] = heap.Pop(&titlesHeap).(titleInfo)
 	}
+	return titlesLevRanked
+}
+
+// titleScorer считает стоимость приведения названий фильмов к запросу.
+type titleScorer struct {
+	titleLower string            // Запрос в нижнем регистре.
+	titleKey   string            // Транслитерация запроса (см. пакет translit).
+	fts        map[int64]float64 // Совпадения по полнотекстовому индексу.
+	bestBM25   float64           // Лучшая (наименьшая) оценка bm25 в fts.
+}
+
+// newTitleScorer создаёт titleScorer для запроса titleLower. fts - совпадения
+// по полнотекстовому индексу (см. ftsMatches), может быть nil.
+func newTitleScorer(titleLower string, fts map[int64]float64) titleScorer {
+	s := titleScorer{
+		titleLower: titleLower,
+		titleKey:   translit.Key(titleLower),
+		fts:        fts,
+	}
+	for _, bm25 := range fts {
+		if bm25 < s.bestBM25 {
+			s.bestBM25 = bm25
+		}
+	}
+	return s
+}
 
+// editCost возвращает стоимость приведения названия фильма title к запросу.
+// Расстояние Левенштейна считается как между самими названиями, так и между
+// их транслитерациями, чтобы находились фильмы, название которых
+// пользователь ввёл другим алфавитом (Brat 2 - Брат 2). Совпадение по
+// транслитерации немного штрафуется, чтобы при прочих равных выше
+// оказывались прямые совпадения. Для названий, найденных по полнотекстовому
+// индексу, стоимость уменьшается тем сильнее, чем лучше их оценка bm25.
+func (s titleScorer) editCost(title titleInfo) int {
+	levDist := levenshtein.Distance(s.titleLower, title.titleLower, levInsCost, levDelCost, levSubCost)
+	if levDist > 0 {
+		translitDist := levenshtein.Distance(s.titleKey, title.titleKey, levInsCost, levDelCost, levSubCost) + translitPenalty
+		if translitDist < levDist {
+			levDist = translitDist
+		}
+	}
+	if bm25, ok := s.fts[title.id]; ok && s.bestBM25 < 0 {
+		levDist -= int(math.Round(ftsMaxBonus * bm25 / s.bestBM25))
+	}
+	return levDist
+}
+
+// rankMatches упорядочивает найденные фильмы с учётом ремейков и других
+// частей фильмов. titlesLevRanked должен быть упорядочен по возрастанию
+// editcost.
+func rankMatches(titlesLevRanked []titleInfo) []titleInfo {
 	// Если в начале titlesLevRanked содержит фильмы с одинаковыми названиями, то
 	// более выше ставим более позднее снятый фильм. Примером такого фильма
 	// является Lion King, который был снят в 1994 и 2019, т.е. выше в списке
@@ -211,6 +346,83 @@ func (t *Titles) bestMatches(title string) []titleInfo {
 	return titlesRanked
 }
 
+// localize заменяет фильмы из list на названия и постеры этих же фильмов на
+// языке lang, если они есть. Например, пользователь с русским языком,
+// набравший "Interstellar", получит русский постер. Повторы одного и того же
+// фильма на разных языках убираются.
+func (t *Titles) localize(list []titleInfo, lang string) []titleInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	localized := make([]titleInfo, 0, len(list))
+	seen := map[int64]struct{}{}
+	for _, title := range list {
+		if _, ok := seen[title.movieID]; ok {
+			continue
+		}
+		seen[title.movieID] = struct{}{}
+		if title.lang != lang {
+			for _, id := range t.movies[title.movieID] {
+				if sibling := t.storage[id]; sibling.lang == lang {
+					sibling.editcost = title.editcost
+					title = sibling
+					break
+				}
+			}
+		}
+		localized = append(localized, title)
+	}
+	return localized
+}
+
+// ftsMatches находит по полнотекстовому индексу movie_title_fts названия
+// фильмов, в которых есть слова, начинающиеся с каждого из слов title
+// (короткие слова должны совпадать целиком, см. ftsMinPrefixLen).
+// Возвращаются оценки bm25 найденных названий по их id в movie_detail.
+func ftsMatches(ctx context.Context, title string) (map[int64]float64, error) {
+	match := sqlite.FTS5PrefixQuery(title, ftsMinPrefixLen)
+	if match == "" {
+		return nil, nil
+	}
+
+	fts := map[int64]float64{}
+	err := withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(titleFTSQuery)
+		if err != nil {
+			return err
+		}
+		rows, err := stmt.QueryContext(ctx, match, maxFTSCandidates)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var bm25 float64
+			err = rows.Scan(&id, &bm25)
+			if err != nil {
+				return err
+			}
+			fts[id] = bm25
+		}
+		return rows.Err()
+	})
+	return fts, err
+}
+
+// searchTitles находит фильмы, которые лучше всего соответствуют запросу
+// пользователя text, и локализует их на язык lang. Если полнотекстовый поиск
+// не удался, то фильмы ищутся только по индексу n-грамм.
+func searchTitles(ctx context.Context, text string, lang iso6391.LangCode) []titleInfo {
+	query := parseTitleQuery(text)
+	fts, err := ftsMatches(ctx, query.title)
+	if err != nil {
+		journal.Error("full-text search failed: ", err)
+		fts = nil
+	}
+	return titles.localize(titles.bestMatches(query, fts), lang)
+}
+
 func (t *Titles) get(movieID int64) (titleInfo, error) {
 	t.mu.RLock()
 	tInfo, ok := t.storage[movieID]
@@ -222,125 +434,291 @@ func (t *Titles) get(movieID int64) (titleInfo, error) {
 }
 
 const (
-	// Таймаут выполнения запроса к БД.
+	// Таймаут выполнения запроса к БД. Столько же запрос ждёт свободного
+	// соединения из пула.
 	dbQueryTimeoutMS = 10000
-
-	// Извлечения постера фильма по его id в таблице movie_detail.
-	posterQuery = `
-SELECT poster
-  FROM movie_detail
- WHERE id = ?1;
+	// Количество соединений в пуле соединений бота с БД по-умолчанию.
+	dbPoolSizeDefault = 4
+
+	// Полнотекстовый поиск названий фильмов. Чем меньше значение bm25, тем
+	// лучше совпадение.
+	titleFTSQuery = `
+  SELECT rowid, bm25(movie_title_fts)
+    FROM movie_title_fts
+   WHERE movie_title_fts MATCH ?1
+ORDER BY bm25(movie_title_fts)
+   LIMIT ?2;
 `
 
 	// Извлечение фильмов выше определённого id.
 	titlesQuery = `
-   SELECT movie_detail.id, movie_detail.title, movie.released_on, movie.collection_id
+   SELECT movie_detail.id, movie_detail.fk_movie_id, movie_detail.lang, movie_detail.title, movie.released_on, movie.collection_id
      FROM movie_detail
 LEFT JOIN movie ON movie_detail.fk_movie_id = movie.id
     WHERE movie_detail.id > ?1 and movie.adult = 0
  ORDER BY movie_detail.id;
 `
 
+	// Извлечение значения из таблицы состояния бота.
+	botStateQuery = `
+SELECT value
+  FROM bot_state
+ WHERE name = ?1;
+`
+
+	// Сохранение значения в таблицу состояния бота.
+	botStateUpsertQuery = `
+INSERT INTO bot_state (name, value)
+     VALUES (?1, ?2)
+ON CONFLICT (name) DO UPDATE SET value = ?2;
+`
+
+	// Название значения в таблице bot_state, в котором хранится offset для
+	// метода getUpdates Telegram Bot API.
+	updateOffsetStateName = "telegram_update_offset"
+
+	// Способы получения сообщений от Telegram.
+	updateModeWebhook = "webhook" // Через webhook (по-умолчанию).
+	updateModePolling = "polling" // Через long polling (метод getUpdates).
+
+	// Время в секундах, в течение которого Telegram держит открытым запрос
+	// getUpdates, если новых сообщений нет.
+	pollTimeoutSec = 30
+	// Пауза перед повтором запроса getUpdates после ошибки.
+	pollRetryDelay = time.Second * 5
+
 	// Стоимости операций для алгоритма Левенштейна.
 	levInsCost = 1   // Вставка символа.
 	levDelCost = 7   // Удаление символа.
 	levSubCost = 100 // Замена символа.
+	// Штраф, который добавляется к расстоянию Левенштейна между
+	// транслитерациями названий фильмов.
+	translitPenalty = levInsCost
+
+	// Длина n-грамм в индексе названий фильмов.
+	titleNgramLen = 3
+	// Макс. количество кандидатов, которые отбираются по индексу n-грамм для
+	// подсчёта расстояния Левенштейна.
+	maxTitleCandidates = 300
+	// Макс. количество кандидатов, которые отбираются по полнотекстовому
+	// индексу названий movie_title_fts.
+	maxFTSCandidates = 100
+	// Слова запроса короче ftsMinPrefixLen символов ищутся в полнотекстовом
+	// индексе целиком, а не как начало слова (см. sqlite.FTS5PrefixQuery).
+	// Если более длинных слов в запросе нет, то полнотекстовый индекс не
+	// используется.
+	ftsMinPrefixLen = 3
+	// На сколько уменьшается расстояние Левенштейна для названия, лучше всех
+	// совпавшего по полнотекстовому индексу (по оценке bm25). Для остальных
+	// совпавших названий уменьшение пропорционально их оценке bm25. Бонус
+	// больше, чем обычно добавляет к расстоянию другой порядок слов в запросе,
+	// но меньше стоимости одной замены символа.
+	ftsMaxBonus = 50
 
 	// Макс. количество вариантов постеров, которые отправляются в ответ на
 	// запрос Telegram клиента.
 	maxResultsInResponse = 3
 
+	// Макс. количество постеров, которые отправляются в ответ на inline запрос.
+	maxInlineResults = 10
+	// Время в секундах, в течение которого Telegram может хранить у себя
+	// ответ на inline запрос.
+	inlineCacheTimeSec = 300
+	// Путь, по которому бот отдаёт постеры. Используется в ответах на inline
+	// запросы, т.к. Telegram сам скачивает постеры по ссылкам из ответа.
+	posterPath = "/poster/"
+
 	// Сообщения, которые отправляются при получении команды /start или /help.
 	greetingMessageEn       = `Please send me a movie title and you will get its poster.`
 	greetingMessageRu       = `Отправьте мне название фильма и я покажу его постер.`
-	helpMessageEn           = `Please send me a movie title like "Frozen" to get its poster.`
-	helpMessageRu           = `Отправьте мне название фильма, например "Фильм, фильм, фильм", чтобы увидеть его постер.`
+	greetingMessageUk       = `Надішліть мені назву фільму, і я покажу його постер.`
+	greetingMessageDe       = `Schick mir einen Filmtitel und ich zeige dir das Filmplakat.`
+	greetingMessageEs       = `Envíame el título de una película y te mostraré su póster.`
+	helpMessageEn           = `Please send me a movie title like "Frozen" to get its poster. Add a year or a range of years to choose between movies with the same title, e.g. "The Lion King 1994" or "Dune (1984-2021)". Send /lang to choose the poster language.`
+	helpMessageRu           = `Отправьте мне название фильма, например "Фильм, фильм, фильм", чтобы увидеть его постер. Чтобы выбрать один из фильмов с одинаковым названием, добавьте год или диапазон годов, например "Король Лев 1994" или "Дюна (1984-2021)". Чтобы выбрать язык постеров, отправьте /lang.`
+	helpMessageUk           = `Надішліть мені назву фільму, наприклад "Холодне серце", щоб побачити його постер. Щоб обрати один із фільмів з однаковою назвою, додайте рік або діапазон років, наприклад "Король Лев 1994" або "Дюна (1984-2021)". Щоб обрати мову постерів, надішліть /lang.`
+	helpMessageDe           = `Schick mir einen Filmtitel wie "Die Eiskönigin", um das Filmplakat zu sehen. Füge ein Jahr oder einen Zeitraum hinzu, um zwischen Filmen mit gleichem Titel zu wählen, z. B. "Der König der Löwen 1994" oder "Dune (1984-2021)". Schick /lang, um die Sprache der Filmplakate zu wählen.`
+	helpMessageEs           = `Envíame el título de una película, por ejemplo "Frozen", para ver su póster. Añade un año o un rango de años para elegir entre películas con el mismo título, por ejemplo "El rey león 1994" o "Dune (1984-2021)". Envía /lang para elegir el idioma de los pósteres.`
 	incorrectMessageReplyEn = `Please send a text message.`
 	incorrectMessageReplyRu = `Отправьте, пожалуйста, текстовое сообщение.`
+	incorrectMessageReplyUk = `Надішліть, будь ласка, текстове повідомлення.`
+	incorrectMessageReplyDe = `Bitte schick eine Textnachricht.`
+	incorrectMessageReplyEs = `Por favor, envía un mensaje de texto.`
 )
 
+// Сообщения бота на одном языке.
+type botMessages struct {
+	greeting         string
+	help             string
+	incorrectMessage string
+	// Ответы на команду /lang. Первый %s - код языка, второй - список
+	// доступных языков.
+	langCurrent     string
+	langChanged     string
+	langUnsupported string
+}
+
+// Переводы сообщений бота. Если для языка пользователя перевода нет, то
+// используются сообщения на английском.
+var translatedMessages = map[iso6391.LangCode]botMessages{
+	iso6391.En: {
+		greeting:         greetingMessageEn,
+		help:             helpMessageEn,
+		incorrectMessage: incorrectMessageReplyEn,
+		langCurrent:      `Posters are shown in language "%s" when available. To change it send /lang <code>, e.g. /lang en. Available languages: %s.`,
+		langChanged:      `Posters will be shown in language "%s" when available.`,
+		langUnsupported:  `Language "%s" is not supported. Available languages: %s.`,
+	},
+	iso6391.Ru: {
+		greeting:         greetingMessageRu,
+		help:             helpMessageRu,
+		incorrectMessage: incorrectMessageReplyRu,
+		langCurrent:      `Постеры показываются на языке "%s", если они есть. Чтобы сменить язык, отправьте /lang <код>, например /lang ru. Доступные языки: %s.`,
+		langChanged:      `Теперь постеры будут показываться на языке "%s", если они есть.`,
+		langUnsupported:  `Язык "%s" не поддерживается. Доступные языки: %s.`,
+	},
+	iso6391.Uk: {
+		greeting:         greetingMessageUk,
+		help:             helpMessageUk,
+		incorrectMessage: incorrectMessageReplyUk,
+		langCurrent:      `Постери показуються мовою "%s", якщо вони є. Щоб змінити мову, надішліть /lang <код>, наприклад /lang uk. Доступні мови: %s.`,
+		langChanged:      `Тепер постери показуватимуться мовою "%s", якщо вони є.`,
+		langUnsupported:  `Мова "%s" не підтримується. Доступні мови: %s.`,
+	},
+	iso6391.De: {
+		greeting:         greetingMessageDe,
+		help:             helpMessageDe,
+		incorrectMessage: incorrectMessageReplyDe,
+		langCurrent:      `Filmplakate werden, wenn vorhanden, in der Sprache "%s" angezeigt. Um sie zu ändern, schick /lang <Code>, z. B. /lang de. Verfügbare Sprachen: %s.`,
+		langChanged:      `Filmplakate werden jetzt, wenn vorhanden, in der Sprache "%s" angezeigt.`,
+		langUnsupported:  `Die Sprache "%s" wird nicht unterstützt. Verfügbare Sprachen: %s.`,
+	},
+	iso6391.Es: {
+		greeting:         greetingMessageEs,
+		help:             helpMessageEs,
+		incorrectMessage: incorrectMessageReplyEs,
+		langCurrent:      `Los pósteres se muestran en el idioma "%s" cuando están disponibles. Para cambiarlo, envía /lang <código>, por ejemplo /lang es. Idiomas disponibles: %s.`,
+		langChanged:      `Ahora los pósteres se mostrarán en el idioma "%s" cuando estén disponibles.`,
+		langUnsupported:  `El idioma "%s" no es compatible. Idiomas disponibles: %s.`,
+	},
+}
+
 var (
-	posterStmt *sqlite.Stmt
-	mu         sync.Mutex
+	// Пул соединений с БД, через которые обрабатываются сообщения от
+	// Telegram.
+	dbPool  *sqlite.Pool
+	posters posterStore
+
+	// Языки из настроек, на которых бот отвечает пользователям.
+	botLangs = map[iso6391.LangCode]struct{}{iso6391.En: {}, iso6391.Ru: {}}
 
-	titles      = Titles{storage: map[int64]titleInfo{}}
+	titles      = Titles{storage: map[int64]titleInfo{}, index: ngram.NewIndex(titleNgramLen)}
 	tlgrmClient *telegrambotapi.Client
+
+	// Адрес, по которому Telegram может скачать постеры, отдаваемые ботом по
+	// пути posterPath.
+	posterBaseURL string
 )
 
 type updateType = int
 
 // Виды сообщений от Telegram, которые умеет обрабатывать бот.
 const (
-	updateCommand           updateType = iota // Команда.
-	updateTextMessage                         // Обычное текстовое сообщение.
-	updateEditedTextMessage                   // Редактированное текстовое сообщение.
-	updateCallbackQuery                       // Нажатие кнопки ранее отправленной inline клавиатуры.
-	updateUnknown                             // Неизвестный вид сообщения.
+	updateCommand            updateType = iota // Команда.
+	updateTextMessage                          // Обычное текстовое сообщение.
+	updateEditedTextMessage                    // Редактированное текстовое сообщение.
+	updateCallbackQuery                        // Нажатие кнопки ранее отправленной inline клавиатуры.
+	updateInlineQuery                          // Inline запрос (@MoviePromoBot <название фильма> в любом чате).
+	updateChosenInlineResult                   // Выбор пользователем одного из результатов inline запроса.
+	updateUnknown                              // Неизвестный вид сообщения.
 )
 
 // bot настраивает общение по Telegram Bot API с пользователями Telegram.
-func bot(ctx context.Context, finished *sync.WaitGroup, cfg botConfig, dbName string) {
+func bot(ctx context.Context, finished *sync.WaitGroup, cfg botConfig, langs []iso6391.LangCode, dbName, posterDir string, titlesSchedule jobSchedule) {
 	goID := "[go bot]:"
 	journal.Replace(cfg.Token, "<telegram_token>")
 	journal.Info(goID, " started")
 
+	botLangs = map[iso6391.LangCode]struct{}{}
+	for _, lang := range langs {
+		botLangs[lang] = struct{}{}
+	}
+
 	defer func() {
 		finished.Done()
 		journal.Info(goID, " finished")
 	}()
 
-	// Установка соединения с БД и её настройка.
-	dbConn, err := sqlite.NewConn(dbName)
-	if err != nil {
-		journal.Fatal(err)
-	}
-	defer dbConn.Close()
-	journal.Info(goID, " connected to database "+dbName)
-
-	err = dbConn.SetBusyTimeout(dbQueryTimeoutMS)
-	if err != nil {
-		journal.Error(goID, " ", err)
+	// Создание пула соединений с БД и его настройка.
+	poolSize := cfg.DBPoolSize
+	if poolSize <= 0 {
+		poolSize = dbPoolSizeDefault
 	}
-	journal.Trace(goID, " set database busy timeout to ", dbQueryTimeoutMS, " ms")
-
-	// Подготавливаем запросы.
-	posterStmt, err = dbConn.Prepare(posterQuery)
+	var err error
+	dbPool, err = sqlite.NewPool(dbName, poolSize)
 	if err != nil {
 		journal.Fatal(goID, " ", err)
 	}
-	defer posterStmt.Close()
-	journal.Trace(goID, " poster query prepared")
+	defer dbPool.Close()
+	dbPool.SetBusyTimeout(dbQueryTimeoutMS)
+	journal.Info(goID, " using database "+dbName+" with pool of ", poolSize, " connections")
 
-	titles.titlesFetchStmt, err = dbConn.Prepare(titlesQuery)
+	posters, err = newPosterStore(posterDir)
 	if err != nil {
 		journal.Fatal(goID, " ", err)
 	}
-	defer titles.titlesFetchStmt.Close()
-	journal.Trace(goID, " titles query prepared")
 
-	// Горутина для периодического вычитывания новых фильмов из БД.
+	// Горутина для вычитывания новых фильмов из БД по расписанию titlesSchedule.
 	go func() {
+		next := titlesSchedule.first(time.Now())
 		for {
+			if !waitUntil(ctx, next) {
+				return
+			}
 			journal.Info(goID, " loading movie titles from database")
-			err = titles.loadNew()
+			// Загрузка всех названий может быть долгой, поэтому
+			// выполняется без таймаута withConn.
+			conn, err := dbPool.Get(ctx)
+			if err == nil {
+				err = titles.loadNew(ctx, conn)
+				dbPool.Put(conn)
+			}
 			if err == nil {
 				journal.Info(goID, " movie titles loading finished ok")
 			} else {
 				journal.Error(err)
 			}
-			// Спим до часа ночи по UTC следующего дня.
-			nextDay := time.Now().AddDate(0, 0, 1)
-			wakeupTime := time.Date(nextDay.Year(), nextDay.Month(), nextDay.Day(), 1, 0, 0, 0, time.UTC)
-			sleepDuration := time.Until(wakeupTime)
-			time.Sleep(sleepDuration)
+			next = titlesSchedule.next(time.Now())
+			journal.Info(goID, " next movie titles loading at ", next, " (", &titlesSchedule, ")")
 		}
 	}()
 
-	// Установка Webhook'а.
 	httpClient := &http.Client{
 		Timeout: time.Second * 10,
 	}
+	if cfg.UpdateMode == updateModePolling {
+		// При long polling'е запрос getUpdates может длиться до
+		// pollTimeoutSec секунд.
+		httpClient.Timeout += time.Second * pollTimeoutSec
+	}
 	tlgrmClient = telegrambotapi.NewClient(cfg.Token, cfg.BotAPIAddr, httpClient)
+
+	switch cfg.UpdateMode {
+	case updateModeWebhook, "":
+		runWebhook(ctx, goID, cfg)
+
+	case updateModePolling:
+		runPolling(ctx, goID, cfg)
+
+	default:
+		journal.Fatal(goID, " unknown update mode \""+cfg.UpdateMode+"\"")
+	}
+}
+
+// runWebhook получает сообщения от Telegram через webhook и обрабатывает их
+// до отмены ctx.
+func runWebhook(ctx context.Context, goID string, cfg botConfig) {
+	// Установка Webhook'а.
 	webhookInfo, err := tlgrmClient.GetWebhookInfo()
 	if err != nil {
 		journal.Fatal(goID, " ", err)
@@ -369,9 +747,19 @@ func bot(ctx context.Context, finished *sync.WaitGroup, cfg botConfig, dbName st
 		journal.Info(goID, " webhook is already set, skip webhook setting")
 	}
 
+	// Адрес для скачивания постеров. Сервера Telegram не скачивают файлы с
+	// серверов с самоподписанными сертификатами, поэтому для работы inline
+	// режима в настройках можно указать отдельный адрес, который, например,
+	// проксируется на бота через nginx.
+	posterBaseURL = strings.TrimSuffix(cfg.PosterBaseURL, "/")
+	if posterBaseURL == "" {
+		posterBaseURL = "https://" + net.JoinHostPort(cfg.WebhookAddr, strconv.Itoa(cfg.WebhookPort))
+	}
+
 	// Запускаем обработчик сообщений от Telegram.
 	server := http.Server{Addr: ":" + strconv.Itoa(cfg.WebhookPort)}
 	http.HandleFunc(webhookPath, telegramHandler)
+	http.HandleFunc(posterPath, posterHandler)
 	// Запускаем HTTP сервер в отдельной горутине, чтобы можно было его
 	// нормально остановить.
 	go func() {
@@ -381,14 +769,143 @@ func bot(ctx context.Context, finished *sync.WaitGroup, cfg botConfig, dbName st
 		}
 	}()
 
-	select {
-	case <-ctx.Done():
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second*60)
-		defer cancel()
-		err = server.Shutdown(timeoutCtx)
+	<-ctx.Done()
+	shutdownServer(&server)
+}
+
+// runPolling получает сообщения от Telegram через long polling (метод
+// getUpdates) и обрабатывает их до отмены ctx. Идентификатор последнего
+// обработанного сообщения сохраняется в БД, чтобы после перезапуска бота
+// сообщения не обрабатывались повторно.
+func runPolling(ctx context.Context, goID string, cfg botConfig) {
+	// Методом getUpdates нельзя пользоваться, пока у бота установлен webhook.
+	webhookInfo, err := tlgrmClient.GetWebhookInfo()
+	if err != nil {
+		journal.Fatal(goID, " ", err)
+	}
+	if webhookInfo.URL != "" {
+		err = tlgrmClient.DeleteWebhook()
 		if err != nil {
-			journal.Error(err)
+			journal.Fatal(goID, " ", err)
 		}
+		journal.Info(goID, " webhook deleted OK")
+	}
+
+	// Постеры для inline режима отдаются по HTTP, только если указан адрес,
+	// через который Telegram может их скачать. Предполагается, что этот адрес
+	// проксируется на порт cfg.WebhookPort.
+	var server *http.Server
+	if cfg.PosterBaseURL != "" {
+		posterBaseURL = strings.TrimSuffix(cfg.PosterBaseURL, "/")
+		server = &http.Server{Addr: ":" + strconv.Itoa(cfg.WebhookPort)}
+		http.HandleFunc(posterPath, posterHandler)
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				journal.Fatal(err)
+			}
+		}()
+	}
+
+	var offset int64
+	err = withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		offsetStmt, err := conn.PrepareCached(botStateQuery)
+		if err != nil {
+			return err
+		}
+		err = offsetStmt.QueryRowContext(ctx, updateOffsetStateName).Scan(&offset)
+		if err == sqlite.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		journal.Fatal(goID, " ", err)
+	}
+	journal.Info(goID, " polling for updates starting from offset ", offset)
+
+	for {
+		updates, err := tlgrmClient.GetUpdates(ctx, int(offset), pollTimeoutSec)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			journal.Error(goID, " ", err)
+			// Пауза перед следующей попыткой, чтобы не заваливать Telegram
+			// запросами, если он недоступен.
+			timer := time.NewTimer(pollRetryDelay)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			break
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		// Сообщения обрабатываются параллельно, как и при работе через
+		// webhook.
+		var wg sync.WaitGroup
+		for i := range updates {
+			wg.Add(1)
+			go func(update *telegrambotapi.Update) {
+				defer wg.Done()
+				err := processUpdate(ctx, update)
+				if err != nil {
+					journal.Error(err)
+				}
+			}(&updates[i])
+		}
+		wg.Wait()
+
+		// Следующий вызов getUpdates с новым offset'ом подтверждает получение
+		// всех обработанных сообщений.
+		offset = int64(updates[len(updates)-1].ID) + 1
+		// Offset сохраняется и при остановке бота, поэтому запрос
+		// выполняется не в ctx.
+		err = withConn(context.Background(), dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+			offsetUpsertStmt, err := conn.PrepareCached(botStateUpsertQuery)
+			if err != nil {
+				return err
+			}
+			_, err = offsetUpsertStmt.ExecContext(ctx, updateOffsetStateName, offset)
+			return err
+		})
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
+	}
+
+	if server != nil {
+		shutdownServer(server)
+	}
+}
+
+// withConn выполняет f с соединением из пула pool. На ожидание свободного
+// соединения и выполнение запросов f отводится dbQueryTimeoutMS: f получает
+// контекст с таким дедлайном, который также отменяется вместе с ctx.
+func withConn(ctx context.Context, pool *sqlite.Pool, f func(ctx context.Context, conn *sqlite.Conn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, dbQueryTimeoutMS*time.Millisecond)
+	defer cancel()
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Put(conn)
+	return f(ctx, conn)
+}
+
+// shutdownServer останавливает HTTP сервер, давая время на завершение
+// обработки текущих запросов.
+func shutdownServer(server *http.Server) {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	err := server.Shutdown(timeoutCtx)
+	if err != nil {
+		journal.Error(err)
 	}
 }
 
@@ -401,8 +918,6 @@ func telegramHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	updateReceiveTime := time.Now()
-
 	var update telegrambotapi.Update
 	err = json.Unmarshal(body, &update)
 	if err != nil {
@@ -411,31 +926,64 @@ func telegramHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	err = processUpdate(req.Context(), &update)
+	if err != nil {
+		journal.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// processUpdate обрабатывает сообщение от Telegram. Ответы на сообщение
+// отправляются отдельными запросами к Telegram Bot API, а не в ответе на
+// webhook запрос, т.к. боту нужен результат их выполнения (например, file_id
+// загруженного постера).
+func processUpdate(ctx context.Context, update *telegrambotapi.Update) error {
+	updateReceiveTime := time.Now()
 	journal.Info("telegram update [id " + strconv.Itoa(update.ID) + "] received")
+	defer func() {
+		journal.Info("telegram update [id ", update.ID, "] processing end (", time.Since(updateReceiveTime), ")")
+	}()
 
-	switch getUpdateType(&update) {
+	switch getUpdateType(update) {
 	// Получена команда.
 	case updateCommand:
 		reply := ""
 		// Выбираем сообщение, которое нужно отправить в зависимости от команды и языка.
-		if strings.HasPrefix(update.Message.Text, "/start") {
-			reply = greetingMessageEn
-			if update.Message.From.LangCode == iso6391.Ru {
-				reply = greetingMessageRu
+		lang := userLang(ctx, update.Message.From)
+		messages := userMessages(lang)
+		args := strings.Fields(update.Message.Text)
+		command := args[0]
+		if i := strings.Index(command, "@"); i != -1 {
+			command = command[:i] // Команда вида /start@MoviePromoBot.
+		}
+		switch command {
+		case "/start":
+			reply = messages.greeting
+		case "/help":
+			reply = messages.help
+		case "/lang":
+			if len(args) < 2 {
+				reply = fmt.Sprintf(messages.langCurrent, lang, availableLangs())
+				break
 			}
-		} else if strings.HasPrefix(update.Message.Text, "/help") {
-			reply = helpMessageEn
-			if update.Message.From.LangCode == iso6391.Ru {
-				reply = helpMessageRu
+			newLang := strings.ToLower(args[1])
+			if _, ok := botLangs[newLang]; !ok {
+				reply = fmt.Sprintf(messages.langUnsupported, args[1], availableLangs())
+				break
+			}
+			err := choosePreferredLang(ctx, update.Message.From, newLang)
+			if err != nil {
+				return err
 			}
+			journal.Info("user [id ", update.Message.From.ID, "] has chosen language ", newLang)
+			reply = fmt.Sprintf(userMessages(newLang).langChanged, newLang)
 		}
 
 		if reply != "" {
 			err := tlgrmClient.SendMessage(update.Message.Chat.ID, reply)
 			if err != nil {
-				journal.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
 		}
 
@@ -454,93 +1002,99 @@ func telegramHandler(w http.ResponseWriter, req *http.Request) {
 			message = update.EditedMessage
 			replyToMessageID = message.ID
 		}
-		sendPhoto, contentType, err := makeSendPhoto(message.Text, message.Chat.ID, replyToMessageID)
-		if err != nil {
-			journal.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", contentType)
-		_, err = w.Write(sendPhoto)
-		if err != nil {
-			journal.Error(err)
-			return
+		lang := userLang(ctx, message.From)
+		bestMatchTitles := searchTitles(ctx, message.Text, lang)
+		if len(bestMatchTitles) == 0 {
+			return errors.New("no match in movies database")
 		}
+		return sendPoster(ctx, "sendPhoto", bestMatchTitles[0].id, func(photo posterPhoto) ([]byte, string, error) {
+			return makeSendPhoto(bestMatchTitles, photo, message.Chat.ID, replyToMessageID)
+		})
 
 	// Пользователь нажал на кнопку ранее отправленного сообщения с inline клавиатурой.
 	case updateCallbackQuery:
 		// При нажатии какой-либо кнопки inline клавиатуры необходимо вызывать
 		// метод AnswerCallbackQuery Telegram Bot API, чтобы исчез белый круг
 		// прогресса на кнопке.
-		err = tlgrmClient.AnswerCallbackQuery(update.CallbackQuery.ID)
+		err := tlgrmClient.AnswerCallbackQuery(update.CallbackQuery.ID)
 		if err != nil {
 			journal.Error(err)
-			return
+			return nil
 		}
 
-		editMessageMedia, contentType, err := makeEditMessageMedia(&update.CallbackQuery)
+		// Каждая кнопка inline клавиатуры должна показывать постер при
+		// нажатии на неё. Этот постер можно получить из таблицы movie_detail
+		// по ID, который хранится в CallbackQuery.Data. См. также в функции
+		// makeSendPhoto место, где создаётся клавиатура.
+		movieID, err := strconv.ParseInt(update.CallbackQuery.Data, 10, 64)
 		if err != nil {
-			journal.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		w.Header().Set("Content-Type", contentType)
-		_, err = w.Write(editMessageMedia)
+		title, err := titles.get(movieID)
 		if err != nil {
-			journal.Error(err)
-			return
+			return err
 		}
+		return sendPoster(ctx, "editMessageMedia", movieID, func(photo posterPhoto) ([]byte, string, error) {
+			return makeEditMessageMedia(&update.CallbackQuery, title, photo)
+		})
 
-	case updateUnknown:
-		reply := incorrectMessageReplyEn
-		if update.Message.From.LangCode == iso6391.Ru {
-			reply = incorrectMessageReplyRu
+	// Пользователь набрал в каком-то чате имя бота и название фильма.
+	case updateInlineQuery:
+		results := makeInlineQueryResults(ctx, update.InlineQuery.Query, userLang(ctx, update.InlineQuery.From))
+		err := tlgrmClient.AnswerInlineQuery(update.InlineQuery.ID, results, inlineCacheTimeSec)
+		if err != nil {
+			return err
 		}
+
+	// Пользователь выбрал один из постеров, отправленных в ответ на inline запрос.
+	case updateChosenInlineResult:
+		journal.Info("inline result [id " + update.ChosenInlineResult.ResultID + "] chosen for query \"" + update.ChosenInlineResult.Query + "\"")
+
+	case updateUnknown:
+		reply := userMessages(userLang(ctx, update.Message.From)).incorrectMessage
 		err := tlgrmClient.SendMessage(update.Message.Chat.ID, reply)
 		if err != nil {
-			journal.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
 	}
 
-	journal.Info("telegram update [id ", update.ID, "] processing end (", time.Since(updateReceiveTime), ")")
+	return nil
 }
 
-// makeSendPhoto возвращает сообщение sendPhoto из Telegram Bot API:
-// https://core.telegram.org/bots/api#sendphoto
-// Если replyToMessageID не равен 0, то в возвращаемое sendPhoto сообщение
-// добавляется параметр reply_to_message_id.
-// Параметр типа string после сообщения - это значение заголовка Content-Type.
-func makeSendPhoto(userInput string, chatID int64, replyToMessageID int) ([]byte, string, error) {
-	bestMatchTitles := titles.bestMatches(userInput)
-	if len(bestMatchTitles) == 0 {
-		return nil, "", errors.New("no match in movies database")
+// userLang возвращает предпочитаемый язык пользователя. При ошибке
+// обращения к БД возвращается язык Telegram клиента пользователя.
+func userLang(ctx context.Context, user telegrambotapi.User) iso6391.LangCode {
+	lang, err := preferredLang(ctx, user)
+	if err != nil {
+		journal.Error("cannot get user [id ", user.ID, "] language: ", err)
 	}
+	return lang
+}
 
-	var poster []byte
-	mu.Lock()
-	err := posterStmt.QueryRow(bestMatchTitles[0].id).Scan(&poster)
-	mu.Unlock()
-	if err != nil {
-		return nil, "", errors.New("cannot fetch poster from database")
+// userMessages возвращает сообщения бота на языке пользователя lang. Если
+// языка пользователя нет в настройках или для него нет перевода, то
+// возвращаются сообщения на английском.
+func userMessages(lang iso6391.LangCode) botMessages {
+	if _, ok := botLangs[lang]; ok {
+		if messages, ok := translatedMessages[lang]; ok {
+			return messages
+		}
 	}
+	return translatedMessages[iso6391.En]
+}
 
+// makeSendPhoto возвращает параметры метода sendPhoto из Telegram Bot API:
+// https://core.telegram.org/bots/api#sendphoto
+// Отправляется постер первого фильма из bestMatchTitles, остальные фильмы
+// доступны через inline клавиатуру. Если replyToMessageID не равен 0, то
+// добавляется параметр reply_to_message_id.
+// Параметр типа string после параметров - это значение заголовка Content-Type.
+func makeSendPhoto(bestMatchTitles []titleInfo, photo posterPhoto, chatID int64, replyToMessageID int) ([]byte, string, error) {
 	var buf bytes.Buffer
 	mw := multipart.NewWriter(&buf)
 
-	// Параметр method.
-	fw, err := mw.CreateFormField("method")
-	if err != nil {
-		return nil, "", err
-	}
-	_, err = fw.Write([]byte("sendPhoto"))
-	if err != nil {
-		return nil, "", err
-	}
-
 	// Параметр chat_id.
-	fw, err = mw.CreateFormField("chat_id")
+	fw, err := mw.CreateFormField("chat_id")
 	if err != nil {
 		return nil, "", err
 	}
@@ -549,9 +1103,21 @@ func makeSendPhoto(userInput string, chatID int64, replyToMessageID int) ([]byte
 		return nil, "", err
 	}
 
-	// Параметр photo.
-	fw, err = mw.CreateFormFile("photo", "image") // Вместо "image" может быть любое другое название.
-	_, err = fw.Write(poster)
+	// Параметр photo. Это либо file_id ранее загруженного постера, либо сам
+	// постер.
+	if photo.fileID != "" {
+		fw, err = mw.CreateFormField("photo")
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = fw.Write([]byte(photo.fileID))
+	} else {
+		fw, err = mw.CreateFormFile("photo", "image") // Вместо "image" может быть любое другое название.
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = fw.Write(photo.image)
+	}
 	if err != nil {
 		return nil, "", err
 	}
@@ -561,11 +1127,7 @@ func makeSendPhoto(userInput string, chatID int64, replyToMessageID int) ([]byte
 	if err != nil {
 		return nil, "", err
 	}
-	posterCaption := bestMatchTitles[0].titleOriginal
-	if !bestMatchTitles[0].releaseDate.IsZero() {
-		posterCaption += " (" + strconv.Itoa(bestMatchTitles[0].releaseDate.Year()) + ")"
-	}
-	_, err = fw.Write([]byte(posterCaption))
+	_, err = fw.Write([]byte(posterCaption(bestMatchTitles[0])))
 	if err != nil {
 		return nil, "", err
 	}
@@ -622,26 +1184,17 @@ func makeSendPhoto(userInput string, chatID int64, replyToMessageID int) ([]byte
 	return buf.Bytes(), mw.FormDataContentType(), nil
 }
 
-// makeEditMessageMedia формирует сообщение, которое должно быть выслано в
-// ответ на нажатие пользователем какой-либо кнопки inline клавиатуры.  Второй
+// makeEditMessageMedia формирует параметры метода editMessageMedia, который
+// выполняется в ответ на нажатие пользователем какой-либо кнопки inline
+// клавиатуры. В сообщении показывается постер фильма title. Второй
 // возвращаемый параметр типа string - это значения заголовка Content-Type.
 // https://core.telegram.org/bots/api#editmessagemedia
-func makeEditMessageMedia(callbackQuery *telegrambotapi.CallbackQuery) ([]byte, string, error) {
+func makeEditMessageMedia(callbackQuery *telegrambotapi.CallbackQuery, title titleInfo, photo posterPhoto) ([]byte, string, error) {
 	var buf bytes.Buffer
 	mw := multipart.NewWriter(&buf)
 
-	// Параметр method.
-	fw, err := mw.CreateFormField("method")
-	if err != nil {
-		return nil, "", err
-	}
-	_, err = fw.Write([]byte("editMessageMedia"))
-	if err != nil {
-		return nil, "", err
-	}
-
 	// Параметр chat_id.
-	fw, err = mw.CreateFormField("chat_id")
+	fw, err := mw.CreateFormField("chat_id")
 	if err != nil {
 		return nil, "", err
 	}
@@ -666,27 +1219,16 @@ func makeEditMessageMedia(callbackQuery *telegrambotapi.CallbackQuery) ([]byte,
 		return nil, "", err
 	}
 
-	// Каждая кнопка inline клавиатуры должна показывать постер при нажатии на
-	// неё. Этот постер можно получить из таблицы movie_detail по ID, который
-	// хранится в callbackQuery.Data. См. также в функции makeSendPhoto место,
-	// где создаётся клавиатура.
-	movieID, err := strconv.ParseInt(callbackQuery.Data, 10, 64)
-	if err != nil {
-		return nil, "", err
-	}
-	title, err := titles.get(movieID)
-	if err != nil {
-		return nil, "", err
-	}
-
+	// Постер передаётся либо через file_id ранее загруженного постера, либо
+	// отдельным параметром photo.
 	photoFieldName := "photo"
 	inputMediaPhoto := telegrambotapi.InputMediaPhoto{
 		Type:    "photo",
 		Media:   "attach://" + photoFieldName,
-		Caption: title.titleOriginal,
+		Caption: posterCaption(title),
 	}
-	if !title.releaseDate.IsZero() {
-		inputMediaPhoto.Caption += " (" + strconv.Itoa(title.releaseDate.Year()) + ")"
+	if photo.fileID != "" {
+		inputMediaPhoto.Media = photo.fileID
 	}
 	inputMediaPhotoJSONed, err := json.Marshal(inputMediaPhoto)
 	if err != nil {
@@ -697,18 +1239,16 @@ func makeEditMessageMedia(callbackQuery *telegrambotapi.CallbackQuery) ([]byte,
 		return nil, "", err
 	}
 
-	var poster []byte
-	mu.Lock()
-	err = posterStmt.QueryRow(movieID).Scan(&poster)
-	mu.Unlock()
-	if err != nil {
-		return nil, "", errors.New("cannot fetch poster from database")
-	}
 	// Параметр photo.
-	fw, err = mw.CreateFormFile(photoFieldName, "image") // Вместо "image" может быть любое другое название.
-	_, err = fw.Write(poster)
-	if err != nil {
-		return nil, "", err
+	if photo.fileID == "" {
+		fw, err = mw.CreateFormFile(photoFieldName, "image") // Вместо "image" может быть любое другое название.
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = fw.Write(photo.image)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
 	// Параметр reply_markup.
@@ -749,6 +1289,105 @@ func makeEditMessageMedia(callbackQuery *telegrambotapi.CallbackQuery) ([]byte,
 	return buf.Bytes(), mw.FormDataContentType(), nil
 }
 
+// makeInlineQueryResults формирует ответ на inline запрос query из постеров
+// фильмов, которые лучше всего соответствуют query. Постеры по возможности
+// выбираются на языке пользователя lang.
+// https://core.telegram.org/bots/api#answerinlinequery
+func makeInlineQueryResults(ctx context.Context, query string, lang iso6391.LangCode) []interface{} {
+	results := []interface{}{}
+	for i, title := range searchTitles(ctx, query, lang) {
+		if i >= maxInlineResults {
+			break
+		}
+		// Постер, уже загруженный в Telegram, отправляется по file_id, чтобы
+		// Telegram не скачивал его заново с бота.
+		fileID, err := getPosterFileID(ctx, title.id)
+		if err != nil {
+			journal.Error("cannot get poster [id ", title.id, "] file_id: ", err)
+		}
+		if fileID != "" {
+			results = append(results, telegrambotapi.InlineQueryResultCachedPhoto{
+				Type:        "photo",
+				ID:          strconv.FormatInt(title.id, 10),
+				PhotoFileID: fileID,
+				Title:       title.titleOriginal,
+				Caption:     posterCaption(title),
+			})
+			continue
+		}
+		posterURL := posterBaseURL + posterPath + strconv.FormatInt(title.id, 10)
+		results = append(results, telegrambotapi.InlineQueryResultPhoto{
+			Type:     "photo",
+			ID:       strconv.FormatInt(title.id, 10),
+			PhotoURL: posterURL,
+			ThumbURL: posterURL,
+			Title:    title.titleOriginal,
+			Caption:  posterCaption(title),
+		})
+	}
+	return results
+}
+
+// posterHandler отдаёт постер фильма по пути вида /poster/<id>, где <id> -
+// значение поля id в таблице movie_detail. Отдаются только постеры фильмов,
+// которые известны боту, т.е. тех, которые могут быть найдены по названию.
+func posterHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	movieID, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, posterPath), 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	_, err = titles.get(movieID)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	poster, err := getPoster(req.Context(), movieID)
+	if err != nil {
+		journal.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(poster))
+	w.Header().Set("Content-Length", strconv.Itoa(len(poster)))
+	_, err = w.Write(poster)
+	if err != nil {
+		journal.Error(err)
+	}
+}
+
+// getPoster извлекает из хранилища постер фильма с идентификатором movieID в
+// таблице movie_detail.
+func getPoster(ctx context.Context, movieID int64) ([]byte, error) {
+	var poster []byte
+	err := withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		var err error
+		poster, err = posters.get(ctx, conn, movieID)
+		return err
+	})
+	if err != nil {
+		journal.Error("poster [id ", movieID, "] fetch error: ", err)
+		return nil, errors.New("cannot fetch poster from store")
+	}
+	return poster, nil
+}
+
+// posterCaption формирует подпись к постеру фильма: название фильма и год его
+// выхода.
+func posterCaption(title titleInfo) string {
+	caption := title.titleOriginal
+	if !title.releaseDate.IsZero() {
+		caption += " (" + strconv.Itoa(title.releaseDate.Year()) + ")"
+	}
+	return caption
+}
+
 // Определение типа сообщения, которые был получен от Telegram.
 func getUpdateType(update *telegrambotapi.Update) updateType {
 	switch {
@@ -767,6 +1406,12 @@ func getUpdateType(update *telegrambotapi.Update) updateType {
 
 	case update.CallbackQuery.ID != "":
 		return updateCallbackQuery
+
+	case update.InlineQuery.ID != "":
+		return updateInlineQuery
+
+	case update.ChosenInlineResult.ResultID != "":
+		return updateChosenInlineResult
 	}
 
 	return updateUnknown
@@ -0,0 +1,874 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/ngram"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+	"github.com/source-farm/movie-promo-bot/telegrambotapi/telegrambotapitest"
+	"github.com/source-farm/movie-promo-bot/translit"
+)
+
+const testBotToken = "123456:TEST"
+
+// Фильмы, которые добавляются в тестовую БД.
+var testMovies = []struct {
+	id           int64
+	title        string
+	lang         string
+	releasedOn   string
+	adult        bool
+	collectionID int64
+}{
+	{1, "The Lion King", "en", "1994-06-23", false, 94032},
+	{2, "The Lion King", "en", "2019-07-12", false, 0},
+	{3, "Брат 2", "ru", "2000-05-11", false, 0},
+	{4, "The Lion King 2: Simba's Pride", "en", "1998-10-27", false, 94032},
+	{5, "Frozen", "en", "2013-11-20", false, 386382},
+	{6, "Frozen II", "en", "2019-11-20", false, 386382},
+	{7, "Adult Movie", "en", "2010-01-01", true, 0},
+	{8, "Interstellar", "en", "2014-11-05", false, 0},
+}
+
+// Названия и постеры фильмов из testMovies на других языках.
+var testSiblings = []struct {
+	id      int64
+	movieID int64
+	lang    string
+	title   string
+}{
+	{105, 5, "ru", "Холодное сердце"},
+	{108, 8, "ru", "Интерстеллар"},
+	{118, 8, "uk", "Інтерстеллар"},
+}
+
+// testPoster возвращает содержимое постера фильма с идентификатором id.
+func testPoster(id int64) []byte {
+	return []byte("poster of movie #" + strconv.FormatInt(id, 10))
+}
+
+// setupTestBot создаёт тестовую БД с фильмами из testMovies, загружает
+// названия фильмов и настраивает бота на работу с поддельным сервером
+// Telegram Bot API.
+func setupTestBot(t *testing.T) (*telegrambotapitest.Server, *sqlite.Conn) {
+	dir, err := ioutil.TempDir("", "movie-promo-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dbName := filepath.Join(dir, "test.db")
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movieStmt, err := conn.Prepare(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult, collection_id)
+     VALUES (?1, ?1, ?2, ?3, ?4, ?5, ?6);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detailStmt, err := conn.Prepare(`
+INSERT INTO movie_detail (id, fk_movie_id, lang, title, poster)
+     VALUES (?1, ?2, ?3, ?4, ?5);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, movie := range testMovies {
+		_, err = movieStmt.Exec(movie.id, movie.title, movie.lang, movie.releasedOn, movie.adult, movie.collectionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = detailStmt.Exec(movie.id, movie.id, movie.lang, movie.title, testPoster(movie.id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sibling := range testSiblings {
+		_, err = detailStmt.Exec(sibling.id, sibling.movieID, sibling.lang, sibling.title, testPoster(sibling.id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	movieStmt.Close()
+	detailStmt.Close()
+
+	posters, err = newPosterStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPool, err = sqlite.NewPool(dbName, dbPoolSizeDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPool.SetBusyTimeout(dbQueryTimeoutMS)
+	titles = Titles{storage: map[int64]titleInfo{}, index: ngram.NewIndex(titleNgramLen)}
+	err = titles.loadNew(context.Background(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	botLangs = map[iso6391.LangCode]struct{}{iso6391.En: {}, iso6391.Ru: {}}
+	server := telegrambotapitest.NewServer(testBotToken)
+	tlgrmClient = server.Client()
+	posterBaseURL = "https://example.com"
+
+	t.Cleanup(func() {
+		server.Close()
+		dbPool.Close()
+		conn.Close()
+	})
+	return server, conn
+}
+
+// textUpdate формирует сообщение от пользователя с текстом text.
+func textUpdate(text string) telegrambotapi.Update {
+	update := telegrambotapi.Update{
+		ID: 1,
+		Message: telegrambotapi.Message{
+			ID:   10,
+			From: telegrambotapi.User{ID: 100, FirstName: "User", LangCode: "en"},
+			Chat: telegrambotapi.Chat{ID: 100, Type: "private"},
+			Text: text,
+		},
+	}
+	if strings.HasPrefix(text, "/") {
+		update.Message.Entity = []telegrambotapi.Entity{{Type: "bot_command", Offset: 0, Length: len(text)}}
+	}
+	return update
+}
+
+// pushText отправляет боту сообщение с текстом text и проверяет, что бот
+// ответил постером.
+func pushText(t *testing.T, server *telegrambotapitest.Server, text string) telegrambotapitest.Call {
+	t.Helper()
+	return pushUpdate(t, server, textUpdate(text), "sendPhoto")
+}
+
+// pushUpdate отправляет боту сообщение update и возвращает последний вызов
+// метода method, которым бот ответил на сообщение.
+func pushUpdate(t *testing.T, server *telegrambotapitest.Server, update telegrambotapi.Update, method string) telegrambotapitest.Call {
+	t.Helper()
+	callsBefore := len(server.CallsTo(method))
+	reply, err := server.PushUpdate(http.HandlerFunc(telegramHandler), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		t.Fatalf("Expected empty webhook reply, got %+v", reply)
+	}
+	calls := server.CallsTo(method)
+	if len(calls) != callsBefore+1 {
+		t.Fatalf("Expected %s call in reply to update %d, got %d", method, update.ID, len(calls)-callsBefore)
+	}
+	return calls[len(calls)-1]
+}
+
+// sentPhoto возвращает постер, отправленный вызовом call, а также признак
+// того, что постер был загружен, а не отправлен через file_id.
+func sentPhoto(t *testing.T, server *telegrambotapitest.Server, call telegrambotapitest.Call) ([]byte, bool) {
+	t.Helper()
+	fileID := call.Params["photo"]
+	if call.Method == "editMessageMedia" {
+		var media telegrambotapi.InputMediaPhoto
+		err := json.Unmarshal([]byte(call.Params["media"]), &media)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileID = media.Media
+	}
+	if photo, ok := call.Files["photo"]; ok {
+		return photo, true
+	}
+	photo, ok := server.File(fileID)
+	if !ok {
+		t.Fatalf("Unknown file_id %q in %s call", fileID, call.Method)
+	}
+	return photo, false
+}
+
+func TestBotCommands(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	testCases := []commandTestCase{
+		{"/start", "en", greetingMessageEn},
+		{"/start", "ru", greetingMessageRu},
+		{"/help", "en", helpMessageEn},
+		{"/help", "ru", helpMessageRu},
+		// Языка нет в настройках.
+		{"/start", "uk", greetingMessageEn},
+		{"/start", "de-DE", greetingMessageEn},
+	}
+	runCommands(t, server, testCases)
+
+	botLangs[iso6391.Uk] = struct{}{}
+	botLangs[iso6391.De] = struct{}{}
+	testCases = []commandTestCase{
+		{"/start", "uk", greetingMessageUk},
+		{"/help", "de-DE", helpMessageDe},
+		// Для языка нет перевода.
+		{"/start", "es", greetingMessageEn},
+	}
+	runCommands(t, server, testCases)
+}
+
+// Команда боту от пользователя с языком lang и ожидаемый ответ на неё.
+type commandTestCase struct {
+	command  string
+	lang     string
+	expected string
+}
+
+// runCommands отправляет боту команды и проверяет ответы на них.
+func runCommands(t *testing.T, server *telegrambotapitest.Server, testCases []commandTestCase) {
+	t.Helper()
+	for _, tc := range testCases {
+		server.Reset()
+		update := textUpdate(tc.command)
+		update.Message.From.LangCode = tc.lang
+		call, err := server.PushUpdate(http.HandlerFunc(telegramHandler), update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if call != nil {
+			t.Fatalf("Expected empty webhook reply to %s, got %+v", tc.command, call)
+		}
+		calls := server.CallsTo("sendMessage")
+		if len(calls) != 1 {
+			t.Fatalf("Expected 1 sendMessage call for %s, got %d", tc.command, len(calls))
+		}
+		if calls[0].Params["chat_id"] != "100" || calls[0].Params["text"] != tc.expected {
+			t.Fatalf("Unexpected reply to %s (%s): %v", tc.command, tc.lang, calls[0].Params)
+		}
+	}
+}
+
+func TestBotTextMessage(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	testCases := []struct {
+		text    string
+		caption string
+		movieID int64
+	}{
+		// Из фильмов с одинаковым названием выше должен быть более новый.
+		{"lion king", "The Lion King (2019)", 2},
+		// Год в запросе позволяет выбрать нужный фильм.
+		{"Lion King 1994", "The Lion King (1994)", 1},
+		{"Lion King (2019)", "The Lion King (2019)", 2},
+		{"frozen 2015-2020", "Frozen II (2019)", 6},
+		// Транслитерация.
+		{"Brat 2", "Брат 2 (2000)", 3},
+		{"Фрозен", "Frozen (2013)", 5},
+		// Слова названия в другом порядке находятся по полнотекстовому индексу.
+		{"simba king", "The Lion King 2: Simba's Pride (1998)", 4},
+	}
+	for _, tc := range testCases {
+		call := pushText(t, server, tc.text)
+		if call.Params["caption"] != tc.caption {
+			t.Fatalf("Expected caption %q for %q, got %q", tc.caption, tc.text, call.Params["caption"])
+		}
+		if call.Params["chat_id"] != "100" {
+			t.Fatalf("Unexpected chat_id %q", call.Params["chat_id"])
+		}
+		if photo, _ := sentPhoto(t, server, call); string(photo) != string(testPoster(tc.movieID)) {
+			t.Fatalf("Unexpected poster for %q", tc.text)
+		}
+	}
+}
+
+func TestBotAdultMovie(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	call := pushText(t, server, "Adult Movie")
+	if photo, _ := sentPhoto(t, server, call); string(photo) == string(testPoster(7)) {
+		t.Fatal("Adult movie poster is sent")
+	}
+
+	recorder := httptest.NewRecorder()
+	posterHandler(recorder, httptest.NewRequest(http.MethodGet, posterPath+"7", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Expected adult movie poster to be not found, got %d", recorder.Code)
+	}
+}
+
+func TestBotCallbackQuery(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	call := pushText(t, server, "lion king")
+	var keyboard telegrambotapi.InlineKeyboardMarkup
+	err := json.Unmarshal([]byte(call.Params["reply_markup"]), &keyboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyboard.InlineKeyboard) != 1 || len(keyboard.InlineKeyboard[0]) < 2 {
+		t.Fatalf("Unexpected keyboard %+v", keyboard)
+	}
+	buttons := keyboard.InlineKeyboard[0]
+	if buttons[0].Text != "- 1 -" || buttons[1].Text != "2" {
+		t.Fatalf("Unexpected buttons %+v", buttons)
+	}
+
+	// Нажимаем на вторую кнопку.
+	update := telegrambotapi.Update{
+		ID: 2,
+		CallbackQuery: telegrambotapi.CallbackQuery{
+			ID:   "callback-1",
+			From: telegrambotapi.User{ID: 100},
+			Message: telegrambotapi.Message{
+				ID:          11,
+				Chat:        telegrambotapi.Chat{ID: 100},
+				ReplyMarkup: keyboard,
+			},
+			Data: buttons[1].CallbackData,
+		},
+	}
+	reply := pushUpdate(t, server, update, "editMessageMedia")
+	if answers := server.CallsTo("answerCallbackQuery"); len(answers) != 1 || answers[0].Params["callback_query_id"] != "callback-1" {
+		t.Fatalf("Unexpected answerCallbackQuery calls %+v", answers)
+	}
+	if reply.Params["message_id"] != "11" {
+		t.Fatalf("Unexpected message_id %q", reply.Params["message_id"])
+	}
+
+	var media telegrambotapi.InputMediaPhoto
+	err = json.Unmarshal([]byte(reply.Params["media"]), &media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.Caption != "The Lion King (1994)" {
+		t.Fatalf("Unexpected caption %q", media.Caption)
+	}
+	if photo, uploaded := sentPhoto(t, server, reply); string(photo) != string(testPoster(1)) || !uploaded {
+		t.Fatal("Unexpected poster")
+	}
+
+	var newKeyboard telegrambotapi.InlineKeyboardMarkup
+	err = json.Unmarshal([]byte(reply.Params["reply_markup"]), &newKeyboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKeyboard.InlineKeyboard[0][0].Text != "1" || newKeyboard.InlineKeyboard[0][1].Text != "- 2 -" {
+		t.Fatalf("Unexpected new keyboard %+v", newKeyboard)
+	}
+}
+
+func TestBotInlineQuery(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	update := telegrambotapi.Update{
+		ID: 3,
+		InlineQuery: telegrambotapi.InlineQuery{
+			ID:    "inline-1",
+			From:  telegrambotapi.User{ID: 100},
+			Query: "frozen",
+		},
+	}
+	reply, err := server.PushUpdate(http.HandlerFunc(telegramHandler), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		t.Fatalf("Expected empty webhook reply, got %+v", reply)
+	}
+
+	calls := server.CallsTo("answerInlineQuery")
+	if len(calls) != 1 || calls[0].Params["inline_query_id"] != "inline-1" {
+		t.Fatalf("Unexpected answerInlineQuery calls %+v", calls)
+	}
+	var results []telegrambotapi.InlineQueryResultPhoto
+	err = json.Unmarshal([]byte(calls[0].Params["results"]), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].ID != "5" || results[0].PhotoURL != "https://example.com"+posterPath+"5" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+
+	// Постер из результата должен отдаваться ботом.
+	recorder := httptest.NewRecorder()
+	posterHandler(recorder, httptest.NewRequest(http.MethodGet, posterPath+"5", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != string(testPoster(5)) {
+		t.Fatalf("Unexpected poster response %d", recorder.Code)
+	}
+}
+
+func TestTitlesYearFilter(t *testing.T) {
+	// Фильмов с тем же названием, но другого года больше, чем отбирается
+	// кандидатов по индексу n-грамм.
+	ts := Titles{storage: map[int64]titleInfo{}, index: ngram.NewIndex(titleNgramLen)}
+	for i := int64(1); i <= maxTitleCandidates+100; i++ {
+		addTestTitle(&ts, i, "The Lion King", 2019, 0)
+	}
+	addTestTitle(&ts, 10000, "The Lion King", 1994, 0)
+
+	matches := ts.bestMatches(parseTitleQuery("the lion king 1994"), nil)
+	if len(matches) != 1 || matches[0].id != 10000 {
+		t.Fatalf("Expected only 1994 movie, got %d matches", len(matches))
+	}
+	// Если фильмов нужного года нет, то год считается частью названия.
+	matches = ts.bestMatches(parseTitleQuery("the lion king 2000"), nil)
+	if len(matches) == 0 || matches[0].titleLower != "the lion king" {
+		t.Fatalf("Unexpected matches without year %v", matches)
+	}
+}
+
+// addTestTitle добавляет в ts фильм без обращения к БД.
+func addTestTitle(ts *Titles, id int64, title string, year int, collectionID int64) {
+	titleLower := strings.ToLower(title)
+	info := titleInfo{
+		id:            id,
+		movieID:       id,
+		lang:          iso6391.En,
+		titleOriginal: title,
+		titleLower:    titleLower,
+		titleKey:      translit.Key(titleLower),
+		releaseDate:   time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC),
+		collectionID:  collectionID,
+	}
+	ts.storage[id] = info
+	ts.index.Add(id, info.titleKey)
+}
+
+// fullScanMatches находит фильмы так же, как levMatches, но считает
+// расстояние Левенштейна для всех фильмов без отбора кандидатов по индексу
+// n-грамм, т.е. так, как фильмы искались до появления индекса.
+func fullScanMatches(ts *Titles, query titleQuery) []titleInfo {
+	scorer := newTitleScorer(strings.ToLower(strings.TrimSpace(query.title)), nil)
+	var titlesHeap titleInfoHeap
+	for _, title := range ts.storage {
+		if !query.yearMatches(title.releaseDate.Year()) {
+			continue
+		}
+		title.editcost = scorer.editCost(title)
+		heap.Push(&titlesHeap, title)
+		if titlesHeap.Len() > 10 {
+			heap.Pop(&titlesHeap)
+		}
+	}
+	if titlesHeap.Len() == 0 && query.hasYear() {
+		return fullScanMatches(ts, query.withoutYear())
+	}
+	matches := make([]titleInfo, titlesHeap.Len())
+	for i := len(matches) - 1; i >= 0; i-- {
+		matches[i] = heap.Pop(&titlesHeap).(titleInfo)
+	}
+	return matches
+}
+
+func TestTitlesFullScanRanking(t *testing.T) {
+	// Каталог из случайных названий, среди которых есть части фильмов и
+	// ремейки с одинаковыми названиями. Случайные названия вышли раньше
+	// остальных фильмов, чтобы запросы с годом находили только фильмы с
+	// настоящими названиями.
+	ts := Titles{storage: map[int64]titleInfo{}, index: ngram.NewIndex(titleNgramLen)}
+	words := []string{
+		"the", "lion", "king", "star", "wars", "godfather", "part", "return",
+		"night", "dark", "knight", "love", "story", "city", "man", "war",
+		"король", "лев", "брат", "ночь", "любовь", "война",
+	}
+	rnd := rand.New(rand.NewSource(1))
+	id := int64(1)
+	for ; id <= 3000; id++ {
+		titleWords := make([]string, 1+rnd.Intn(4))
+		for i := range titleWords {
+			titleWords[i] = words[rnd.Intn(len(words))]
+		}
+		addTestTitle(&ts, id, strings.Join(titleWords, " "), 1900+rnd.Intn(50), 0)
+	}
+	for _, movie := range []struct {
+		title        string
+		year         int
+		collectionID int64
+	}{
+		{"The Lion King", 1994, 1},
+		{"The Lion King 2: Simba's Pride", 1998, 1},
+		{"The Lion King", 2019, 0},
+		{"Star Wars", 1977, 2},
+		{"The Empire Strikes Back", 1980, 2},
+		{"Return of the Jedi", 1983, 2},
+		{"Star Wars: The Force Awakens", 2015, 2},
+		{"The Godfather", 1972, 3},
+		{"The Godfather: Part II", 1974, 3},
+		{"The Godfather: Part III", 1990, 3},
+		{"King Kong", 1933, 0},
+		{"King Kong", 1976, 0},
+		{"King Kong", 2005, 0},
+		{"The Dark Knight", 2008, 4},
+		{"The Dark Knight Rises", 2012, 4},
+		{"Брат", 1997, 5},
+		{"Брат 2", 2000, 5},
+		{"Король Лев", 1994, 0},
+	} {
+		addTestTitle(&ts, id, movie.title, movie.year, movie.collectionID)
+		id++
+	}
+
+	// Индекс n-грамм не находит названия, у которых нет общих n-грамм с
+	// запросом, поэтому запросы составлены к фильмам из каталога, а не к
+	// случайным названиям. top - начало окончательного списка фильмов.
+	testCases := []struct {
+		text string
+		top  []string
+	}{
+		{"the lion king", []string{"The Lion King 2019", "The Lion King 1994", "The Lion King 2: Simba's Pride 1998"}},
+		{"lion king", []string{"lion king 1943"}},
+		{"star wars", []string{"Star Wars 1977"}},
+		{"the godfather", []string{"The Godfather 1972", "The Godfather: Part II 1974", "The Godfather: Part III 1990"}},
+		{"godfather part", []string{"godfather part 1932"}},
+		{"king kong", []string{"King Kong 2005", "King Kong 1976", "King Kong 1933"}},
+		{"king kong 1976", []string{"King Kong 1976"}},
+		{"the dark night", []string{"The Dark Knight 2008", "The Dark Knight Rises 2012"}},
+		{"brat 2", []string{"Брат 2 2000"}},
+		{"король лев", []string{"Король Лев 1994"}},
+		{"the lion king 2019", []string{"The Lion King 2019"}},
+		{"godfather 1974", []string{"The Godfather: Part II 1974"}},
+		{"king kong 1950", []string{"King Kong 2005", "King Kong 1976", "King Kong 1933"}},
+	}
+	for _, tc := range testCases {
+		query := parseTitleQuery(tc.text)
+		matches := ts.levMatches(query, nil)
+		expected := fullScanMatches(&ts, query)
+		if len(matches) == 0 || len(matches) != len(expected) {
+			t.Fatalf("Expected %d matches for %q, got %d", len(expected), tc.text, len(matches))
+		}
+		// При полном переборе фильмы с одинаковым editcost шли в порядке
+		// обхода map'а, т.е. в случайном. Поэтому такие фильмы сравниваются
+		// как множества, а у последней группы, которая может не поместиться
+		// в список целиком, сравнивается только количество.
+		for i := 0; i < len(matches); {
+			j := i
+			group := map[int64]int{}
+			for ; j < len(matches) && matches[j].editcost == matches[i].editcost; j++ {
+				if expected[j].editcost != matches[j].editcost {
+					t.Fatalf("Expected editcost %d for match #%d for %q, got %d", expected[j].editcost, j, tc.text, matches[j].editcost)
+				}
+				group[matches[j].id]++
+				group[expected[j].id]--
+			}
+			if j < len(matches) || len(expected) < 10 {
+				for id, n := range group {
+					if n != 0 {
+						t.Fatalf("Unexpected matches with editcost %d for %q (id %d)", matches[i].editcost, tc.text, id)
+					}
+				}
+			}
+			i = j
+		}
+
+		ranked := ts.bestMatches(query, nil)
+		if len(ranked) < len(tc.top) {
+			t.Fatalf("Expected at least %d matches for %q, got %d", len(tc.top), tc.text, len(ranked))
+		}
+		for i, title := range tc.top {
+			if got := ranked[i].titleOriginal + " " + strconv.Itoa(ranked[i].releaseDate.Year()); got != title {
+				t.Fatalf("Expected %q as match #%d for %q, got %q", title, i, tc.text, got)
+			}
+		}
+	}
+}
+
+func TestBotUnknownMessage(t *testing.T) {
+	server, _ := setupTestBot(t)
+
+	update := textUpdate("")
+	_, err := server.PushUpdate(http.HandlerFunc(telegramHandler), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.CallsTo("sendMessage")
+	if len(calls) != 1 || calls[0].Params["text"] != incorrectMessageReplyEn {
+		t.Fatalf("Unexpected sendMessage calls %+v", calls)
+	}
+}
+
+func TestBotPolling(t *testing.T) {
+	server, conn := setupTestBot(t)
+
+	// Установленный webhook должен быть удалён при переходе на long polling.
+	err := tlgrmClient.SetWebhook("https://1.2.3.4:8443/"+testBotToken, []byte("certificate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddUpdate(textUpdate("frozen"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		runPolling(ctx, "[go bot-test]:", botConfig{})
+		close(finished)
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(server.CallsTo("sendPhoto")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Polling is not stopped after context cancellation")
+	}
+
+	if server.WebhookURL() != "" {
+		t.Fatal("Webhook is not deleted")
+	}
+	calls := server.CallsTo("sendPhoto")
+	if len(calls) != 1 || calls[0].Params["caption"] != "Frozen (2013)" {
+		t.Fatalf("Unexpected sendPhoto calls %+v", calls)
+	}
+
+	stateStmt, err := conn.Prepare(botStateQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateStmt.Close()
+	var offset int64
+	err = stateStmt.QueryRow(updateOffsetStateName).Scan(&offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 2 {
+		t.Fatalf("Expected offset 2, got %d", offset)
+	}
+}
+
+func TestBotPreferredLang(t *testing.T) {
+	server, conn := setupTestBot(t)
+
+	// Русскому пользователю английское название показывается с русским
+	// постером.
+	update := textUpdate("Interstellar")
+	update.Message.From.LangCode = "ru"
+	call := pushUpdate(t, server, update, "sendPhoto")
+	if photo, _ := sentPhoto(t, server, call); call.Params["caption"] != "Интерстеллар (2014)" || string(photo) != string(testPoster(108)) {
+		t.Fatalf("Unexpected reply %v", call.Params)
+	}
+
+	// Английскому пользователю русское название показывается с английским
+	// постером, причём один фильм не повторяется на разных языках.
+	call = pushText(t, server, "Холодное сердце")
+	if photo, _ := sentPhoto(t, server, call); call.Params["caption"] != "Frozen (2013)" || string(photo) != string(testPoster(5)) {
+		t.Fatalf("Unexpected reply %v", call.Params)
+	}
+	var keyboard telegrambotapi.InlineKeyboardMarkup
+	err := json.Unmarshal([]byte(call.Params["reply_markup"]), &keyboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, button := range keyboard.InlineKeyboard[0][1:] {
+		if button.CallbackData == "5" || button.CallbackData == "105" {
+			t.Fatalf("Movie is repeated in keyboard %+v", keyboard)
+		}
+	}
+
+	// Если постера на языке пользователя нет, то показывается найденный.
+	update = textUpdate("Brat 2")
+	update.Message.From.LangCode = "ru"
+	call = pushUpdate(t, server, update, "sendPhoto")
+	if call.Params["caption"] != "Брат 2 (2000)" {
+		t.Fatalf("Unexpected reply %v", call.Params)
+	}
+
+	// Язык клиента пользователя сохраняется в БД и обновляется при его смене.
+	stmt, err := conn.Prepare(userLangQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var lang string
+	var chosen int64
+	err = stmt.QueryRow(int64(100)).Scan(&lang, &chosen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang != "ru" || chosen != 0 {
+		t.Fatalf("Unexpected user language %s (chosen %d)", lang, chosen)
+	}
+}
+
+func TestBotLangCommand(t *testing.T) {
+	server, _ := setupTestBot(t)
+	botLangs[iso6391.Uk] = struct{}{}
+
+	lastReply := func() string {
+		calls := server.CallsTo("sendMessage")
+		if len(calls) == 0 {
+			t.Fatal("No sendMessage calls")
+		}
+		return calls[len(calls)-1].Params["text"]
+	}
+	pushCommand := func(command string) {
+		_, err := server.PushUpdate(http.HandlerFunc(telegramHandler), textUpdate(command))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pushCommand("/lang")
+	if reply := lastReply(); !strings.Contains(reply, `"en"`) || !strings.Contains(reply, "en, ru, uk") {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	pushCommand("/lang fr")
+	if reply := lastReply(); !strings.Contains(reply, `"fr" is not supported`) {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	pushCommand("/lang@TestBot UK")
+	if reply := lastReply(); !strings.Contains(reply, `мовою "uk"`) {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	// Выбранный язык не перезаписывается языком клиента.
+	call := pushText(t, server, "interstellar")
+	if photo, _ := sentPhoto(t, server, call); call.Params["caption"] != "Інтерстеллар (2014)" || string(photo) != string(testPoster(118)) {
+		t.Fatalf("Unexpected reply %v", call.Params)
+	}
+	pushCommand("/start")
+	if reply := lastReply(); reply != greetingMessageUk {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	// Inline запросы тоже учитывают выбранный язык.
+	update := telegrambotapi.Update{
+		ID:          4,
+		InlineQuery: telegrambotapi.InlineQuery{ID: "inline-2", From: telegrambotapi.User{ID: 100, LangCode: "en"}, Query: "interstellar"},
+	}
+	_, err := server.PushUpdate(http.HandlerFunc(telegramHandler), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.CallsTo("answerInlineQuery")
+	if len(calls) != 1 || !strings.Contains(calls[0].Params["results"], `"id":"118"`) {
+		t.Fatalf("Unexpected answerInlineQuery calls %+v", calls)
+	}
+}
+
+func TestBotFileID(t *testing.T) {
+	server, conn := setupTestBot(t)
+
+	// Первый раз постер загружается, а его file_id сохраняется в БД.
+	call := pushText(t, server, "interstellar")
+	photo, uploaded := sentPhoto(t, server, call)
+	if !uploaded || string(photo) != string(testPoster(8)) {
+		t.Fatal("Poster is not uploaded")
+	}
+	stmt, err := conn.Prepare(fileIDQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var fileID string
+	err = stmt.QueryRow(int64(8)).Scan(&fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Повторно отправляется file_id самого большого размера постера.
+	call = pushText(t, server, "interstellar")
+	photo, uploaded = sentPhoto(t, server, call)
+	if uploaded || call.Params["photo"] != fileID || string(photo) != string(testPoster(8)) {
+		t.Fatalf("Expected file_id %q, got %v", fileID, call.Params)
+	}
+	if size, _ := server.File(fileID); len(size) == 0 || strings.HasSuffix(fileID, "-small") {
+		t.Fatalf("Unexpected file_id %q", fileID)
+	}
+
+	// Кнопки inline клавиатуры тоже используют file_id.
+	update := telegrambotapi.Update{
+		ID: 2,
+		CallbackQuery: telegrambotapi.CallbackQuery{
+			ID:   "callback-1",
+			From: telegrambotapi.User{ID: 100},
+			Message: telegrambotapi.Message{
+				ID:          11,
+				Chat:        telegrambotapi.Chat{ID: 100},
+				ReplyMarkup: telegrambotapi.InlineKeyboardMarkup{InlineKeyboard: [][]telegrambotapi.InlineKeyboardButton{{{Text: "- 1 -", CallbackData: "8"}}}},
+			},
+			Data: "8",
+		},
+	}
+	reply := pushUpdate(t, server, update, "editMessageMedia")
+	if _, uploaded := sentPhoto(t, server, reply); uploaded {
+		t.Fatal("Poster is uploaded instead of sending file_id")
+	}
+
+	// Если Telegram не принимает file_id, то постер загружается заново, а
+	// новый file_id сохраняется в БД.
+	server.ForgetFiles()
+	server.Reset()
+	_, err = server.PushUpdate(http.HandlerFunc(telegramHandler), textUpdate("interstellar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos := server.CallsTo("sendPhoto")
+	if len(photos) != 2 || photos[0].Params["photo"] != fileID {
+		t.Fatalf("Unexpected sendPhoto calls %+v", photos)
+	}
+	call = photos[1]
+	photo, uploaded = sentPhoto(t, server, call)
+	if !uploaded || string(photo) != string(testPoster(8)) {
+		t.Fatal("Poster is not uploaded after file_id rejection")
+	}
+	var newFileID string
+	err = stmt.QueryRow(int64(8)).Scan(&newFileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newFileID == fileID {
+		t.Fatal("file_id is not updated")
+	}
+	call = pushText(t, server, "interstellar")
+	if call.Params["photo"] != newFileID {
+		t.Fatalf("Expected file_id %q, got %v", newFileID, call.Params)
+	}
+
+	// Inline режим тоже отправляет file_id вместо ссылки на постер.
+	server.Reset()
+	inlineUpdate := telegrambotapi.Update{
+		ID: 3,
+		InlineQuery: telegrambotapi.InlineQuery{
+			ID:    "inline-1",
+			From:  telegrambotapi.User{ID: 100},
+			Query: "interstellar",
+		},
+	}
+	_, err = server.PushUpdate(http.HandlerFunc(telegramHandler), inlineUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.CallsTo("answerInlineQuery")
+	if len(calls) != 1 {
+		t.Fatalf("Unexpected answerInlineQuery calls %+v", calls)
+	}
+	var results []map[string]interface{}
+	err = json.Unmarshal([]byte(calls[0].Params["results"]), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0]["id"] != "8" || results[0]["photo_file_id"] != newFileID || results[0]["photo_url"] != nil {
+		t.Fatalf("Expected cached photo result with file_id %q, got %+v", newFileID, results)
+	}
+}
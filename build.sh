@@ -2,7 +2,7 @@ SQLITE_LOCATION=sqlite/lib
 
 echo "building SQLite library..."
 pushd $SQLITE_LOCATION 1>/dev/null
-gcc -DSQLITE_OMIT_LOAD_EXTENSION -DSQLITE_DEFAULT_FOREIGN_KEYS=1 -c sqlite3.c
+gcc -DSQLITE_OMIT_LOAD_EXTENSION -DSQLITE_DEFAULT_FOREIGN_KEYS=1 -DSQLITE_ENABLE_FTS5 -c sqlite3.c
 ar rcs libsqlite3.a sqlite3.o
 rm sqlite3.o
 popd 1>/dev/null
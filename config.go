@@ -1,27 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/source-farm/movie-promo-bot/iso6391"
 	"github.com/source-farm/movie-promo-bot/journal"
 	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/themoviedb"
 )
 
 type botConfig struct {
-	Token       string `json:"telegram_token"`
+	Token string `json:"telegram_token"`
+	// Способ получения сообщений от Telegram: "webhook" (по-умолчанию) или
+	// "polling". Для работы через webhook нужны публичный IP адрес и
+	// сертификат, а long polling работает откуда угодно, например, с
+	// машины разработчика.
+	UpdateMode  string `json:"update_mode"`
 	WebhookAddr string `json:"webhook_address"`
 	WebhookPort int    `json:"webhook_port"`
 	BotAPIAddr  string `json:"telegram_bot_api_address"`
 	PublicCert  string `json:"public_cert"`
 	PrivateKey  string `json:"private_key"`
+	// Адрес, по которому Telegram может скачивать постеры для ответов на
+	// inline запросы. Если не указан, то используется адрес webhook'а.
+	PosterBaseURL string `json:"poster_base_url"`
+	// Макс. количество соединений с БД, через которые одновременно
+	// обрабатываются сообщения от Telegram. Если не указано, то
+	// используется dbPoolSizeDefault.
+	DBPoolSize int `json:"db_pool_size"`
+}
+
+// Настройки резервного копирования БД.
+type backupConfig struct {
+	// Папка, в которую сохраняются резервные копии БД. Если не указана, то
+	// резервные копии не делаются.
+	Dir string `json:"dir"`
+	// Интервал между резервными копиями в часах. Если не указан, то
+	// используется backupIntervalHoursDefault.
+	IntervalHours int `json:"interval_hours"`
+	// Количество хранимых последних копий. Если не указано, то
+	// используется backupKeepDefault.
+	Keep int `json:"keep"`
+}
+
+// Расписания периодических задач. Если расписание задачи не указано, то
+// используется расписание по-умолчанию (см. schedule.go).
+type scheduleConfig struct {
+	// Полная обработка файла ежедневного экспорта The MovieDB.
+	Export jobSchedule `json:"export"`
+	// Обработка фильмов, изменившихся за последние сутки.
+	Changes jobSchedule `json:"changes"`
+	// Загрузка новых названий фильмов из БД в бота.
+	Titles jobSchedule `json:"titles"`
 }
 
 type config struct {
-	TheMovieDBKey string    `json:"themoviedb_key"`
-	DBName        string    `json:"db_name"`
-	Bot           botConfig `json:"bot_config"`
+	TheMovieDBKey string `json:"themoviedb_key"`
+	// Адреса сервисов The MovieDB. Незаполненные адреса берутся из
+	// themoviedb.DefaultBaseURLs. Нужны для работы с локальной заменой
+	// The MovieDB, например, при отладке.
+	TheMovieDBURLs themoviedb.BaseURLs `json:"themoviedb_urls"`
+	// Языки (коды ISO 639-1), на которых скачиваются названия и постеры
+	// фильмов и на которых бот отвечает пользователям. Если не указаны, то
+	// используются themoviedb.DefaultLangs.
+	Langs  []iso6391.LangCode `json:"langs"`
+	DBName string             `json:"db_name"`
+	// Папка, в которой хранятся постеры. Если не указана, то постеры
+	// хранятся в самой БД, что сильно увеличивает её размер.
+	PosterDir string         `json:"poster_dir"`
+	Backup    backupConfig   `json:"backup"`
+	Schedule  scheduleConfig `json:"schedule"`
+	Bot       botConfig      `json:"bot_config"`
 }
 
 // Чтение настроек из файла настроек.
@@ -43,11 +99,33 @@ func readConfig(cfgFilename string) (*config, error) {
 		return nil, err
 	}
 
+	if len(cfg.Langs) == 0 {
+		cfg.Langs = append([]iso6391.LangCode(nil), themoviedb.DefaultLangs...)
+	}
+	for i, lang := range cfg.Langs {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if len(lang) != 2 {
+			return nil, errors.New("incorrect language code \"" + cfg.Langs[i] + "\" in config")
+		}
+		cfg.Langs[i] = lang
+	}
+
+	err = cfg.Schedule.Export.init(exportCronDefault)
+	if err == nil {
+		err = cfg.Schedule.Changes.init(changesCronDefault)
+	}
+	if err == nil {
+		err = cfg.Schedule.Titles.init(titlesCronDefault)
+	}
+	if err != nil {
+		return nil, errors.New("incorrect schedule in config: " + err.Error())
+	}
+
 	journal.Info("config file read OK")
 	return &cfg, nil
 }
 
-// Инициализация БД фильмов.
+// Инициализация БД фильмов: выполнение невыполненных миграций схемы БД.
 func initDB(dbName string) error {
 	journal.Info(" initialising database " + dbName)
 
@@ -58,49 +136,121 @@ func initDB(dbName string) error {
 	defer con.Close()
 	journal.Trace("connected to " + dbName)
 
-	//- Основная таблица с информацией о фильме.
-	query := `
-CREATE TABLE IF NOT EXISTS movie (
-    id             INTEGER PRIMARY KEY,
-    tmdb_id        INTEGER NOT NULL UNIQUE,
-    original_title TEXT    NOT NULL,
-    original_lang  TEXT    NOT NULL,
-    released_on    TEXT    NOT NULL,
-    adult          INTEGER NOT NULL,
-    imdb_id        INTEGER,
-    vote_count     INTEGER,
-    vote_average   REAL,
-    collection_id  INTEGER, -- Если равен 0, то фильм не принадлежит никакой коллекции.
-    created_on     TEXT DEFAULT (datetime('now')),
-    updated_on     TEXT
-);
-`
-	_, err = con.Exec(query)
+	// Без FTS5 не выполнится миграция с полнотекстовым индексом названий.
+	if !sqlite.HasFTS5() {
+		return errors.New("SQLite library is built without FTS5 (see build.sh)")
+	}
+
+	err = migrate(con)
 	if err != nil {
 		return err
 	}
-	journal.Trace("table movie create OK")
-
-	//- Таблица с дополнительной информацией о фильме из таблицы movie.
-	query = `
-CREATE TABLE IF NOT EXISTS movie_detail (
-    id          INTEGER PRIMARY KEY,
-    fk_movie_id REFERENCES movie(id) NOT NULL,
-    lang        TEXT NOT NULL,
-    title       TEXT NOT NULL,
-    poster      BLOB,
-    created_on  TEXT DEFAULT (datetime('now')),
-    updated_on  TEXT,
-                UNIQUE (fk_movie_id, lang)
-);
-`
-	_, err = con.Exec(query)
+
+	journal.Info("database " + dbName + " init OK")
+
+	return nil
+}
+
+// printPendingMigrations выводит в stdout миграции схемы БД dbName, которые
+// будут выполнены при следующем запуске бота.
+func printPendingMigrations(dbName string) error {
+	con, err := sqlite.NewConn(dbName)
 	if err != nil {
 		return err
 	}
-	journal.Trace("table movie_detail create OK")
+	defer con.Close()
 
-	journal.Info("database " + dbName + " init OK")
+	version, pending, err := pendingMigrations(con)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("database %s schema version: %d (latest %d)\n", dbName, version, len(migrations))
+	if len(pending) == 0 {
+		fmt.Println("no pending migrations")
+	}
+	for i, m := range pending {
+		fmt.Printf("pending migration #%d: %s\n", version+i+1, m.description)
+	}
+	return nil
+}
+
+// printStatus выводит в stdout состояние получения фильмов из БД dbName и
+// время следующих запусков задач по расписаниям schedule. Миграции схемы БД
+// не выполняются: если они есть, то выводится только их количество, т.к.
+// таблиц состояния получения фильмов в БД может ещё не быть.
+func printStatus(dbName string, schedule *scheduleConfig) error {
+	con, err := sqlite.NewConn(dbName)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
 
+	version, pending, err := pendingMigrations(con)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		fmt.Printf("database %s schema version: %d (latest %d), %d pending migrations will be applied on next start\n",
+			dbName, version, len(migrations), len(pending))
+	} else {
+		err = printHarvestStatus(con)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, job := range []struct {
+		name     string
+		schedule *jobSchedule
+	}{
+		{"export scan", &schedule.Export},
+		{"changes scan", &schedule.Changes},
+		{"titles reload", &schedule.Titles},
+	} {
+		onStartup := ""
+		if job.schedule.runOnStartup() {
+			onStartup = ", also on startup"
+		}
+		fmt.Printf("%s: %s, next run at %v%s\n", job.name, job.schedule, job.schedule.next(now), onStartup)
+	}
 	return nil
 }
+
+// printHarvestStatus выводит в stdout стадию незавершённой сессии получения
+// фильмов и количество фильмов в очереди harvest_queue по состояниям.
+func printHarvestStatus(con *sqlite.Conn) error {
+	var stage string
+	err := harvestState(context.Background(), con, harvestStageStateName, &stage)
+	if err != nil {
+		return err
+	}
+	// Незавершённая сессия либо выполняется сейчас, либо была прервана и
+	// продолжится при следующем запуске бота.
+	if stage == "" {
+		fmt.Println("harvest session: none")
+	} else {
+		fmt.Println("harvest session: unfinished, stage " + stage)
+	}
+
+	stmt, err := con.Prepare("SELECT state, count(*) FROM harvest_queue GROUP BY state ORDER BY state;")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state string
+		var count int64
+		err = rows.Scan(&state, &count)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("harvest queue %s: %d\n", state, count)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,225 @@
+// Пакет cron разбирает расписания в формате cron и вычисляет по ним время
+// следующего запуска.
+//
+// Расписание состоит из пяти полей, разделённых пробелами: минута (0-59), час
+// (0-23), день месяца (1-31), месяц (1-12 или JAN-DEC) и день недели (0-7 или
+// SUN-SAT, 0 и 7 - воскресенье). Каждое поле - это список через запятую из
+// значений, диапазонов "a-b" и "*" (все значения), к диапазонам и "*" можно
+// добавить шаг "/n". Например, "30 9 * * MON-FRI" - в 9:30 по будням,
+// "0 */6 * * *" - каждые 6 часов. Как и в классическом cron, если ограничены
+// и день месяца, и день недели, то подходит любой из них. Вместо пяти полей
+// можно указать @yearly (@annually), @monthly, @weekly, @daily (@midnight)
+// или @hourly.
+package cron
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Максимальное количество лет, на которое вперёд ищется следующий запуск.
+// Например, расписание "0 0 30 2 *" (30 февраля) никогда не выполняется.
+const maxYearsAhead = 5
+
+// Schedule - разобранное расписание.
+type Schedule struct {
+	expr   string
+	minute bits
+	hour   bits
+	dom    bits
+	month  bits
+	dow    bits
+	// Поля дня месяца и дня недели равны "*" (возможно, с шагом).
+	domStar bool
+	dowStar bool
+}
+
+// bits - множество значений поля, значение n соответствует биту n.
+type bits uint64
+
+func (b bits) has(n int) bool {
+	return b&(1<<uint(n)) != 0
+}
+
+// field описывает допустимые значения поля расписания.
+type field struct {
+	name     string
+	min, max int
+	names    []string // Названия значений начиная с min, если они есть.
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: []string{
+		"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC",
+	}}
+	dowField = field{name: "day of week", min: 0, max: 7, names: []string{
+		"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT",
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse разбирает расписание expr.
+func Parse(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "@") {
+		var ok bool
+		spec, ok = descriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, errors.New("cron: unknown descriptor \"" + expr + "\"")
+		}
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron: expected 5 fields in \"" + expr + "\", got " + strconv.Itoa(len(fields)))
+	}
+
+	s := Schedule{expr: strings.TrimSpace(expr)}
+	var err error
+	if s.minute, _, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, _, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, s.domStar, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, _, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, s.dowStar, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	// 7 - тоже воскресенье.
+	if s.dow.has(7) {
+		s.dow |= 1
+	}
+	return &s, nil
+}
+
+// String возвращает расписание в том виде, в котором оно было передано в Parse.
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next возвращает время первого запуска по расписанию строго после t.
+// Расписание вычисляется в часовом поясе t. Если запусков нет в течение
+// maxYearsAhead лет, то возвращается нулевое время.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// Запуски происходят в начале минуты.
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + maxYearsAhead
+	for t.Year() <= yearLimit {
+		year, month, day := t.Date()
+		switch {
+		case !s.month.has(int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(t.Hour()):
+			next := time.Date(year, month, day, t.Hour()+1, 0, 0, 0, loc)
+			// При переходе на летнее время час может повториться.
+			if !next.After(t) {
+				next = t.Truncate(time.Hour).Add(time.Hour)
+			}
+			t = next
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches возвращает true, если день t подходит под поля дня месяца и дня
+// недели.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom.has(t.Day())
+	dowMatch := s.dow.has(int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// parseField разбирает поле расписания. Возвращает множество значений поля и
+// признак того, что поле начинается с "*".
+func parseField(value string, f field) (bits, bool, error) {
+	var result bits
+	star := strings.HasPrefix(value, "*")
+	for _, item := range strings.Split(value, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i != -1 {
+			rangePart = item[:i]
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false, errors.New("cron: incorrect step in " + f.name + " field \"" + value + "\"")
+			}
+			step = n
+		}
+
+		var low, high int
+		switch {
+		case rangePart == "*":
+			low, high = f.min, f.max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = f.parseValue(bounds[0]); err != nil {
+				return 0, false, err
+			}
+			if high, err = f.parseValue(bounds[1]); err != nil {
+				return 0, false, err
+			}
+			if low > high {
+				return 0, false, errors.New("cron: incorrect range in " + f.name + " field \"" + value + "\"")
+			}
+		default:
+			var err error
+			if low, err = f.parseValue(rangePart); err != nil {
+				return 0, false, err
+			}
+			high = low
+			// Значение с шагом, например "5/15", означает диапазон до
+			// максимального значения.
+			if step > 1 {
+				high = f.max
+			}
+		}
+
+		for n := low; n <= high; n += step {
+			result |= 1 << uint(n)
+		}
+	}
+	return result, star, nil
+}
+
+// parseValue разбирает одно значение поля: число или название.
+func (f field) parseValue(value string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(value, name) {
+			return f.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < f.min || n > f.max {
+		return 0, errors.New("cron: incorrect " + f.name + " \"" + value + "\"")
+	}
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Пятница.
+	start := time.Date(2020, 5, 1, 10, 30, 15, 0, time.UTC)
+	testCases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 5, 1, 10, 31, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2020, 5, 2, 9, 0, 0, 0, time.UTC)},
+		{"45 10 * * *", time.Date(2020, 5, 1, 10, 45, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2020, 5, 1, 10, 40, 0, 0, time.UTC)},
+		{"5/20 */6 * * *", time.Date(2020, 5, 1, 12, 5, 0, 0, time.UTC)},
+		{"0 8,20 * * *", time.Date(2020, 5, 1, 20, 0, 0, 0, time.UTC)},
+		{"30 9 * * MON-FRI", time.Date(2020, 5, 4, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Подходит и 15-е число, и понедельник.
+		{"0 0 15 * 1", time.Date(2020, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range testCases {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", tc.expr, err)
+		}
+		if next := s.Next(start); !next.Equal(tc.next) {
+			t.Fatalf("Expected next run %v for %q, got %v", tc.next, tc.expr, next)
+		}
+	}
+}
+
+func TestNextTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := Parse("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 5, 1, 7, 0, 0, 0, time.UTC)
+	next := s.Next(start.In(loc))
+	if expected := time.Date(2020, 5, 2, 6, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Fatalf("Expected next run %v, got %v", expected, next)
+	}
+
+	// В день перехода на летнее время 2:30 не существует.
+	loc, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err = Parse("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next = s.Next(time.Date(2020, 3, 7, 12, 0, 0, 0, loc))
+	if next.IsZero() || next.Day() != 9 {
+		t.Fatalf("Unexpected next run %v", next)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * FOO *",
+		"@sometimes",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("Expected error for %q", expr)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/source-farm/movie-promo-bot/journal"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+)
+
+const (
+	// Извлечение file_id, под которым постер из movie_detail хранится в
+	// Telegram.
+	fileIDQuery = `
+SELECT file_id
+  FROM telegram_file
+ WHERE fk_movie_detail_id = ?1;
+`
+
+	fileIDUpsertQuery = `
+INSERT INTO telegram_file (fk_movie_detail_id, file_id)
+     VALUES (?1, ?2)
+ON CONFLICT (fk_movie_detail_id) DO UPDATE SET (file_id, updated_on) = (?2, datetime('now'));
+`
+
+	fileIDDeleteQuery = `
+DELETE FROM telegram_file
+      WHERE fk_movie_detail_id = ?1;
+`
+)
+
+// posterPhoto - постер, который отправляется в Telegram: либо file_id ранее
+// загруженного в Telegram постера, либо сама картинка.
+type posterPhoto struct {
+	fileID string
+	image  []byte
+}
+
+// sendPoster выполняет метод method Telegram Bot API (sendPhoto или
+// editMessageMedia) с постером из строки movieID таблицы movie_detail.
+// Параметры метода формирует makeParams, второе возвращаемое им значение -
+// это значение заголовка Content-Type.
+// Если постер уже загружался в Telegram, то вместо картинки отправляется её
+// file_id. Если Telegram отклоняет file_id, то картинка загружается заново.
+// После загрузки картинки её новый file_id сохраняется в БД.
+func sendPoster(ctx context.Context, method string, movieID int64, makeParams func(photo posterPhoto) ([]byte, string, error)) error {
+	fileID, err := getPosterFileID(ctx, movieID)
+	if err != nil {
+		journal.Error("cannot get poster [id ", movieID, "] file_id: ", err)
+	}
+	if fileID != "" {
+		params, contentType, err := makeParams(posterPhoto{fileID: fileID})
+		if err != nil {
+			return err
+		}
+		_, err = tlgrmClient.Post(method, contentType, bytes.NewReader(params))
+		if !fileIDRejected(err) {
+			return err
+		}
+		journal.Info("poster [id ", movieID, "] file_id is rejected (", err, "), uploading poster")
+		err = deletePosterFileID(ctx, movieID)
+		if err != nil {
+			journal.Error(err)
+		}
+	}
+
+	image, err := getPoster(ctx, movieID)
+	if err != nil {
+		return err
+	}
+	params, contentType, err := makeParams(posterPhoto{image: image})
+	if err != nil {
+		return err
+	}
+	result, err := tlgrmClient.Post(method, contentType, bytes.NewReader(params))
+	if err != nil {
+		return err
+	}
+
+	// Сохраняем file_id самого большого размера загруженной картинки.
+	var message telegrambotapi.Message
+	err = json.Unmarshal(result, &message)
+	if err != nil || len(message.Photo) == 0 {
+		journal.Error("no photo in ", method, " result for poster [id ", movieID, "]")
+		return nil
+	}
+	largest := message.Photo[0]
+	for _, size := range message.Photo[1:] {
+		if size.Width*size.Height > largest.Width*largest.Height {
+			largest = size
+		}
+	}
+	err = savePosterFileID(ctx, movieID, largest.FileID)
+	if err != nil {
+		journal.Error("cannot save poster [id ", movieID, "] file_id: ", err)
+	}
+	return nil
+}
+
+// fileIDRejected возвращает true, если err - это отказ Telegram принять
+// file_id, например, из-за того, что файл был удалён с серверов Telegram.
+func fileIDRejected(err error) bool {
+	tlgrmErr, ok := err.(*telegrambotapi.Error)
+	return ok && tlgrmErr.Code == 400 && strings.Contains(strings.ToLower(tlgrmErr.Description), "file")
+}
+
+// getPosterFileID возвращает file_id постера из строки movieID таблицы
+// movie_detail. Если постер ещё не загружался в Telegram, то возвращается
+// пустая строка.
+func getPosterFileID(ctx context.Context, movieID int64) (string, error) {
+	var fileID string
+	err := withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(fileIDQuery)
+		if err != nil {
+			return err
+		}
+		err = stmt.QueryRowContext(ctx, movieID).Scan(&fileID)
+		if err == sqlite.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return fileID, err
+}
+
+func savePosterFileID(ctx context.Context, movieID int64, fileID string) error {
+	return withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(fileIDUpsertQuery)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, movieID, fileID)
+		return err
+	})
+}
+
+func deletePosterFileID(ctx context.Context, movieID int64) error {
+	return withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(fileIDDeleteQuery)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, movieID)
+		return err
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
 	"strconv"
@@ -21,12 +22,12 @@ const (
 	// Мин. количество голосов по-умолчанию, которое должно быть у фильма, чтобы
 	// для него закачался постер.
 	minVoteCountDefault = 25
-	// Мин. количество голосов, которое должно быть у фильма на русском,
-	// чтобы для него закачался постер.
-	minVoteCountRu     = 5
+	// Мин. количество голосов, которое должно быть у фильма не на
+	// английском (на одном из языков из настроек), чтобы для него закачался
+	// постер. У таких фильмов обычно гораздо меньше голосов.
+	minVoteCountLocal  = 5
 	crawlersNum        = 3
 	movieFetchMaxFails = 3
-	tmdbMaxRetries     = 3
 	dbBusyTimeoutMS    = 10000
 	httpReqTimeout     = time.Second * 15
 
@@ -45,7 +46,8 @@ INSERT INTO movie (tmdb_id,
                    vote_count,
                    vote_average,
                    collection_id)
-     VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)
+     VALUES (:tmdb_id, :original_title, :original_lang, :released_on, :adult,
+             :imdb_id, :vote_count, :vote_average, :collection_id)
 ON CONFLICT (tmdb_id) DO UPDATE SET (tmdb_id,
                                      original_title,
                                      original_lang,
@@ -55,7 +57,8 @@ ON CONFLICT (tmdb_id) DO UPDATE SET (tmdb_id,
                                      vote_count,
                                      vote_average,
                                      collection_id,
-                                     updated_on) = (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, datetime('now'));
+                                     updated_on) = (:tmdb_id, :original_title, :original_lang, :released_on, :adult,
+                                                    :imdb_id, :vote_count, :vote_average, :collection_id, datetime('now'));
 `
 
 	movieDBIDQuery = `
@@ -64,17 +67,33 @@ SELECT id
  WHERE tmdb_id = ?1;
 `
 
-	// Языки, для которых есть постеры в БД для переданного идентификатора фильма.
-	posterLangsQuery = `
-    SELECT md.lang
+	// Постеры, которые есть в БД для переданного идентификатора фильма.
+	fetchedPostersQuery = `
+    SELECT md.id, md.lang, md.poster_path, md.poster_vote_average
       FROM movie as m
 INNER JOIN movie_detail as md on m.id = md.fk_movie_id
      WHERE m.tmdb_id = ?1;
 `
 
+	// Сам постер сохраняется отдельно, через posterStore.
 	posterInsertQuery = `
-INSERT INTO movie_detail (fk_movie_id, lang, title, poster)
-     VALUES (?1, ?2, ?3, ?4);
+INSERT INTO movie_detail (fk_movie_id, lang, title, poster_path, poster_vote_average)
+     VALUES (?1, ?2, ?3, ?4, ?5);
+`
+
+	// Замена постера на другой лучший постер из The MovieDB. Сам постер
+	// заменяется через posterStore.
+	posterUpdateQuery = `
+UPDATE movie_detail
+   SET (poster_path, poster_vote_average, updated_on) = (?2, ?3, datetime('now'))
+ WHERE id = ?1;
+`
+
+	// Обновление пути и оценки постера без замены самого постера.
+	posterMetaUpdateQuery = `
+UPDATE movie_detail
+   SET (poster_path, poster_vote_average) = (?2, ?3)
+ WHERE id = ?1;
 `
 )
 
@@ -83,8 +102,38 @@ type movieBrief struct {
 	TMDBID int `json:"id"` // Идентификатор фильма в The MovieDB API.
 }
 
-// theMovieDBHarvester заполняет локальную базу фильмов через The MovieDB API.
-func theMovieDBHarvester(ctx context.Context, finished *sync.WaitGroup, key, dbName string) {
+// movieRecord - это строка таблицы movie. Поля подставляются в именованные
+// параметры movieUpsertQuery.
+type movieRecord struct {
+	TMDBID        int              `sqlite:"tmdb_id"`
+	OriginalTitle string           `sqlite:"original_title"`
+	OriginalLang  iso6391.LangCode `sqlite:"original_lang"`
+	ReleasedOn    string           `sqlite:"released_on"`
+	Adult         bool             `sqlite:"adult"`
+	IMDBID        string           `sqlite:"imdb_id"`
+	VoteCount     int              `sqlite:"vote_count"`
+	VoteAverage   float64          `sqlite:"vote_average"`
+	CollectionID  int              `sqlite:"collection_id"`
+}
+
+// newMovieRecord возвращает строку таблицы movie для фильма movie.
+func newMovieRecord(movie *themoviedb.Movie) movieRecord {
+	return movieRecord{
+		TMDBID:        movie.TMDBID,
+		OriginalTitle: movie.OriginalTitle,
+		OriginalLang:  movie.OriginalLang,
+		ReleasedOn:    movie.ReleaseDate.Format("2006-01-02"),
+		Adult:         movie.Adult,
+		IMDBID:        movie.IMDBID,
+		VoteCount:     movie.VoteCount,
+		VoteAverage:   movie.VoteAverage,
+		CollectionID:  movie.Collection.ID,
+	}
+}
+
+// theMovieDBHarvester заполняет локальную базу фильмов через The MovieDB API
+// по расписаниям из schedule.
+func theMovieDBHarvester(ctx context.Context, finished *sync.WaitGroup, key string, baseURLs themoviedb.BaseURLs, langs []iso6391.LangCode, dbName, posterDir string, schedule scheduleConfig) {
 	journal.Replace(key, "<themoviedbapi_key>")
 	goID := "[go tmdb-harvester]:"
 	journal.Info(goID, " started")
@@ -97,487 +146,673 @@ func theMovieDBHarvester(ctx context.Context, finished *sync.WaitGroup, key, dbN
 	httpClient := &http.Client{
 		Timeout: httpReqTimeout,
 	}
-	tmdbClient := themoviedb.NewClient(key, httpClient)
-	err := tmdbClient.Configure()
+	tmdbClient := themoviedb.NewClientWithBaseURLs(key, httpClient, baseURLs)
+	tmdbClient.SetLangs(langs)
+	err := tmdbClient.ConfigureContext(ctx)
+	if ctx.Err() != nil {
+		return
+	}
 	if err != nil {
 		journal.Fatal(goID, " ", err)
 	}
 
-	// Для ожидания завершения tmdbSeeker'а и tmdbCrawler'ов.
-	var wg sync.WaitGroup
+	// Пул соединений с БД для tmdbSeeker'а и tmdbCrawler'ов. Соединений
+	// хватает на все горутины, поэтому они не ждут друг друга.
+	pool, err := sqlite.NewPool(dbName, crawlersNum+1)
+	if err != nil {
+		journal.Fatal(goID, " ", err)
+	}
+	defer pool.Close()
+	pool.SetBusyTimeout(dbBusyTimeoutMS)
+	posters, err := newPosterStore(posterDir)
+	if err != nil {
+		journal.Fatal(goID, " ", err)
+	}
+
+	// Время следующей обработки файла экспорта и изменившихся фильмов. Если
+	// обе обработки должны начаться одновременно, то сначала выполняется
+	// обработка файла экспорта, а сразу после неё - изменившихся фильмов.
+	now := time.Now()
+	jobs := []struct {
+		stage    string
+		schedule *jobSchedule
+		next     time.Time
+	}{
+		{harvestStageExport, &schedule.Export, schedule.Export.first(now)},
+		{harvestStageChanges, &schedule.Changes, schedule.Changes.first(now)},
+	}
+
+	// Сессия, прерванная остановкой или падением бота, продолжается сразу,
+	// не дожидаясь расписания.
+	var interrupted string
+	err = withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+		return harvestState(ctx, conn, harvestStageStateName, &interrupted)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		journal.Fatal(goID, " ", err)
+	}
+	if interrupted != "" {
+		_, err = harvestSession(ctx, goID, tmdbClient, pool, posters, langs, interrupted)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
+	}
 
 	for {
-		journal.Info(goID, " starting new movies fetch")
-		wg.Add(crawlersNum + 1) // +1 для горутины tmdbSeeker.
-
-		movieID := make(chan int)
-		// tmdbSeeker записывает в канал movieID идентификаторы фильмов, для
-		// которых ещё не скачаны все постеры.  Горутины tmdbCrawler извлекают
-		// эти идентификаторы из movieID и выполняют фактическую работу по
-		// скачиванию и добавлению фильмов в БД.
-		go tmdbSeeker(ctx, &wg, tmdbClient, dbName, movieID)
-		for i := 0; i < crawlersNum; i++ {
-			crawlerID := "[go tmdb-crawler-" + strconv.Itoa(i+1) + "]:"
-			go tmdbCrawler(crawlerID, &wg, tmdbClient, dbName, movieID)
-		}
-
-		wg.Wait()
-		journal.Info(goID, " movies fetch finished")
-
-		// После завершения сессии получения фильмов ждём начала следующего дня
-		// по UTC перед следующей сессией.
-		nextDay := time.Now().AddDate(0, 0, 1)
-		nextDay = time.Date(nextDay.Year(), nextDay.Month(), nextDay.Day(), 0, 0, 0, 0, time.UTC)
-		sleepDuration := time.Until(nextDay)
-		journal.Info(goID, " sleeping for ", sleepDuration, " (before ", nextDay, ")")
-		timer := time.NewTimer(sleepDuration)
-		select {
-		case <-timer.C:
-		case <-ctx.Done():
-			timer.Stop()
+		job := &jobs[0]
+		if jobs[1].next.Before(job.next) {
+			job = &jobs[1]
+		}
+		journal.Info(goID, " next ", job.stage, " scan at ", job.next, " (", job.schedule, ")")
+		if !waitUntil(ctx, job.next) {
 			journal.Info(goID, " sleeping cancelled")
 			return
 		}
 
+		_, err = harvestSession(ctx, goID, tmdbClient, pool, posters, langs, job.stage)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
+		job.next = job.schedule.next(time.Now())
+
 		// Пытаемся снова сконфигурировать The Movie DB API клиента, т.к.
 		// документация рекомендует это делать раз в несколько дней.
-		err := tmdbClient.Configure()
+		err = tmdbClient.ConfigureContext(ctx)
 		if err != nil {
 			journal.Error(goID, " ", err)
 		}
 	}
 }
 
-// tmdbSeeker записывает в канал movieID идентификаторы фильмов, для которых ещё
-// не была найдена вся необходимая информация.
-func tmdbSeeker(ctx context.Context, wg *sync.WaitGroup, client *themoviedb.Client, dbName string, movieID chan<- int) {
+// harvestSession выполняет сессию получения фильмов, которая начинается с
+// этапа stage, или продолжает прерванную сессию. Возвращает true, если
+// сессия продолжена. Если сессия прервана отменой ctx, то она остаётся
+// незавершённой.
+func harvestSession(ctx context.Context, goID string, client *themoviedb.Client, pool *sqlite.Pool, posters posterStore, langs []iso6391.LangCode, stage string) (bool, error) {
+	resumed, err := startHarvestSession(ctx, pool, stage)
+	if err != nil {
+		return false, err
+	}
+	if resumed {
+		journal.Info(goID, " resuming interrupted movies fetch")
+	} else {
+		journal.Info(goID, " starting new movies fetch (", stage, " scan)")
+	}
+
+	// Для ожидания завершения tmdbSeeker'а и tmdbCrawler'ов.
+	var wg sync.WaitGroup
+	wg.Add(crawlersNum + 1) // +1 для горутины tmdbSeeker.
+
+	seekerDone := make(chan struct{})
+	// tmdbSeeker добавляет в очередь harvest_queue фильмы, у которых могут
+	// быть новые постеры, и закрывает seekerDone, когда больше не будет
+	// добавлять фильмы. Горутины tmdbCrawler забирают фильмы из очереди и
+	// выполняют фактическую работу по скачиванию и добавлению фильмов в БД.
+	go tmdbSeeker(ctx, &wg, client, pool, seekerDone)
+	for i := 0; i < crawlersNum; i++ {
+		crawlerID := "[go tmdb-crawler-" + strconv.Itoa(i+1) + "]:"
+		go tmdbCrawler(ctx, crawlerID, &wg, client, pool, posters, langs, seekerDone)
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		journal.Info(goID, " movies fetch interrupted")
+		return resumed, ctx.Err()
+	}
+	journal.Info(goID, " movies fetch finished")
+	return resumed, finishHarvestSession(ctx, pool)
+}
+
+// tmdbSeeker добавляет в очередь harvest_queue фильмы, у которых могут быть
+// новые постеры, и закрывает seekerDone по завершению.
+// Места, до которых обработаны файл ежедневного экспорта и список
+// изменившихся фильмов, сохраняются вместе с добавленными в очередь фильмами,
+// поэтому после перезапуска бота tmdbSeeker продолжает с этих мест.
+func tmdbSeeker(ctx context.Context, wg *sync.WaitGroup, client *themoviedb.Client, pool *sqlite.Pool, seekerDone chan<- struct{}) {
 	goID := "[go tmdb-seeker]:"
-	dailyExportFilename := "daily"
 
 	journal.Info(goID, " started")
 
 	// Очистка по завершению.
 	defer func() {
-		if _, err := os.Stat(dailyExportFilename); err == nil {
-			os.Remove(dailyExportFilename)
-		}
-		close(movieID)
+		close(seekerDone)
 		wg.Done()
 		journal.Info(goID, " finished")
 	}()
 
-	// Установка соединения с БД и её настройка.
-	conn, err := sqlite.NewConn(dbName)
+	// Соединение с БД берётся из пула на всё время работы tmdbSeeker'а.
+	conn, err := pool.Get(ctx)
 	if err != nil {
 		journal.Error(goID, " ", err)
 		return
 	}
-	defer conn.Close()
-	err = conn.SetBusyTimeout(dbBusyTimeoutMS)
+	defer pool.Put(conn)
+
+	var stage string
+	err = harvestState(ctx, conn, harvestStageStateName, &stage)
 	if err != nil {
 		journal.Error(goID, " ", err)
 		return
 	}
 
-	// Подготовка запросов.
-	posterLangsStmt, err := conn.Prepare(posterLangsQuery)
-	if err != nil {
-		journal.Fatal(goID, " ", err)
+	switch stage {
+	case harvestStageExport:
+		err = seekExportedMovies(ctx, goID, client, conn)
+	case harvestStageChanges:
+		err = seekChangedMovies(ctx, goID, client, conn)
+	default:
 		return
 	}
-	defer posterLangsStmt.Close()
-	journal.Trace(goID, " poster languages query prepared")
+	if err == nil {
+		err = setHarvestState(ctx, conn, harvestStageStateName, harvestStageCrawl)
+	}
+	if err != nil {
+		journal.Error(goID, " ", err)
+	}
+}
+
+// seekExportedMovies добавляет в очередь фильмы из файла ежедневного экспорта
+// The MovieDB API, которых нет в БД.
+func seekExportedMovies(ctx context.Context, goID string, client *themoviedb.Client, conn *sqlite.Conn) error {
+	dailyExportFilename := "daily"
+	defer func() {
+		if _, err := os.Stat(dailyExportFilename); err == nil {
+			os.Remove(dailyExportFilename)
+		}
+	}()
 
-	movieDBIDStmt, err := conn.Prepare(movieDBIDQuery)
+	movieDBIDStmt, err := conn.PrepareCached(movieDBIDQuery)
 	if err != nil {
-		journal.Fatal(goID, " ", err)
-		return
+		return err
 	}
-	defer movieDBIDStmt.Close()
 	journal.Trace(goID, " movie id query prepared")
 
-	//--------------------------------------------------------------------------------
-	// Обрабатываем фильмы из базы с краткой информацией о всех фильмах The MovieDB API.
-	//--------------------------------------------------------------------------------
+	// Дата файла экспорта и количество уже обработанных строк этого файла,
+	// если сессия продолжается.
+	var exportDate string
+	var exportLine int
+	err = harvestState(ctx, conn, harvestExportDateStateName, &exportDate)
+	if err == nil {
+		err = harvestState(ctx, conn, harvestExportLineStateName, &exportLine)
+	}
+	if err != nil {
+		return err
+	}
 
-	// Пытаемся скачать базу с краткой информацией о фильмах за какой-либо из
-	// пяти предыдущих дней.
-	now := time.Now()
-	for i := 1; i <= 5; i++ {
-		date := now.AddDate(0, 0, -i)
-		journal.Info(goID, " downloading daily export for "+date.Format("2006-01-02"))
-		year, month, day := date.Date()
-		err = client.GetDailyExport(year, int(month), day, dailyExportFilename)
+	downloaded := false
+	if exportDate != "" {
+		journal.Info(goID, " downloading daily export for "+exportDate+" to resume from line ", exportLine+1)
+		date, err := time.Parse("2006-01-02", exportDate)
 		if err == nil {
-			journal.Info(goID, " daily export for "+date.Format("2006-01-02")+" download OK")
-			break
+			year, month, day := date.Date()
+			err = client.GetDailyExportContext(ctx, year, int(month), day, dailyExportFilename)
+		}
+		if err == nil {
+			journal.Info(goID, " daily export for "+exportDate+" download OK")
+			downloaded = true
 		} else {
-			journal.Error(goID, " daily export for "+date.Format("2006-01-02")+" download fail: ", err)
+			journal.Error(goID, " daily export for "+exportDate+" download fail: ", err)
 		}
 	}
-	if err != nil {
-		journal.Error(goID, " cannot download daily export for any of 5 previous days")
-		return
+	// При остановке бота место в файле экспорта должно сохраниться.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if !downloaded {
+		// Пытаемся скачать базу с краткой информацией о фильмах за какой-либо
+		// из пяти предыдущих дней.
+		now := time.Now()
+		for i := 1; i <= 5; i++ {
+			date := now.AddDate(0, 0, -i)
+			journal.Info(goID, " downloading daily export for "+date.Format("2006-01-02"))
+			year, month, day := date.Date()
+			err = client.GetDailyExportContext(ctx, year, int(month), day, dailyExportFilename)
+			if err == nil {
+				journal.Info(goID, " daily export for "+date.Format("2006-01-02")+" download OK")
+				exportDate = date.Format("2006-01-02")
+				break
+			} else {
+				journal.Error(goID, " daily export for "+date.Format("2006-01-02")+" download fail: ", err)
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return errors.New("cannot download daily export for any of 5 previous days")
+		}
+
+		// Файл другой, поэтому он обрабатывается с начала.
+		exportLine = 0
+		err = conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+			err := setHarvestState(ctx, conn, harvestExportDateStateName, exportDate)
+			if err != nil {
+				return err
+			}
+			return setHarvestState(ctx, conn, harvestExportLineStateName, exportLine)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Файл базы фильмов - это архив gzip. Извлекаем из него данные на лету.
 	f, err := os.Open(dailyExportFilename)
 	if err != nil {
-		journal.Error(goID, " ", err)
-		return
+		return err
 	}
 	defer f.Close()
 	gzipReader, err := gzip.NewReader(f)
 	if err != nil {
-		journal.Error(goID, " ", err)
-		return
+		return err
 	}
 	defer gzipReader.Close()
 
-	// Каждая строка в базе фильмов - это JSON объект с краткой информацией о фильме.
-	// Извлекаем этот объект и отправляем фильм в канал movieID, если его нет в БД.
+	// Каждая строка в базе фильмов - это JSON объект с краткой информацией о
+	// фильме. Извлекаем этот объект и добавляем фильм в очередь, если его нет
+	// в БД. Фильмы добавляются пачками вместе с номером последней
+	// обработанной строки.
+	var tmdbIDs []int
+	line := 0
 	scanner := bufio.NewScanner(gzipReader)
 	for scanner.Scan() {
-		movieRaw := scanner.Text()
-		var movie movieBrief
-		err = json.Unmarshal([]byte(movieRaw), &movie)
-		if err != nil || movie.TMDBID == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line++
+		if line <= exportLine {
 			continue
 		}
 
-		var movieDBID int64
-		err = movieDBIDStmt.QueryRow(movie.TMDBID).Scan(&movieDBID)
-		if err != nil && err != sqlite.ErrNoRows {
-			journal.Error(goID, " ", err)
-			continue
+		var movie movieBrief
+		err = json.Unmarshal(scanner.Bytes(), &movie)
+		if err == nil && movie.TMDBID != 0 {
+			var movieDBID int64
+			err = movieDBIDStmt.QueryRowContext(ctx, movie.TMDBID).Scan(&movieDBID)
+			switch err {
+			case sqlite.ErrNoRows:
+				tmdbIDs = append(tmdbIDs, movie.TMDBID)
+			case nil:
+				journal.Trace(goID, " ", "movie [", movie.TMDBID, "] is contained in DB, skip fetching")
+			default:
+				journal.Error(goID, " ", err)
+			}
 		}
 
-		// Отправляем фильм дальше, если его нет в БД.
-		if err == sqlite.ErrNoRows {
-			select {
-			case movieID <- movie.TMDBID:
-			case <-ctx.Done():
-				return
+		if line%harvestQueueBatchSize == 0 {
+			err = enqueueMovies(ctx, conn, tmdbIDs, harvestSourceExport, harvestExportLineStateName, line)
+			if err != nil {
+				return err
 			}
-		} else {
-			journal.Trace(goID, " ", "movie [", movie.TMDBID, "] is contained in DB, skip fetching")
+			tmdbIDs = tmdbIDs[:0]
 		}
 	}
 	err = scanner.Err()
 	if err != nil {
 		journal.Error(goID, " ", err)
 	}
+	return enqueueMovies(ctx, conn, tmdbIDs, harvestSourceExport, harvestExportLineStateName, line)
+}
 
-	//--------------------------------------------------------------------------------
-	// Обрабатываем изменившиеся фильмы.
-	//--------------------------------------------------------------------------------
-	journal.Info(goID, " processing changed movies")
-	rateLimitStr := strconv.Itoa(int(themoviedb.APIRateLimitDur.Seconds()))
-pagesLoop:
-	for page := 1; page <= themoviedb.ChangedMoviesMaxPage; page++ {
-		var movies []int
-		var err error
-	pageFetchLoop:
-		for i := 0; i < tmdbMaxRetries; i++ {
-			journal.Trace(goID, " fetching changed movies page #", page)
-			movies, err = client.GetChangedMovies(page)
-			switch err {
-			case nil:
-				journal.Info(goID, " changed movies page #", page, " fetch OK")
-				break pageFetchLoop
-
-			case themoviedb.ErrRateLimit:
-				if i == (tmdbMaxRetries - 1) {
-					journal.Info(goID, " changed movies page #", page, " fetch fail")
-					break pageFetchLoop
-				} else {
-					journal.Info(goID, " tmdb rate limit exceeded, sleeping for "+rateLimitStr+" sec")
-					time.Sleep(themoviedb.APIRateLimitDur)
-				}
-
-			case themoviedb.ErrPage:
-				break pagesLoop
+// seekChangedMovies добавляет в очередь все изменившиеся фильмы: у них могут
+// появиться постеры на недостающих языках или другие лучшие постеры.
+func seekChangedMovies(ctx context.Context, goID string, client *themoviedb.Client, conn *sqlite.Conn) error {
+	// Последняя обработанная страница, если сессия продолжается.
+	var lastPage int
+	err := harvestState(ctx, conn, harvestChangesPageStateName, &lastPage)
+	if err != nil {
+		return err
+	}
 
-			default:
-				journal.Error(goID, " changed movies page #", page, " fetch error: ", err)
-				break pageFetchLoop
-			}
+	journal.Info(goID, " processing changed movies starting from page #", lastPage+1)
+	for page := lastPage + 1; page <= themoviedb.ChangedMoviesMaxPage; page++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		for _, tmdbID := range movies {
-			finished, err := allPostersFetched(posterLangsStmt, tmdbID)
-			if err != nil {
-				journal.Error(goID, " ", err)
-				continue
-			}
+		// Лимит запросов и повторы при ошибках сервера обеспечивает сам
+		// клиент. Если страницу получить не удалось, то она пропускается.
+		journal.Trace(goID, " fetching changed movies page #", page)
+		movies, err := client.GetChangedMoviesContext(ctx, page)
+		if err == themoviedb.ErrPage {
+			break
+		}
+		if err != nil {
+			journal.Error(goID, " changed movies page #", page, " fetch error: ", err)
+		} else {
+			journal.Info(goID, " changed movies page #", page, " fetch OK")
+		}
 
-			if !finished {
-				select {
-				case movieID <- tmdbID:
-				case <-ctx.Done():
-					return
-				}
-			}
+		err = enqueueMovies(ctx, conn, movies, harvestSourceChanges, harvestChangesPageStateName, page)
+		if err != nil {
+			return err
 		}
 	}
 	journal.Info(goID, " changed movies processing end")
+	return nil
 }
 
-// tmdbCrawler извлекает по The MovieDB API данные о фильмах из movieID и
-// записывает эти данные в БД.
-func tmdbCrawler(goID string, wg *sync.WaitGroup, client *themoviedb.Client, dbName string, movieID <-chan int) {
+// tmdbCrawler забирает фильмы из очереди harvest_queue, извлекает по The
+// MovieDB API данные о них и записывает эти данные в БД. tmdbCrawler
+// завершается, когда очередь пуста и tmdbSeeker закрыл seekerDone. При отмене
+// ctx незавершённая транзакция прерывается и откатывается, а фильм
+// возвращается в очередь.
+func tmdbCrawler(ctx context.Context, goID string, wg *sync.WaitGroup, client *themoviedb.Client, pool *sqlite.Pool, posters posterStore, langs []iso6391.LangCode, seekerDone <-chan struct{}) {
 	journal.Info(goID, " started")
 	defer func() {
 		wg.Done()
 		journal.Info(goID, " finished")
 	}()
 
-	// Установка соединения с БД и её настройка.
-	conn, err := sqlite.NewConn(dbName)
-	if err != nil {
-		journal.Error(err)
-		return
-	}
-	defer conn.Close()
-	journal.Info(goID, " connected to database "+dbName)
+	seekerFinished := false
+	for {
+		tmdbID, claimed, err := claimMovie(ctx, pool)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
 
-	err = conn.SetBusyTimeout(dbBusyTimeoutMS)
-	if err != nil {
-		journal.Error(goID, " ", err)
-		return
-	}
-	journal.Trace(goID, " set database connection busy timeout to ", dbBusyTimeoutMS, " ms")
+		if !claimed {
+			if seekerFinished {
+				return
+			}
+			// Ждём, пока tmdbSeeker добавит фильмы в очередь. Если он
+			// завершился, то проверяем очередь последний раз.
+			timer := time.NewTimer(harvestQueuePollInterval)
+			select {
+			case <-timer.C:
+			case <-seekerDone:
+				timer.Stop()
+				seekerFinished = true
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			continue
+		}
 
-	// Подготовка запросов.
-	movieUpsertStmt, err := conn.Prepare(movieUpsertQuery)
-	if err != nil {
-		journal.Fatal(goID, " ", err)
-		return
+		err = crawlMovie(ctx, goID, client, pool, posters, langs, tmdbID)
+		err = finishMovie(ctx, pool, tmdbID, err)
+		if err != nil {
+			journal.Error(goID, " ", err)
+		}
 	}
-	defer movieUpsertStmt.Close()
-	journal.Trace(goID, " movie upsert query prepared")
+}
 
-	posterLangsStmt, err := conn.Prepare(posterLangsQuery)
+// crawlMovie извлекает по The MovieDB API данные о фильме tmdbID и записывает
+// эти данные в БД.
+func crawlMovie(ctx context.Context, goID string, client *themoviedb.Client, pool *sqlite.Pool, posters posterStore, langs []iso6391.LangCode, tmdbID int) error {
+	// Получаем общие данные фильма. Лимит запросов и повторы при ошибках
+	// сервера обеспечивает сам клиент.
+	journal.Trace(goID, " fetching movie [", tmdbID, "]")
+	movie, err := client.GetMovieContext(ctx, tmdbID)
 	if err != nil {
-		journal.Fatal(goID, " ", err)
-		return
+		journal.Error(goID, " movie [", tmdbID, "] fetch error: ", err)
+		return err
 	}
-	defer posterLangsStmt.Close()
-	journal.Trace(goID, " poster languages query prepared")
+	journal.Info(goID, " movie [", tmdbID, "] fetch OK")
 
-	posterInsertStmt, err := conn.Prepare(posterInsertQuery)
-	if err != nil {
-		journal.Fatal(goID, " ", err)
-		return
+	if movie.ReleaseDate.After(time.Now()) {
+		journal.Info(goID, " movie [", tmdbID, "] has still not released, skip")
+		return nil
 	}
-	defer posterInsertStmt.Close()
-	journal.Trace(goID, " poster insert query prepared")
 
-	movieDBIDStmt, err := conn.Prepare(movieDBIDQuery)
-	if err != nil {
-		journal.Fatal(goID, " ", err)
-		return
+	// Если image равен nil, то у постера в БД обновляются только путь и
+	// оценка.
+	type posterData struct {
+		image       []byte
+		lang        iso6391.LangCode
+		title       string
+		path        string
+		voteAverage float64
+		// Строка movie_detail с прежним постером на языке lang. Если равна 0,
+		// то постера на этом языке в БД ещё нет.
+		detailID int64
 	}
-	defer movieDBIDStmt.Close()
-	journal.Trace(goID, " movie id query prepared")
+	var fetchedPosters []posterData
 
-	rateLimitStr := strconv.Itoa(int(themoviedb.APIRateLimitDur.Seconds()))
-	// Закачиваем фильмы.
-mainLoop:
-	for tmdbID := range movieID {
-		var movie themoviedb.Movie
-		var err error
-		// Получаем общие данные фильма.
-	movieFetchLoop:
-		for i := 0; i < tmdbMaxRetries; i++ {
-			journal.Trace(goID, " fetching movie [", tmdbID, "]")
-			movie, err = client.GetMovie(tmdbID)
-			switch err {
-			case nil:
-				journal.Info(goID, " movie [", tmdbID, "] fetch OK")
-				break movieFetchLoop
-
-			case themoviedb.ErrRateLimit:
-				if i == (tmdbMaxRetries - 1) {
-					journal.Error(goID, " movie [", tmdbID, "] fetch fail")
-				} else {
-					journal.Info(goID, " tmdb rate limit exceeded, sleeping for "+rateLimitStr+" sec")
-					time.Sleep(themoviedb.APIRateLimitDur)
-				}
-
-			default:
-				journal.Error(goID, " movie [", tmdbID, "] fetch error: ", err)
-				break movieFetchLoop
-			}
-		}
+	movieHighRanked := false
+	if movie.OriginalLang != iso6391.En && containsLang(langs, movie.OriginalLang) {
+		movieHighRanked = movie.VoteCount >= minVoteCountLocal
+	} else {
+		movieHighRanked = movie.VoteCount >= minVoteCountDefault
+	}
+	// Закачиваем постеры фильма, если фильм популярен.
+	if movieHighRanked {
+		// Находим какие постеры уже есть в БД.
+		var inDBPosters map[iso6391.LangCode]fetchedPoster
+		err = withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+			var err error
+			inDBPosters, err = getFetchedPosters(ctx, conn, tmdbID)
+			return err
+		})
 		if err != nil {
-			continue
-		}
-
-		if movie.ReleaseDate.After(time.Now()) {
-			journal.Info(goID, " movie [", tmdbID, "] has still not released, skip")
-			continue
-		}
-
-		type posterData struct {
-			image []byte
-			lang  iso6391.LangCode
-			title string
+			journal.Error(goID, " ", err)
+			return err
 		}
-		var posters []posterData
 
-		movieHighRanked := false
-		if movie.OriginalLang == iso6391.Ru {
-			movieHighRanked = movie.VoteCount >= minVoteCountRu
-		} else {
-			movieHighRanked = movie.VoteCount >= minVoteCountDefault
-		}
-		// Закачиваем постеры фильма, если фильм популярен.
-		if movieHighRanked {
-			// Находим для каких языков постеры уже есть в БД.
-			inDBPosterLangs, err := getFetchedPosterLangs(posterLangsStmt, tmdbID)
-			if err != nil {
-				journal.Error(goID, " ", err)
+		for _, poster := range movie.Poster {
+			// Если нет названия фильма на том же языке, что и постер, то не скачиваем постер.
+			if title, ok := movie.Title[poster.Lang]; !ok || title == "" {
+				journal.Trace(goID, " movie [", tmdbID, "] has no title for poster ("+poster.Lang+"), skip fetching it")
 				continue
 			}
-
-			err = nil
-		posterLoop:
-			for _, poster := range movie.Poster {
-				// Если нет названия фильма на том же языке, что и постер, то не скачиваем постер.
-				if title, ok := movie.Title[poster.Lang]; !ok || title == "" {
-					journal.Trace(goID, " movie [", tmdbID, "] has no title for poster ("+poster.Lang+"), skip fetching it")
+			meta := posterData{
+				lang:        poster.Lang,
+				title:       movie.Title[poster.Lang],
+				path:        poster.Path,
+				voteAverage: poster.VoteAverage,
+			}
+			inDBPoster, inDB := inDBPosters[poster.Lang]
+			if inDB {
+				meta.detailID = inDBPoster.id
+				switch {
+				// Постер скачан до того, как стали сохраняться его путь и
+				// оценка. Считаем, что это и есть текущий лучший постер, и
+				// только запоминаем его путь и оценку, не скачивая постер.
+				case inDBPoster.path == "":
+					fetchedPosters = append(fetchedPosters, meta)
 					continue
-				}
-				// Не скачиваем постер, если он уже есть в БД.
-				if _, ok := inDBPosterLangs[poster.Lang]; ok {
+				// Тот же постер, у которого могла измениться оценка.
+				case inDBPoster.path == poster.Path:
+					if inDBPoster.voteAverage != poster.VoteAverage {
+						fetchedPosters = append(fetchedPosters, meta)
+					}
 					journal.Trace(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") is already in database, skip fetching it")
 					continue
+				// Другой постер с той же оценкой: The MovieDB просто вернул
+				// равноценные постеры в другом порядке, постер не заменяется.
+				case inDBPoster.voteAverage == poster.VoteAverage:
+					journal.Trace(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") has the same vote average as in database, skip fetching it")
+					continue
 				}
-				var image []byte
-
-			posterFetchLoop:
-				for i := 0; i < tmdbMaxRetries; i++ {
-					journal.Trace(goID, " fetching movie [", tmdbID, "] poster ("+poster.Lang+")")
-					image, err = client.GetPoster(poster.Path)
-					switch err {
-					case nil:
-						journal.Info(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") fetch OK")
-						title := movie.Title[poster.Lang]
-						posters = append(posters, posterData{image: image, lang: poster.Lang, title: title})
-						break posterFetchLoop
-
-					case themoviedb.ErrRateLimit:
-						if i == (tmdbMaxRetries - 1) {
-							journal.Error(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") fetch fail")
-						} else {
-							journal.Info(goID, " tmdb rate limit exceeded, sleeping for "+rateLimitStr+" sec")
-							time.Sleep(themoviedb.APIRateLimitDur)
-						}
-
-					default:
-						journal.Error(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") fetch error: ", err)
-						break posterLoop
-					}
-				}
+				journal.Info(goID, " movie [", tmdbID, "] best poster ("+poster.Lang+") changed from \""+inDBPoster.path+"\" to \""+poster.Path+"\"")
 			}
+
+			journal.Trace(goID, " fetching movie [", tmdbID, "] poster ("+poster.Lang+")")
+			image, err := client.GetPosterContext(ctx, poster.Path)
 			if err != nil {
-				continue
+				journal.Error(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") fetch error: ", err)
+				return err
 			}
-		} else {
-			journal.Trace(goID, " movie [", tmdbID, "] is low voted, skip posters fetching")
+			journal.Info(goID, " movie [", tmdbID, "] poster ("+poster.Lang+") fetch OK")
+			meta.image = image
+			fetchedPosters = append(fetchedPosters, meta)
 		}
+	} else {
+		journal.Trace(goID, " movie [", tmdbID, "] is low voted, skip posters fetching")
+	}
 
-		// Добавляем полученные данные в БД.
-		err = conn.Begin()
+	// Добавляем полученные данные в БД. Соединение берётся из пула
+	// только на время транзакции, а не на время закачки фильма.
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		journal.Error(goID, " ", err)
+		return err
+	}
+	// Транзакция начинается сразу с блокировкой на запись, т.к. другие
+	// tmdbCrawler'ы тоже пишут в БД. Если БД всё-таки окажется занятой,
+	// то WithTx повторит транзакцию.
+	// Картинки заменённых постеров удаляются из хранилища только после
+	// подтверждения транзакции.
+	var replacedRefs []string
+	err = conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+		replacedRefs = replacedRefs[:0]
+		movieUpsertStmt, err := conn.PrepareCached(movieUpsertQuery)
 		if err != nil {
-			journal.Error(goID, " cannot begin transaction: ", err)
-			continue
+			return err
+		}
+		movieDBIDStmt, err := conn.PrepareCached(movieDBIDQuery)
+		if err != nil {
+			return err
+		}
+		posterInsertStmt, err := conn.PrepareCached(posterInsertQuery)
+		if err != nil {
+			return err
+		}
+		posterUpdateStmt, err := conn.PrepareCached(posterUpdateQuery)
+		if err != nil {
+			return err
+		}
+		posterMetaUpdateStmt, err := conn.PrepareCached(posterMetaUpdateQuery)
+		if err != nil {
+			return err
+		}
+		fileIDDeleteStmt, err := conn.PrepareCached(fileIDDeleteQuery)
+		if err != nil {
+			return err
 		}
 
-		// Объявляем movieDBID здесь, т.к. goto не может перепрыгивать через
-		// объявления переменных.
-		var movieDBID int64
 		// Добавляем описание фильма в таблицу movie.
 		journal.Trace(goID, " adding (or updading) movie [", tmdbID, "] description to database")
-		_, err = movieUpsertStmt.Exec(
-			movie.TMDBID,
-			movie.OriginalTitle,
-			movie.OriginalLang,
-			movie.ReleaseDate.Format("2006-01-02"),
-			movie.Adult,
-			movie.IMDBID,
-			movie.VoteCount,
-			movie.VoteAverage,
-			movie.Collection.ID)
+		_, err = movieUpsertStmt.ExecContext(ctx, newMovieRecord(&movie))
 		if err != nil {
-			goto DBError
+			return err
 		}
 
 		// Получаем идентификатор, с которым фильм был добавлен в таблицу movie.
-		err = movieDBIDStmt.QueryRow(tmdbID).Scan(&movieDBID)
+		var movieDBID int64
+		err = movieDBIDStmt.QueryRowContext(ctx, tmdbID).Scan(&movieDBID)
 		if err != nil {
-			goto DBError
+			return err
 		}
 
-		// Добавляем постеры в БД.
-		for _, poster := range posters {
-			journal.Trace(goID, " adding movie [", tmdbID, "] poster ("+poster.lang+") to database")
-			_, err = posterInsertStmt.Exec(movieDBID, poster.lang, poster.title, poster.image)
+		// Добавляем постеры в БД или заменяем прежние постеры.
+		for _, poster := range fetchedPosters {
+			detailID := poster.detailID
+			if poster.image == nil {
+				_, err = posterMetaUpdateStmt.ExecContext(ctx, detailID, poster.path, poster.voteAverage)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if detailID == 0 {
+				journal.Trace(goID, " adding movie [", tmdbID, "] poster ("+poster.lang+") to database")
+				result, err := posterInsertStmt.ExecContext(ctx, movieDBID, poster.lang, poster.title, poster.path, poster.voteAverage)
+				if err != nil {
+					return err
+				}
+				detailID, err = result.LastInsertId()
+				if err != nil {
+					return err
+				}
+			} else {
+				journal.Trace(goID, " replacing movie [", tmdbID, "] poster ("+poster.lang+") in database")
+				_, err = posterUpdateStmt.ExecContext(ctx, detailID, poster.path, poster.voteAverage)
+				if err != nil {
+					return err
+				}
+				// Прежний постер, загруженный в Telegram, больше не
+				// отправляется пользователям.
+				_, err = fileIDDeleteStmt.ExecContext(ctx, detailID)
+				if err != nil {
+					return err
+				}
+				ref, err := posters.ref(ctx, conn, detailID)
+				if err != nil {
+					return err
+				}
+				if ref != "" {
+					replacedRefs = append(replacedRefs, ref)
+				}
+			}
+			err = posters.put(ctx, conn, detailID, poster.image)
 			if err != nil {
-				goto DBError
+				return err
 			}
 		}
-
-		// Если мы дошли до этого места, то значит все данные готовы к добавлению в БД.
-		err = conn.Commit()
-		if err != nil {
-			goto DBError
-		} else {
-			journal.Info(goID, " adding movie [", tmdbID, "] data to database OK")
+		return nil
+	})
+	if err != nil {
+		journal.Error(goID, " adding movie [", tmdbID, "] data to database failed, rolled back: ", err)
+	} else {
+		journal.Info(goID, " adding movie [", tmdbID, "] data to database OK")
+		// Ошибка удаления прежних картинок не мешает обработке фильма,
+		// оставшиеся картинки удалит sweepPosterFiles.
+		releaseErr := posters.release(ctx, conn, replacedRefs)
+		if releaseErr != nil {
+			journal.Error(goID, " movie [", tmdbID, "] replaced posters release error: ", releaseErr)
 		}
-		continue mainLoop
+	}
+	pool.Put(conn)
+	return err
+}
 
-	DBError:
-		journal.Error(goID, " ", err, ", rolling back")
-		err = conn.Rollback()
-		if err != nil {
-			journal.Error(goID, " ", err)
+// containsLang возвращает true, если язык lang есть в langs.
+func containsLang(langs []iso6391.LangCode, lang iso6391.LangCode) bool {
+	for _, l := range langs {
+		if l == lang {
+			return true
 		}
 	}
+	return false
 }
 
-// allPostersFetched возвращает true, nil есть все постеры фильма с
-// идентификатором tmdbID уже получены.
-func allPostersFetched(posterLangsStmt *sqlite.Stmt, tmdbID int) (bool, error) {
-	inDBPosterLangs, err := getFetchedPosterLangs(posterLangsStmt, tmdbID)
-	if err != nil {
-		return false, err
-	}
-	_, EnPosterFetched := inDBPosterLangs[iso6391.En]
-	_, RuPosterFetched := inDBPosterLangs[iso6391.Ru]
-	return EnPosterFetched && RuPosterFetched, nil
+// fetchedPoster - постер фильма, который уже есть в БД.
+type fetchedPoster struct {
+	id          int64   // Идентификатор строки movie_detail.
+	path        string  // Путь к постеру в The MovieDB, если он известен.
+	voteAverage float64 // Оценка постера в The MovieDB на момент сохранения.
 }
 
-// getFetchedPosterLangs находит языки, для которых постеры есть в БД.
-func getFetchedPosterLangs(posterLangsStmt *sqlite.Stmt, tmdbID int) (map[iso6391.LangCode]struct{}, error) {
-	rows, err := posterLangsStmt.Query(tmdbID)
+// getFetchedPosters находит постеры фильма tmdbID, которые есть в БД, по их
+// языкам.
+func getFetchedPosters(ctx context.Context, conn *sqlite.Conn, tmdbID int) (map[iso6391.LangCode]fetchedPoster, error) {
+	stmt, err := conn.PrepareCached(fetchedPostersQuery)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, tmdbID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	posterLangs := map[iso6391.LangCode]struct{}{}
+	fetched := map[iso6391.LangCode]fetchedPoster{}
 	for rows.Next() {
+		var poster fetchedPoster
 		var lang string
-		err = rows.Scan(&lang)
+		err = rows.Scan(&poster.id, &lang, &poster.path, &poster.voteAverage)
 		if err != nil {
 			return nil, err
 		}
-		posterLangs[lang] = struct{}{}
+		fetched[lang] = poster
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return posterLangs, nil
+	return fetched, nil
 }
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/themoviedb"
+	"github.com/source-farm/movie-promo-bot/themoviedb/themoviedbtest"
+)
+
+const testTMDBKey = "test-key"
+
+// Фильмы, которые отдаёт поддельный сервер The MovieDB.
+var testTMDBMovies = []themoviedbtest.Movie{
+	{
+		TMDBID:        550,
+		OriginalTitle: "Fight Club",
+		OriginalLang:  iso6391.En,
+		ReleaseDate:   "1999-10-15",
+		VoteCount:     20000,
+		Title:         map[iso6391.LangCode]string{iso6391.En: "Fight Club", iso6391.Ru: "Бойцовский клуб", iso6391.Uk: "Бійцівський клуб"},
+		Posters: []themoviedb.Poster{
+			{Lang: iso6391.En, Path: "/fight-club-en.jpg", VoteAverage: 5.5},
+			{Lang: iso6391.Ru, Path: "/fight-club-ru.jpg", VoteAverage: 5.2},
+			{Lang: iso6391.Uk, Path: "/fight-club-uk.jpg", VoteAverage: 5.1},
+		},
+	},
+	{
+		TMDBID:        20992,
+		OriginalTitle: "Брат 2",
+		OriginalLang:  iso6391.Ru,
+		ReleaseDate:   "2000-05-11",
+		VoteCount:     10,
+		Collection:    themoviedb.MovieCollection{ID: 146402, Name: "Брат"},
+		Title:         map[iso6391.LangCode]string{iso6391.Ru: "Брат 2"},
+		Posters: []themoviedb.Poster{
+			{Lang: iso6391.Ru, Path: "/brat-2-ru.jpg", VoteAverage: 5.3},
+		},
+	},
+	// Немецкий фильм. Голосов достаточно только для фильма на языке из
+	// настроек.
+	{
+		TMDBID:        387,
+		OriginalTitle: "Das Boot",
+		OriginalLang:  iso6391.De,
+		ReleaseDate:   "1981-09-16",
+		VoteCount:     10,
+		Title:         map[iso6391.LangCode]string{iso6391.De: "Das Boot", iso6391.En: "Das Boot"},
+		Posters: []themoviedb.Poster{
+			{Lang: iso6391.De, Path: "/das-boot-de.jpg", VoteAverage: 5.3},
+			{Lang: iso6391.En, Path: "/das-boot-en.jpg", VoteAverage: 5.3},
+		},
+	},
+	// Мало голосов - постеры не скачиваются.
+	{
+		TMDBID:        100,
+		OriginalTitle: "Unpopular",
+		OriginalLang:  iso6391.En,
+		ReleaseDate:   "2010-01-01",
+		VoteCount:     1,
+		Title:         map[iso6391.LangCode]string{iso6391.En: "Unpopular"},
+		Posters:       []themoviedb.Poster{{Lang: iso6391.En, Path: "/unpopular.jpg"}},
+	},
+	// Фильм ещё не вышел - не добавляется в БД.
+	{
+		TMDBID:        101,
+		OriginalTitle: "Future",
+		OriginalLang:  iso6391.En,
+		ReleaseDate:   time.Now().AddDate(1, 0, 0).Format("2006-01-02"),
+		VoteCount:     1000,
+		Title:         map[iso6391.LangCode]string{iso6391.En: "Future"},
+		Posters:       []themoviedb.Poster{{Lang: iso6391.En, Path: "/future.jpg"}},
+	},
+}
+
+// setupTestHarvester создаёт пустую тестовую БД и поддельный сервер The
+// MovieDB с фильмами из testTMDBMovies.
+func setupTestHarvester(t *testing.T) (*themoviedbtest.Server, string) {
+	dir, err := ioutil.TempDir("", "movie-promo-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dbName := filepath.Join(dir, "test.db")
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := themoviedbtest.NewServer(testTMDBKey)
+	t.Cleanup(server.Close)
+	var ids []int
+	for i, movie := range testTMDBMovies {
+		server.AddMovie(movie)
+		for j, poster := range movie.Posters {
+			server.AddPoster(poster.Path, themoviedbtest.PosterImage(i*10+j))
+		}
+		ids = append(ids, movie.TMDBID)
+	}
+	server.SetDailyExport(time.Now().AddDate(0, 0, -1), ids)
+	return server, dbName
+}
+
+// runHarvest выполняет обработку файла экспорта и изменившихся фильмов так
+// же, как это делает theMovieDBHarvester, когда обе обработки запланированы
+// на одно время.
+func runHarvest(t *testing.T, client *themoviedb.Client, dbName, posterDir string, langs []iso6391.LangCode) {
+	runHarvestContext(context.Background(), t, client, dbName, posterDir, langs)
+}
+
+// runHarvestContext - это runHarvest, который можно прервать отменой ctx.
+func runHarvestContext(ctx context.Context, t *testing.T, client *themoviedb.Client, dbName, posterDir string, langs []iso6391.LangCode) {
+	for _, stage := range []string{harvestStageExport, harvestStageChanges} {
+		// Продолженная прерванная сессия не заменяет запланированную.
+		for runHarvestSession(ctx, t, client, dbName, posterDir, langs, stage) {
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// runHarvestSession выполняет одну сессию получения фильмов с этапа stage
+// через harvestSession. Возвращает true, если была продолжена прерванная
+// сессия.
+func runHarvestSession(ctx context.Context, t *testing.T, client *themoviedb.Client, dbName, posterDir string, langs []iso6391.LangCode, stage string) bool {
+	client.SetLangs(langs)
+	err := client.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := sqlite.NewPool(dbName, crawlersNum+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.SetBusyTimeout(dbBusyTimeoutMS)
+	posters, err := newPosterStore(posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		resumed bool
+		err     error
+	}
+	finished := make(chan result, 1)
+	go func() {
+		resumed, err := harvestSession(ctx, "[go tmdb-harvester-test]:", client, pool, posters, langs, stage)
+		finished <- result{resumed, err}
+	}()
+	select {
+	case res := <-finished:
+		if res.err != nil && ctx.Err() == nil {
+			t.Fatal(res.err)
+		}
+		return res.resumed && ctx.Err() == nil
+	case <-time.After(time.Second * 30):
+		t.Fatal("Harvest is not finished in time")
+	}
+	return false
+}
+
+// testPosters возвращает постеры из хранилища постеров по tmdb_id фильма и
+// языку.
+func testPosters(t *testing.T, dbName, posterDir string) map[int]map[iso6391.LangCode][]byte {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	store, err := newPosterStore(posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := conn.Prepare(`
+    SELECT m.tmdb_id, md.id, md.lang
+      FROM movie as m
+INNER JOIN movie_detail as md on m.id = md.fk_movie_id;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type detail struct {
+		tmdbID int64
+		id     int64
+		lang   string
+	}
+	var details []detail
+	for rows.Next() {
+		var d detail
+		err = rows.Scan(&d.tmdbID, &d.id, &d.lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		details = append(details, d)
+	}
+	rows.Close()
+
+	posters := map[int]map[iso6391.LangCode][]byte{}
+	for _, d := range details {
+		poster, err := store.get(context.Background(), conn, d.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if posters[int(d.tmdbID)] == nil {
+			posters[int(d.tmdbID)] = map[iso6391.LangCode][]byte{}
+		}
+		posters[int(d.tmdbID)][d.lang] = poster
+	}
+	return posters
+}
+
+// testMovieCount возвращает количество фильмов в БД.
+func testMovieCount(t *testing.T, dbName string) int64 {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("SELECT count(*) FROM movie;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var count int64
+	err = stmt.QueryRow().Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// testMovieRecord возвращает строку таблицы movie для фильма tmdbID.
+func testMovieRecord(t *testing.T, dbName string, tmdbID int) movieRecord {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare(`
+SELECT tmdb_id, original_title, original_lang, released_on, adult, imdb_id, vote_count, vote_average, collection_id
+  FROM movie
+ WHERE tmdb_id = :tmdb_id;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var record movieRecord
+	err = stmt.QueryRow(map[string]interface{}{"tmdb_id": tmdbID}).ScanStruct(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestHarvest(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+
+	runHarvest(t, server.Client(), dbName, "", themoviedb.DefaultLangs)
+
+	if count := testMovieCount(t, dbName); count != 4 {
+		t.Fatalf("Expected 4 movies in database, got %d", count)
+	}
+	posters := testPosters(t, dbName, "")
+	if len(posters) != 2 || len(posters[550]) != 2 || len(posters[20992]) != 1 {
+		t.Fatalf("Unexpected posters in database: %v", posters)
+	}
+	if !bytes.Equal(posters[550][iso6391.Ru], themoviedbtest.PosterImage(1)) {
+		t.Fatal("Unexpected Fight Club russian poster")
+	}
+	if !bytes.Equal(posters[20992][iso6391.Ru], themoviedbtest.PosterImage(10)) {
+		t.Fatal("Unexpected Brat 2 poster")
+	}
+	if server.RequestCount("/t/p/") != 3 {
+		t.Fatalf("Expected 3 poster requests, got %d", server.RequestCount("/t/p/"))
+	}
+
+	// Поля фильма записаны в свои колонки.
+	expected := movieRecord{
+		TMDBID:        20992,
+		OriginalTitle: "Брат 2",
+		OriginalLang:  iso6391.Ru,
+		ReleasedOn:    "2000-05-11",
+		VoteCount:     10,
+		CollectionID:  146402,
+	}
+	if record := testMovieRecord(t, dbName, 20992); record != expected {
+		t.Fatalf("Unexpected Brat 2 record %+v", record)
+	}
+}
+
+func TestHarvestServerErrors(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+
+	// Ошибка при получении фильма и при получении его постера, которая не
+	// проходит после всех повторов запроса. Однократное превышение лимита
+	// запросов клиент исправляет повтором.
+	server.FailNext("/3/movie/550", http.StatusServiceUnavailable, themoviedb.DefaultMaxRetries+1)
+	server.FailNext("/t/p/w500/brat-2-ru.jpg", http.StatusInternalServerError, themoviedb.DefaultMaxRetries+1)
+	server.FailNext("/3/movie/387", http.StatusTooManyRequests, 1)
+	runHarvestSession(context.Background(), t, server.Client(), dbName, "", themoviedb.DefaultLangs, harvestStageExport)
+
+	posters := testPosters(t, dbName, "")
+	if len(posters) != 0 {
+		t.Fatalf("Expected no posters in database, got %v", posters)
+	}
+	if count := testMovieCount(t, dbName); count != 2 {
+		t.Fatalf("Expected 2 movies in database, got %d", count)
+	}
+
+	// Следующая сессия докачивает фильмы, которые не удалось получить.
+	server.SetChangedMovies([]int{20992})
+	runHarvest(t, server.Client(), dbName, "", themoviedb.DefaultLangs)
+	posters = testPosters(t, dbName, "")
+	if len(posters[550]) != 2 || len(posters[20992]) != 1 {
+		t.Fatalf("Unexpected posters in database: %v", posters)
+	}
+}
+
+func TestHarvestLangs(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+
+	// Первая сессия с языками по-умолчанию, вторая - с дополнительными
+	// языками из настроек. Уже скачанные постеры не перекачиваются, а
+	// постеры на новых языках докачиваются через изменившиеся фильмы.
+	runHarvest(t, server.Client(), dbName, "", themoviedb.DefaultLangs)
+	server.SetChangedMovies([]int{550, 20992, 387})
+	requestsBefore := server.RequestCount("/t/p/")
+	runHarvest(t, server.Client(), dbName, "", []iso6391.LangCode{iso6391.En, iso6391.Ru, iso6391.Uk, iso6391.De})
+
+	posters := testPosters(t, dbName, "")
+	if len(posters[550]) != 3 || !bytes.Equal(posters[550][iso6391.Uk], themoviedbtest.PosterImage(2)) {
+		t.Fatalf("Unexpected Fight Club posters: %v", posters[550])
+	}
+	// У немецкого фильма достаточно голосов, т.к. немецкий есть в настройках.
+	if len(posters[387]) != 2 || !bytes.Equal(posters[387][iso6391.De], themoviedbtest.PosterImage(20)) {
+		t.Fatalf("Unexpected Das Boot posters: %v", posters[387])
+	}
+	if requests := server.RequestCount("/t/p/") - requestsBefore; requests != 3 {
+		t.Fatalf("Expected 3 new poster requests, got %d", requests)
+	}
+}
+
+func TestHarvestPosterRefresh(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+	posterDir := filepath.Join(filepath.Dir(dbName), "posters")
+	runHarvest(t, server.Client(), dbName, posterDir, themoviedb.DefaultLangs)
+
+	// Английский постер Бойцовского клуба уже отправлялся в Telegram, а
+	// русский был скачан до того, как стал сохраняться poster_path.
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+INSERT INTO telegram_file (fk_movie_detail_id, file_id)
+     SELECT md.id, 'old-file-id'
+       FROM movie as m
+ INNER JOIN movie_detail as md on m.id = md.fk_movie_id
+      WHERE m.tmdb_id = 550 AND md.lang = 'en';
+UPDATE movie_detail
+   SET poster_path = NULL, poster_vote_average = NULL
+ WHERE lang = 'ru' AND fk_movie_id = (SELECT id FROM movie WHERE tmdb_id = 550);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSum := sha256.Sum256(themoviedbtest.PosterImage(0))
+	oldHash := hex.EncodeToString(oldSum[:])
+	oldFile := filepath.Join(posterDir, oldHash[:2], oldHash)
+	if _, err = os.Stat(oldFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// В The MovieDB появился английский постер с более высокой оценкой и
+	// русский постер с той же оценкой, что и прежний.
+	movie := testTMDBMovies[0]
+	movie.Posters = append([]themoviedb.Poster{
+		{Lang: iso6391.En, Path: "/fight-club-en-new.jpg", VoteAverage: 6.1},
+		{Lang: iso6391.Ru, Path: "/fight-club-ru-same.jpg", VoteAverage: 5.2},
+	}, movie.Posters...)
+	server.AddMovie(movie)
+	server.AddPoster("/fight-club-en-new.jpg", themoviedbtest.PosterImage(100))
+	server.AddPoster("/fight-club-ru-same.jpg", themoviedbtest.PosterImage(101))
+	server.SetChangedMovies([]int{550, 20992})
+	requestsBefore := server.RequestCount("/t/p/")
+	runHarvest(t, server.Client(), dbName, posterDir, themoviedb.DefaultLangs)
+
+	// Скачивается только новый лучший постер. У русского постера путь был
+	// неизвестен, поэтому запоминается путь текущего лучшего постера.
+	if requests := server.RequestCount("/t/p/") - requestsBefore; requests != 1 {
+		t.Fatalf("Expected 1 new poster request, got %d", requests)
+	}
+	posters := testPosters(t, dbName, posterDir)
+	if len(posters[550]) != 2 || !bytes.Equal(posters[550][iso6391.En], themoviedbtest.PosterImage(100)) ||
+		!bytes.Equal(posters[550][iso6391.Ru], themoviedbtest.PosterImage(1)) {
+		t.Fatalf("Unexpected Fight Club posters: %v", posters[550])
+	}
+	// Файл заменённого постера удаляется.
+	if _, err = os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected replaced poster file to be removed, got %v", err)
+	}
+
+	type detail struct {
+		lang        string
+		path        string
+		voteAverage float64
+		updated     bool
+		hasFileID   bool
+	}
+	testDetails := func() []detail {
+		stmt, err := conn.Prepare(`
+    SELECT md.lang, md.poster_path, md.poster_vote_average, md.updated_on IS NOT NULL, tf.file_id IS NOT NULL
+      FROM movie as m
+INNER JOIN movie_detail as md on m.id = md.fk_movie_id
+ LEFT JOIN telegram_file as tf on md.id = tf.fk_movie_detail_id
+     WHERE m.tmdb_id = 550
+  ORDER BY md.lang;
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stmt.Close()
+		rows, err := stmt.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var details []detail
+		for rows.Next() {
+			var d detail
+			err = rows.Scan(&d.lang, &d.path, &d.voteAverage, &d.updated, &d.hasFileID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			details = append(details, d)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return details
+	}
+	expected := []detail{
+		{iso6391.En, "/fight-club-en-new.jpg", 6.1, true, false},
+		{iso6391.Ru, "/fight-club-ru-same.jpg", 5.2, false, false},
+	}
+	if details := testDetails(); !reflect.DeepEqual(details, expected) {
+		t.Fatalf("Expected Fight Club posters %+v, got %+v", expected, details)
+	}
+
+	// Равноценный постер не заменяет уже сохранённый, а изменившаяся оценка
+	// того же постера запоминается без его скачивания.
+	movie.Posters = []themoviedb.Poster{
+		{Lang: iso6391.En, Path: "/fight-club-en-new.jpg", VoteAverage: 6.3},
+		{Lang: iso6391.Ru, Path: "/fight-club-ru.jpg", VoteAverage: 5.2},
+	}
+	server.AddMovie(movie)
+	requestsBefore = server.RequestCount("/t/p/")
+	runHarvest(t, server.Client(), dbName, posterDir, themoviedb.DefaultLangs)
+	if requests := server.RequestCount("/t/p/") - requestsBefore; requests != 0 {
+		t.Fatalf("Expected no new poster requests, got %d", requests)
+	}
+	expected[0].voteAverage = 6.3
+	if details := testDetails(); !reflect.DeepEqual(details, expected) {
+		t.Fatalf("Expected Fight Club posters %+v, got %+v", expected, details)
+	}
+}
+
+func TestHarvestResume(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+
+	// Бот упал на этапе обработки изменившихся фильмов: файл экспорта уже
+	// обработан, один фильм обрабатывался, другой ждёт в очереди, а на
+	// третьем бот падал уже movieFetchMaxFails раз.
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`
+INSERT INTO harvest_queue (tmdb_id, source, state, attempts)
+     VALUES (550, 'export', 'claimed', 1),
+            (20992, 'export', 'pending', 0),
+            (100, 'export', 'claimed', 3);
+INSERT INTO bot_state (name, value)
+     VALUES ('harvest_stage', 'changes'),
+            ('harvest_changes_page', 0);
+`)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetChangedMovies([]int{387})
+	resumed := runHarvestSession(context.Background(), t, server.Client(), dbName, "", themoviedb.DefaultLangs, harvestStageExport)
+	if !resumed {
+		t.Fatal("Expected interrupted session to be resumed")
+	}
+
+	if requests := server.RequestCount("/p/exports/"); requests != 0 {
+		t.Fatalf("Expected no daily export requests, got %d", requests)
+	}
+	if count := testMovieCount(t, dbName); count != 3 {
+		t.Fatalf("Expected 3 movies in database, got %d", count)
+	}
+	posters := testPosters(t, dbName, "")
+	if len(posters[550]) != 2 || len(posters[20992]) != 1 {
+		t.Fatalf("Unexpected posters in database: %v", posters)
+	}
+	states := testQueueStates(t, dbName)
+	expected := map[int]string{550: queueStateDone, 20992: queueStateDone, 387: queueStateDone, 100: queueStateFailed}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("Expected queue states %v, got %v", expected, states)
+	}
+
+	// Следующая сессия очищает очередь и начинается с файла экспорта, из
+	// которого снова берётся фильм, на котором бот падал.
+	runHarvestSession(context.Background(), t, server.Client(), dbName, "", themoviedb.DefaultLangs, harvestStageExport)
+	if requests := server.RequestCount("/p/exports/"); requests != 1 {
+		t.Fatalf("Expected 1 daily export request, got %d", requests)
+	}
+	if count := testMovieCount(t, dbName); count != 4 {
+		t.Fatalf("Expected 4 movies in database, got %d", count)
+	}
+	states = testQueueStates(t, dbName)
+	if states[100] != queueStateDone || states[550] != "" {
+		t.Fatalf("Unexpected queue states %v", states)
+	}
+}
+
+func TestHarvestShutdown(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+
+	// Бот останавливается, пока постер Бойцовского клуба ещё скачивается.
+	const posterDelay = time.Second * 10
+	server.Inject(themoviedbtest.Fault{Path: "/t/p/", Delay: posterDelay})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for server.RequestCount("/t/p/") == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+		cancel()
+	}()
+	start := time.Now()
+	runHarvestContext(ctx, t, server.Client(), dbName, "", themoviedb.DefaultLangs)
+	if elapsed := time.Since(start); elapsed >= posterDelay {
+		t.Fatalf("Harvest is not stopped in time (%v)", elapsed)
+	}
+
+	// Прерванный фильм вернулся в очередь без траты попытки, а сессия
+	// осталась незавершённой.
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.PrepareCached("SELECT state, attempts FROM harvest_queue WHERE tmdb_id = 550;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state, stage string
+	var attempts int
+	err = stmt.QueryRow().Scan(&state, &attempts)
+	if err == nil {
+		err = harvestState(context.Background(), conn, harvestStageStateName, &stage)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != queueStatePending || attempts != 0 || stage == "" {
+		t.Fatalf("Unexpected queue state %s (%d attempts) and stage %q after shutdown", state, attempts, stage)
+	}
+
+	// После перезапуска сессия продолжается и докачивает фильм.
+	server.ClearFaults()
+	resumed := runHarvestSession(context.Background(), t, server.Client(), dbName, "", themoviedb.DefaultLangs, harvestStageExport)
+	if !resumed {
+		t.Fatal("Expected interrupted session to be resumed")
+	}
+	if count := testMovieCount(t, dbName); count != 4 {
+		t.Fatalf("Expected 4 movies in database, got %d", count)
+	}
+	if posters := testPosters(t, dbName, ""); len(posters[550]) != 2 {
+		t.Fatalf("Unexpected posters in database: %v", posters)
+	}
+	if requests := server.RequestCount("/p/exports/"); requests != 1 {
+		t.Fatalf("Expected 1 daily export request, got %d", requests)
+	}
+}
+
+// testQueueStates возвращает состояния фильмов в очереди harvest_queue по
+// tmdb_id.
+func testQueueStates(t *testing.T, dbName string) map[int]string {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("SELECT tmdb_id, state FROM harvest_queue;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	states := map[int]string{}
+	for rows.Next() {
+		var tmdbID int
+		var state string
+		err = rows.Scan(&tmdbID, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[tmdbID] = state
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+// Очередь фильмов сборщика хранится в таблице harvest_queue, а ход сессии
+// получения фильмов (этап и место, до которого tmdbSeeker дошёл на этом
+// этапе) - в таблице bot_state. Поэтому после перезапуска бота незавершённая
+// сессия продолжается с того же места, а фильмы, которые tmdbSeeker уже
+// нашёл, не теряются.
+
+const (
+	// Откуда фильм попал в очередь.
+	harvestSourceExport  = "export"  // Из файла ежедневного экспорта.
+	harvestSourceChanges = "changes" // Из списка изменившихся фильмов.
+
+	// Состояния фильма в очереди.
+	queueStatePending = "pending" // Ждёт обработки.
+	queueStateClaimed = "claimed" // Обрабатывается tmdbCrawler'ом.
+	queueStateDone    = "done"    // Обработан.
+	queueStateFailed  = "failed"  // Не удалось обработать, повторяется в следующей сессии.
+
+	// Этапы сессии получения фильмов. Сессия начинается с обработки файла
+	// ежедневного экспорта или изменившихся фильмов (по расписанию каждой из
+	// них) и заканчивается обработкой остатка очереди. Пустой этап означает,
+	// что незавершённой сессии нет.
+	harvestStageExport  = "export"  // Обработка файла ежедневного экспорта.
+	harvestStageChanges = "changes" // Обработка изменившихся фильмов.
+	harvestStageCrawl   = "crawl"   // tmdbSeeker закончил, обрабатывается остаток очереди.
+
+	// Названия значений в таблице bot_state.
+	harvestStageStateName       = "harvest_stage"
+	harvestExportDateStateName  = "harvest_export_date"  // Дата обрабатываемого файла экспорта.
+	harvestExportLineStateName  = "harvest_export_line"  // Количество обработанных строк файла экспорта.
+	harvestChangesPageStateName = "harvest_changes_page" // Последняя обработанная страница изменившихся фильмов.
+
+	// Количество строк файла экспорта, которые добавляются в очередь одной
+	// транзакцией вместе с сохранением места в файле.
+	harvestQueueBatchSize = 1000
+	// Пауза tmdbCrawler'а перед повторной проверкой пустой очереди.
+	harvestQueuePollInterval = time.Millisecond * 200
+
+	queueInsertQuery = `
+INSERT INTO harvest_queue (tmdb_id, source)
+     VALUES (?1, ?2)
+ON CONFLICT (tmdb_id) DO NOTHING;
+`
+
+	queuePendingQuery = `
+  SELECT tmdb_id
+    FROM harvest_queue
+   WHERE state = 'pending'
+ORDER BY tmdb_id
+   LIMIT 1;
+`
+
+	queueClaimQuery = `
+UPDATE harvest_queue
+   SET state = 'claimed', attempts = attempts + 1, updated_on = datetime('now')
+ WHERE tmdb_id = ?1;
+`
+
+	queueFinishQuery = `
+UPDATE harvest_queue
+   SET state = ?2, last_error = ?3, updated_on = datetime('now')
+ WHERE tmdb_id = ?1;
+`
+
+	// Возврат фильма в очередь, если его обработка была прервана
+	// остановкой бота. Это не считается попыткой.
+	queueReleaseQuery = `
+UPDATE harvest_queue
+   SET state = 'pending', attempts = attempts - 1, updated_on = datetime('now')
+ WHERE tmdb_id = ?1;
+`
+
+	// Фильмы, которые обрабатывались во время падения бота, возвращаются в
+	// очередь. Если на таком фильме бот падает постоянно, то фильм
+	// пропускается до следующей сессии.
+	queueResumeQuery = `
+UPDATE harvest_queue
+   SET state = CASE WHEN attempts >= ?1 THEN 'failed' ELSE 'pending' END,
+       updated_on = datetime('now')
+ WHERE state = 'claimed';
+`
+
+	// Очистка очереди перед новой сессией. Фильмы, которые не удалось
+	// обработать, повторяются, пока не кончатся попытки.
+	queueCleanupQuery = `
+DELETE FROM harvest_queue
+      WHERE state = 'done' OR (state = 'failed' AND attempts >= ?1);
+`
+	queueRetryQuery = `
+UPDATE harvest_queue
+   SET state = 'pending', updated_on = datetime('now')
+ WHERE state = 'failed';
+`
+)
+
+// startHarvestSession начинает новую сессию получения фильмов с этапа stage
+// или, если предыдущая сессия была прервана, продолжает её. Возвращает true,
+// если сессия продолжена.
+func startHarvestSession(ctx context.Context, pool *sqlite.Pool, stage string) (bool, error) {
+	resumed := false
+	err := withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+		return conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+			var interrupted string
+			err := harvestState(ctx, conn, harvestStageStateName, &interrupted)
+			if err != nil {
+				return err
+			}
+			if interrupted != "" {
+				resumed = true
+				return execCached(ctx, conn, queueResumeQuery, movieFetchMaxFails)
+			}
+
+			err = execCached(ctx, conn, queueCleanupQuery, movieFetchMaxFails)
+			if err == nil {
+				err = execCached(ctx, conn, queueRetryQuery)
+			}
+			if err == nil {
+				err = setHarvestState(ctx, conn, harvestExportDateStateName, "")
+			}
+			if err == nil {
+				err = setHarvestState(ctx, conn, harvestExportLineStateName, 0)
+			}
+			if err == nil {
+				err = setHarvestState(ctx, conn, harvestChangesPageStateName, 0)
+			}
+			if err == nil {
+				err = setHarvestState(ctx, conn, harvestStageStateName, stage)
+			}
+			return err
+		})
+	})
+	return resumed, err
+}
+
+// finishHarvestSession отмечает, что незавершённой сессии получения фильмов
+// нет. Обработанные фильмы остаются в очереди до начала следующей сессии.
+func finishHarvestSession(ctx context.Context, pool *sqlite.Pool) error {
+	return withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+		return setHarvestState(ctx, conn, harvestStageStateName, "")
+	})
+}
+
+// enqueueMovies добавляет фильмы tmdbIDs из источника source в очередь и
+// сохраняет в bot_state значение checkpoint под названием checkpointName
+// одной транзакцией, т.е. место, до которого tmdbSeeker обработал источник,
+// всегда соответствует содержимому очереди.
+func enqueueMovies(ctx context.Context, conn *sqlite.Conn, tmdbIDs []int, source, checkpointName string, checkpoint interface{}) error {
+	return conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+		stmt, err := conn.PrepareCached(queueInsertQuery)
+		if err != nil {
+			return err
+		}
+		for _, tmdbID := range tmdbIDs {
+			_, err = stmt.ExecContext(ctx, tmdbID, source)
+			if err != nil {
+				return err
+			}
+		}
+		return setHarvestState(ctx, conn, checkpointName, checkpoint)
+	})
+}
+
+// claimMovie забирает из очереди фильм на обработку. Если в очереди нет
+// ожидающих обработки фильмов, то возвращается false.
+func claimMovie(ctx context.Context, pool *sqlite.Pool) (int, bool, error) {
+	var tmdbID int
+	claimed := false
+	err := withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+		return conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+			stmt, err := conn.PrepareCached(queuePendingQuery)
+			if err != nil {
+				return err
+			}
+			err = stmt.QueryRowContext(ctx).Scan(&tmdbID)
+			if err == sqlite.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			claimed = true
+			return execCached(ctx, conn, queueClaimQuery, tmdbID)
+		})
+	})
+	return tmdbID, claimed && err == nil, err
+}
+
+// finishMovie записывает в очередь результат обработки фильма tmdbID.
+// crawlErr - ошибка обработки фильма или nil. Если обработка была прервана
+// отменой ctx, то фильм возвращается в очередь.
+func finishMovie(ctx context.Context, pool *sqlite.Pool, tmdbID int, crawlErr error) error {
+	if ctx.Err() != nil {
+		// Бот останавливается, но фильм нужно успеть вернуть в очередь.
+		return withConn(context.Background(), pool, func(ctx context.Context, conn *sqlite.Conn) error {
+			return execCached(ctx, conn, queueReleaseQuery, tmdbID)
+		})
+	}
+
+	state, lastError := queueStateDone, interface{}(nil)
+	if crawlErr != nil {
+		state, lastError = queueStateFailed, crawlErr.Error()
+	}
+	return withConn(ctx, pool, func(ctx context.Context, conn *sqlite.Conn) error {
+		return execCached(ctx, conn, queueFinishQuery, tmdbID, state, lastError)
+	})
+}
+
+// harvestState записывает в dest значение name из таблицы bot_state. Если
+// значения нет, то dest не изменяется.
+func harvestState(ctx context.Context, conn *sqlite.Conn, name string, dest interface{}) error {
+	stmt, err := conn.PrepareCached(botStateQuery)
+	if err != nil {
+		return err
+	}
+	err = stmt.QueryRowContext(ctx, name).Scan(dest)
+	if err == sqlite.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// setHarvestState сохраняет значение value под названием name в таблицу
+// bot_state.
+func setHarvestState(ctx context.Context, conn *sqlite.Conn, name string, value interface{}) error {
+	return execCached(ctx, conn, botStateUpsertQuery, name, value)
+}
+
+// execCached выполняет запрос query из кэша SQL-предложений соединения conn.
+func execCached(ctx context.Context, conn *sqlite.Conn, query string, args ...interface{}) error {
+	stmt, err := conn.PrepareCached(query)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, args...)
+	return err
+}
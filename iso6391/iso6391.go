@@ -6,4 +6,7 @@ type LangCode = string
 const (
 	En LangCode = "en"
 	Ru          = "ru"
+	Uk          = "uk"
+	De          = "de"
+	Es          = "es"
 )
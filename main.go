@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"sync"
@@ -11,6 +12,11 @@ import (
 )
 
 func main() {
+	migratePostersFlag := flag.Bool("migrate-posters", false, "move posters from database to poster_dir from config and exit")
+	pendingMigrationsFlag := flag.Bool("pending-migrations", false, "show database schema migrations that are not applied yet and exit")
+	statusFlag := flag.Bool("status", false, "show movies harvest status and next planned runs of scheduled jobs and exit")
+	flag.Parse()
+
 	journal.Info("application started")
 
 	cfg, err := readConfig("config.json")
@@ -18,20 +24,56 @@ func main() {
 		journal.Fatal(err)
 	}
 
+	if *pendingMigrationsFlag {
+		err = printPendingMigrations(cfg.DBName)
+		if err != nil {
+			journal.Fatal(err)
+		}
+		journal.Stop()
+		return
+	}
+
+	if *statusFlag {
+		err = printStatus(cfg.DBName, &cfg.Schedule)
+		if err != nil {
+			journal.Fatal(err)
+		}
+		journal.Stop()
+		return
+	}
+
 	err = initDB(cfg.DBName)
 	if err != nil {
 		journal.Fatal(err)
 	}
 
+	// Перенос постеров из БД в папку с постерами выполняется отдельно от
+	// работы бота.
+	if *migratePostersFlag {
+		err = migratePosters(cfg.DBName, cfg.PosterDir)
+		if err != nil {
+			journal.Fatal(err)
+		}
+		journal.Info("application finished")
+		journal.Stop()
+		return
+	}
+
 	cancelCtx, cancel := context.WithCancel(context.Background())
 	wg := sync.WaitGroup{}
 	// Горутина для пополнения БД фильмами по The MovieDB API (api.themoviedb.org).
 	wg.Add(1)
-	go theMovieDBHarvester(cancelCtx, &wg, cfg.TheMovieDBKey, cfg.DBName)
+	go theMovieDBHarvester(cancelCtx, &wg, cfg.TheMovieDBKey, cfg.TheMovieDBURLs, cfg.Langs, cfg.DBName, cfg.PosterDir, cfg.Schedule)
+
+	// Горутина для периодического резервного копирования БД.
+	if cfg.Backup.Dir != "" {
+		wg.Add(1)
+		go backupJob(cancelCtx, &wg, cfg.Backup, cfg.DBName)
+	}
 
 	// Горутина бота - взаимодействие по Telegram Bot API с пользователями Telegram.
 	wg.Add(1)
-	go bot(cancelCtx, &wg, cfg.Bot, cfg.DBName)
+	go bot(cancelCtx, &wg, cfg.Bot, cfg.Langs, cfg.DBName, cfg.PosterDir, cfg.Schedule.Titles)
 
 	// Выходим при получении какого-либо сигнала закрытия программы.
 	quitSignal := make(chan os.Signal, 1)
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/source-farm/movie-promo-bot/journal"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+// migration - изменение схемы БД. Версия схемы БД хранится в PRAGMA
+// user_version и равна количеству выполненных миграций.
+type migration struct {
+	description string
+	up          string // SQL запросы миграции, разделённые ";".
+}
+
+// migrations - миграции схемы БД в порядке их выполнения. Миграция с
+// индексом i переводит БД из версии i в версию i+1. Уже добавленные
+// миграции изменять нельзя, любое изменение схемы - это новая миграция в
+// конце списка.
+// Первые миграции используют CREATE TABLE IF NOT EXISTS, т.к. до появления
+// миграций таблицы создавались без учёта версии и в существующих БД они уже
+// есть при user_version равном 0.
+var migrations = []migration{
+	{
+		description: "create movie and movie_detail tables",
+		up: `
+-- Основная таблица с информацией о фильме.
+CREATE TABLE IF NOT EXISTS movie (
+    id             INTEGER PRIMARY KEY,
+    tmdb_id        INTEGER NOT NULL UNIQUE,
+    original_title TEXT    NOT NULL,
+    original_lang  TEXT    NOT NULL,
+    released_on    TEXT    NOT NULL,
+    adult          INTEGER NOT NULL,
+    imdb_id        INTEGER,
+    vote_count     INTEGER,
+    vote_average   REAL,
+    collection_id  INTEGER, -- Если равен 0, то фильм не принадлежит никакой коллекции.
+    created_on     TEXT DEFAULT (datetime('now')),
+    updated_on     TEXT
+);
+
+-- Таблица с дополнительной информацией о фильме из таблицы movie.
+CREATE TABLE IF NOT EXISTS movie_detail (
+    id          INTEGER PRIMARY KEY,
+    fk_movie_id REFERENCES movie(id) NOT NULL,
+    lang        TEXT NOT NULL,
+    title       TEXT NOT NULL,
+    poster      BLOB,
+    created_on  TEXT DEFAULT (datetime('now')),
+    updated_on  TEXT,
+                UNIQUE (fk_movie_id, lang)
+);
+`,
+	},
+	{
+		description: "create bot_state table",
+		up: `
+-- Таблица для хранения состояния бота между перезапусками.
+CREATE TABLE IF NOT EXISTS bot_state (
+    name  TEXT PRIMARY KEY,
+    value
+);
+`,
+	},
+	{
+		description: "create telegram_user table",
+		up: `
+-- Таблица пользователей бота. Поле id - идентификатор пользователя в
+-- Telegram, lang - язык, на котором пользователю показываются постеры.
+CREATE TABLE IF NOT EXISTS telegram_user (
+    id          INTEGER PRIMARY KEY,
+    lang        TEXT    NOT NULL,
+    lang_chosen INTEGER NOT NULL DEFAULT 0, -- Если равен 1, то язык выбран командой /lang.
+    created_on  TEXT DEFAULT (datetime('now')),
+    updated_on  TEXT
+);
+`,
+	},
+	{
+		description: "create telegram_file table",
+		up: `
+-- Идентификаторы (file_id), под которыми постеры из movie_detail хранятся
+-- в Telegram после их первой отправки пользователю.
+CREATE TABLE IF NOT EXISTS telegram_file (
+    fk_movie_detail_id INTEGER PRIMARY KEY REFERENCES movie_detail(id),
+    file_id            TEXT NOT NULL,
+    created_on         TEXT DEFAULT (datetime('now')),
+    updated_on         TEXT
+);
+`,
+	},
+	{
+		description: "create poster_file table",
+		up: `
+-- Постеры из movie_detail, которые хранятся не в БД, а в папке с
+-- постерами (см. filePosterStore). Файл постера находится по его sha256.
+CREATE TABLE IF NOT EXISTS poster_file (
+    fk_movie_detail_id INTEGER PRIMARY KEY REFERENCES movie_detail(id),
+    sha256             TEXT NOT NULL,
+    created_on         TEXT DEFAULT (datetime('now')),
+    updated_on         TEXT
+);
+`,
+	},
+	{
+		description: "create movie_title_fts full-text index",
+		up: `
+-- Полнотекстовый индекс FTS5 по названиям фильмов из movie_detail. Сами
+-- названия хранятся только в movie_detail (external content table), а индекс
+-- обновляется триггерами. rowid индекса равен id в movie_detail.
+CREATE VIRTUAL TABLE movie_title_fts USING fts5(
+    title,
+    content = 'movie_detail',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+INSERT INTO movie_title_fts(movie_title_fts) VALUES ('rebuild');
+
+CREATE TRIGGER movie_detail_fts_insert AFTER INSERT ON movie_detail BEGIN
+    INSERT INTO movie_title_fts(rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER movie_detail_fts_delete AFTER DELETE ON movie_detail BEGIN
+    INSERT INTO movie_title_fts(movie_title_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER movie_detail_fts_update AFTER UPDATE OF title ON movie_detail BEGIN
+    INSERT INTO movie_title_fts(movie_title_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO movie_title_fts(rowid, title) VALUES (new.id, new.title);
+END;
+`,
+	},
+	{
+		description: "create harvest_queue table",
+		up: `
+-- Очередь фильмов сборщика. tmdbSeeker добавляет в неё фильмы из файла
+-- ежедневного экспорта (source = 'export') и из списка изменившихся фильмов
+-- (source = 'changes'), а tmdbCrawler'ы забирают их на обработку.
+CREATE TABLE IF NOT EXISTS harvest_queue (
+    tmdb_id    INTEGER PRIMARY KEY,
+    source     TEXT NOT NULL,
+    state      TEXT NOT NULL DEFAULT 'pending', -- pending, claimed, done или failed.
+    attempts   INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_on TEXT DEFAULT (datetime('now')),
+    updated_on TEXT
+);
+
+CREATE INDEX IF NOT EXISTS harvest_queue_state ON harvest_queue(state);
+`,
+	},
+	{
+		description: "add poster_path and poster_vote_average to movie_detail",
+		up: `
+-- Путь (file_path) и средняя оценка (vote_average) постера из movie_detail в
+-- The MovieDB. По ним сборщик определяет, что в The MovieDB появился другой
+-- лучший постер. У постеров, скачанных до этой миграции, поля равны NULL.
+ALTER TABLE movie_detail ADD COLUMN poster_path TEXT;
+ALTER TABLE movie_detail ADD COLUMN poster_vote_average REAL;
+`,
+	},
+}
+
+// schemaVersion возвращает версию схемы БД.
+func schemaVersion(conn *sqlite.Conn) (int, error) {
+	stmt, err := conn.Prepare("PRAGMA user_version;")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var version int64
+	err = stmt.QueryRow().Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if int(version) > len(migrations) {
+		return 0, errors.New("database schema version " + strconv.FormatInt(version, 10) +
+			" is newer than the latest known version " + strconv.Itoa(len(migrations)))
+	}
+	return int(version), nil
+}
+
+// pendingMigrations возвращает версию схемы БД и ещё не выполненные для неё
+// миграции.
+func pendingMigrations(conn *sqlite.Conn) (int, []migration, error) {
+	version, err := schemaVersion(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return version, migrations[version:], nil
+}
+
+// migrate выполняет невыполненные миграции схемы БД. Каждая миграция
+// выполняется в своей транзакции вместе с изменением версии схемы, поэтому
+// при ошибке БД остаётся в версии последней успешной миграции.
+func migrate(conn *sqlite.Conn) error {
+	version, pending, err := pendingMigrations(conn)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		journal.Trace("database schema version ", version, " is up to date")
+		return nil
+	}
+
+	for i, m := range pending {
+		newVersion := version + i + 1
+		journal.Info("applying migration #", newVersion, " (", m.description, ")")
+		// Запросы выполняются методами conn, т.к. у sqlite.Tx нет своих
+		// методов выполнения запросов: WithTx открыл транзакцию на этом же
+		// соединении, поэтому миграция и изменение версии схемы выполняются
+		// внутри неё и откатываются вместе.
+		err = conn.WithTx(context.Background(), sqlite.Immediate, func(*sqlite.Tx) error {
+			_, err := conn.Exec(m.up)
+			if err != nil {
+				return err
+			}
+			_, err = conn.Exec("PRAGMA user_version = " + strconv.Itoa(newVersion) + ";")
+			return err
+		})
+		if err != nil {
+			return errors.New("migration #" + strconv.Itoa(newVersion) + " (" + m.description + ") failed: " + err.Error())
+		}
+		journal.Info("migration #", newVersion, " OK")
+	}
+	return nil
+}
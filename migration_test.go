@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+// testMigrationDB возвращает имя ещё не созданной тестовой БД.
+func testMigrationDB(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "movie-promo-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "test.db")
+}
+
+// testSchemaVersion возвращает версию схемы БД dbName и количество
+// невыполненных для неё миграций.
+func testSchemaVersion(t *testing.T, dbName string) (int, int) {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	version, pending, err := pendingMigrations(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version, len(pending)
+}
+
+func TestMigrate(t *testing.T) {
+	dbName := testMigrationDB(t)
+
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if version, pending := testSchemaVersion(t, dbName); version != 0 || pending != len(migrations) {
+		t.Fatalf("Unexpected new database version %d with %d pending migrations", version, pending)
+	}
+
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, pending := testSchemaVersion(t, dbName); version != len(migrations) || pending != 0 {
+		t.Fatalf("Unexpected database version %d with %d pending migrations", version, pending)
+	}
+	_, err = conn.Exec("INSERT INTO bot_state (name, value) VALUES ('test', 1);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Повторная инициализация ничего не меняет.
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := testSchemaVersion(t, dbName); version != len(migrations) {
+		t.Fatalf("Unexpected database version %d", version)
+	}
+
+	// БД более новой версии, чем известно боту, не инициализируется.
+	_, err = conn.Exec("PRAGMA user_version = 1000;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initDB(dbName)
+	if err == nil {
+		t.Fatal("Expected error for newer database version, got nil")
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	dbName := testMigrationDB(t)
+
+	// БД, созданная до появления миграций: таблицы есть, а user_version
+	// равен 0.
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(migrations[0].up + migrations[1].up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec("INSERT INTO bot_state (name, value) VALUES ('test', 1);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := testSchemaVersion(t, dbName); version != len(migrations) {
+		t.Fatalf("Unexpected database version %d", version)
+	}
+	stmt, err := conn.Prepare("SELECT value FROM bot_state WHERE name = 'test';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var value int64
+	err = stmt.QueryRow().Scan(&value)
+	if err != nil || value != 1 {
+		t.Fatalf("Unexpected bot state %d (%v)", value, err)
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	dbName := testMigrationDB(t)
+	err := initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldMigrations := migrations
+	defer func() { migrations = oldMigrations }()
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{description: "good", up: "CREATE TABLE good (id INTEGER);"},
+		migration{description: "bad", up: "CREATE TABLE partial (id INTEGER); CREATE TABLE bad (;"},
+	)
+
+	// Ошибочная миграция откатывается целиком, а предыдущие остаются.
+	err = initDB(dbName)
+	if err == nil {
+		t.Fatal("Expected migration error, got nil")
+	}
+	if version, pending := testSchemaVersion(t, dbName); version != len(oldMigrations)+1 || pending != 1 {
+		t.Fatalf("Unexpected database version %d with %d pending migrations", version, pending)
+	}
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("SELECT * FROM good;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec("SELECT * FROM partial;")
+	if err == nil {
+		t.Fatal("Table of failed migration is not rolled back")
+	}
+}
+
+func TestMovieTitleFTS(t *testing.T) {
+	dbName := testMigrationDB(t)
+	err := initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("SELECT count(*) FROM movie_title_fts WHERE movie_title_fts MATCH ?1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	matches := func(text string) int64 {
+		t.Helper()
+		var count int64
+		err := stmt.QueryRow(sqlite.FTS5PrefixQuery(text, 1)).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Индекс обновляется триггерами при добавлении, изменении и удалении
+	// названий.
+	_, err = conn.Exec(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult) VALUES (1, 238, 'The Godfather', 'en', '1972-03-14', 0);
+INSERT INTO movie_detail (id, fk_movie_id, lang, title) VALUES (1, 1, 'en', 'The Godfather Part II');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := matches("godfather part"); n != 1 {
+		t.Fatalf("Expected 1 match for inserted title, got %d", n)
+	}
+	_, err = conn.Exec("UPDATE movie_detail SET title = 'Крёстный отец' WHERE id = 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := matches("godfather"); n != 0 {
+		t.Fatalf("Expected no matches for old title, got %d", n)
+	}
+	if n := matches("КРЁСТНЫЙ"); n != 1 {
+		t.Fatalf("Expected 1 match for updated title, got %d", n)
+	}
+	_, err = conn.Exec("DELETE FROM movie_detail WHERE id = 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := matches("КРЁСТНЫЙ"); n != 0 {
+		t.Fatalf("Expected no matches for deleted title, got %d", n)
+	}
+}
+
+func TestPrintStatusNoMigrate(t *testing.T) {
+	// -status не должен выполнять миграции схемы БД.
+	dbName := testMigrationDB(t)
+	var schedule scheduleConfig
+	for _, job := range []struct {
+		schedule *jobSchedule
+		cron     string
+	}{
+		{&schedule.Export, exportCronDefault},
+		{&schedule.Changes, changesCronDefault},
+		{&schedule.Titles, titlesCronDefault},
+	} {
+		if err := job.schedule.init(job.cron); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := printStatus(dbName, &schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, pending := testSchemaVersion(t, dbName); version != 0 || pending != len(migrations) {
+		t.Fatalf("Unexpected database version %d with %d pending migrations after status", version, pending)
+	}
+
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = printStatus(dbName, &schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+// Пакет ngram реализует инвертированный индекс по символьным n-граммам. Индекс
+// используется для быстрого отбора небольшого количества строк, похожих на
+// заданную, среди большого набора строк.
+package ngram
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// Index - инвертированный индекс по символьным n-граммам. Каждая
+// проиндексированная строка (документ) разбивается на n-граммы, и для каждой
+// n-граммы хранится список документов, в которых она встречается.
+// Index не предназначен для одновременного использования из нескольких
+// горутин без внешней синхронизации, но Candidates и CandidatesFunc можно
+// вызывать одновременно, если индекс в это время не изменяется.
+type Index struct {
+	n        int
+	postings map[string][]int32 // n-грамма -> порядковые номера документов.
+	ids      []int64            // Порядковый номер документа -> его идентификатор.
+	lens     []int32            // Длина документа в рунах.
+	// Буферы для подсчёта общих n-грамм (*countBuf), которые переиспользуются
+	// между запросами.
+	counts sync.Pool
+}
+
+// countBuf - буфер для подсчёта количества общих с запросом n-грамм у
+// документов. Между запросами все элементы counts равны нулю.
+type countBuf struct {
+	counts  []uint16 // Порядковый номер документа -> количество общих n-грамм.
+	touched []int32  // Документы с ненулевым количеством в counts.
+}
+
+// NewIndex создаёт пустой индекс по n-граммам длины n. Если n меньше 1, то
+// используются триграммы.
+func NewIndex(n int) *Index {
+	if n < 1 {
+		n = 3
+	}
+	return &Index{
+		n:        n,
+		postings: map[string][]int32{},
+	}
+}
+
+// Add добавляет в индекс документ text с идентификатором id. Индекс не
+// изменяет регистр символов, поэтому text и запросы к индексу должны быть
+// приведены к одному виду заранее.
+func (ix *Index) Add(id int64, text string) {
+	grams := ix.grams(text)
+	if len(grams) == 0 {
+		return
+	}
+
+	docNum := int32(len(ix.ids))
+	ix.ids = append(ix.ids, id)
+	ix.lens = append(ix.lens, int32(len([]rune(text))))
+	for _, gram := range grams {
+		ix.postings[gram] = append(ix.postings[gram], docNum)
+	}
+}
+
+// Len возвращает количество проиндексированных документов.
+func (ix *Index) Len() int {
+	return len(ix.ids)
+}
+
+// Candidates возвращает идентификаторы не более чем max документов, которые
+// имеют больше всего общих n-грамм с query. Документы с одинаковым
+// количеством общих n-грамм упорядочиваются по близости их длины к длине
+// query. Документы, у которых нет ни одной общей n-граммы с query, не
+// возвращаются. Наиболее похожие документы находятся в начале возвращаемого
+// слайса.
+func (ix *Index) Candidates(query string, max int) []int64 {
+	return ix.CandidatesFunc(query, max, nil)
+}
+
+// CandidatesFunc - это Candidates, который отбирает только документы, для
+// идентификаторов которых keep возвращает true. Документы отсеиваются до
+// отбора max лучших, поэтому подходящий документ не вытесняется
+// неподходящими. Если keep равен nil, то подходят все документы.
+func (ix *Index) CandidatesFunc(query string, max int, keep func(id int64) bool) []int64 {
+	if max <= 0 || len(ix.ids) == 0 {
+		return nil
+	}
+	grams := ix.grams(query)
+	if len(grams) == 0 {
+		return nil
+	}
+
+	// Подсчитываем для каждого документа количество общих с query n-грамм.
+	// touched содержит документы, у которых есть хотя бы одна общая n-грамма.
+	// Буфер не выделяется заново для каждого запроса, т.к. для большого
+	// индекса он занимает порядка мегабайта. После запроса в буфере
+	// обнуляются только затронутые элементы.
+	buf, _ := ix.counts.Get().(*countBuf)
+	if buf == nil || len(buf.counts) < len(ix.ids) {
+		buf = &countBuf{counts: make([]uint16, len(ix.ids))}
+	}
+	counts, touched := buf.counts, buf.touched[:0]
+	defer func() {
+		for _, docNum := range touched {
+			counts[docNum] = 0
+		}
+		buf.touched = touched[:0]
+		ix.counts.Put(buf)
+	}()
+	for _, gram := range grams {
+		for _, docNum := range ix.postings[gram] {
+			if counts[docNum] == 0 {
+				touched = append(touched, docNum)
+			}
+			counts[docNum]++
+		}
+	}
+
+	// Отбираем max лучших документов с помощью кучи, в вершине которой
+	// находится худший из уже отобранных документов.
+	queryLen := int32(len([]rune(query)))
+	h := candidateHeap{}
+	for _, docNum := range touched {
+		if keep != nil && !keep(ix.ids[docNum]) {
+			continue
+		}
+		c := candidate{
+			docNum:  docNum,
+			shared:  counts[docNum],
+			lenDiff: abs(ix.lens[docNum] - queryLen),
+		}
+		if h.Len() < max {
+			heap.Push(&h, c)
+		} else if c.better(h[0]) {
+			h[0] = c
+			heap.Fix(&h, 0)
+		}
+	}
+
+	ids := make([]int64, h.Len())
+	for i := len(ids) - 1; i >= 0; i-- {
+		ids[i] = ix.ids[heap.Pop(&h).(candidate).docNum]
+	}
+	return ids
+}
+
+// grams разбивает text на уникальные n-граммы. Перед разбиением text
+// дополняется пробелом с обеих сторон, чтобы начало и конец строки тоже
+// давали свои n-граммы, а короткие строки давали хотя бы одну n-грамму.
+func (ix *Index) grams(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	runes := []rune(" " + text + " ")
+	if len(runes) < ix.n {
+		return []string{string(runes)}
+	}
+	seen := map[string]struct{}{}
+	grams := make([]string, 0, len(runes)-ix.n+1)
+	for i := 0; i+ix.n <= len(runes); i++ {
+		gram := string(runes[i : i+ix.n])
+		if _, ok := seen[gram]; ok {
+			continue
+		}
+		seen[gram] = struct{}{}
+		grams = append(grams, gram)
+	}
+	return grams
+}
+
+// candidate - документ, отобранный в качестве кандидата при поиске.
+type candidate struct {
+	docNum  int32
+	shared  uint16 // Количество общих с запросом n-грамм.
+	lenDiff int32  // Разница длин документа и запроса.
+}
+
+// better возвращает true, если c подходит под запрос лучше, чем other.
+func (c candidate) better(other candidate) bool {
+	if c.shared != other.shared {
+		return c.shared > other.shared
+	}
+	if c.lenDiff != other.lenDiff {
+		return c.lenDiff < other.lenDiff
+	}
+	return c.docNum < other.docNum
+}
+
+// Куча из значений типа candidate, в вершине которой находится худший кандидат.
+type candidateHeap []candidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(i, j int) bool { return h[j].better(h[i]) }
+func (h candidateHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *candidateHeap) Push(x interface{}) {
+	*h = append(*h, x.(candidate))
+}
+
+func (h *candidateHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func abs(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,247 @@
+package ngram
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/source-farm/movie-promo-bot/levenshtein"
+)
+
+var testTitles = []string{
+	"the lion king",
+	"the lion king 2: simba's pride",
+	"lion",
+	"the godfather",
+	"the godfather: part ii",
+	"frozen",
+	"frozen ii",
+	"король лев",
+	"крёстный отец",
+}
+
+func TestCandidates(t *testing.T) {
+	index := NewIndex(3)
+	for i, title := range testTitles {
+		index.Add(int64(i+1), title)
+	}
+	if index.Len() != len(testTitles) {
+		t.Fatalf("Expected %d documents, got %d", len(testTitles), index.Len())
+	}
+
+	testCases := []struct {
+		query string
+		first int64
+	}{
+		{"the lion king", 1},
+		{"lion king", 1},
+		{"godfater", 4},
+		{"frozen", 6},
+		{"король", 8},
+		{"крестный отец", 9},
+	}
+	for _, tc := range testCases {
+		candidates := index.Candidates(tc.query, 3)
+		if len(candidates) == 0 {
+			t.Fatalf("No candidates for %q", tc.query)
+		}
+		if len(candidates) > 3 {
+			t.Fatalf("Expected at most 3 candidates for %q, got %d", tc.query, len(candidates))
+		}
+		if candidates[0] != tc.first {
+			t.Fatalf("Expected %d as the first candidate for %q, got %v", tc.first, tc.query, candidates)
+		}
+	}
+}
+
+func TestCandidatesFunc(t *testing.T) {
+	// Много одинаковых документов, которые не подходят под фильтр, не
+	// вытесняют подходящий документ.
+	index := NewIndex(3)
+	for i := 1; i <= 100; i++ {
+		index.Add(int64(i), "the lion king")
+	}
+	index.Add(1000, "the lion king")
+	candidates := index.CandidatesFunc("the lion king", 10, func(id int64) bool { return id == 1000 })
+	if len(candidates) != 1 || candidates[0] != 1000 {
+		t.Fatalf("Expected only filtered candidate, got %v", candidates)
+	}
+	if candidates := index.Candidates("the lion king", 10); len(candidates) != 10 || candidates[0] != 1 {
+		t.Fatalf("Unexpected candidates without filter %v", candidates)
+	}
+}
+
+func TestCandidatesEmpty(t *testing.T) {
+	index := NewIndex(3)
+	if candidates := index.Candidates("frozen", 10); candidates != nil {
+		t.Fatalf("Expected no candidates in empty index, got %v", candidates)
+	}
+
+	index.Add(1, "frozen")
+	if candidates := index.Candidates("", 10); candidates != nil {
+		t.Fatalf("Expected no candidates for empty query, got %v", candidates)
+	}
+	if candidates := index.Candidates("xyz", 10); len(candidates) != 0 {
+		t.Fatalf("Expected no candidates for unrelated query, got %v", candidates)
+	}
+}
+
+func TestCandidatesShortQuery(t *testing.T) {
+	index := NewIndex(3)
+	index.Add(1, "up")
+	index.Add(2, "it")
+
+	candidates := index.Candidates("up", 10)
+	if len(candidates) != 1 || candidates[0] != 1 {
+		t.Fatalf("Expected [1], got %v", candidates)
+	}
+
+	index.Add(3, "a")
+	candidates = index.Candidates("a", 10)
+	if len(candidates) != 1 || candidates[0] != 3 {
+		t.Fatalf("Expected [3], got %v", candidates)
+	}
+}
+
+func TestCandidatesReuse(t *testing.T) {
+	// Буфер подсчёта n-грамм, оставшийся от предыдущего запроса, не влияет на
+	// результат следующего, в т.ч. после добавления документов в индекс.
+	index := NewIndex(3)
+	for i, title := range testTitles {
+		index.Add(int64(i+1), title)
+	}
+	first := index.Candidates("the lion king", 3)
+	if again := index.Candidates("the lion king", 3); !equalIDs(first, again) {
+		t.Fatalf("Expected %v on repeated query, got %v", first, again)
+	}
+	index.Add(100, "the lion king")
+	if candidates := index.Candidates("the lion king", 2); !equalIDs(candidates, []int64{1, 100}) {
+		t.Fatalf("Expected [1 100] after adding document, got %v", candidates)
+	}
+
+	// Одновременные запросы не мешают друг другу.
+	queries := []string{"the lion king", "godfater", "frozen", "крестный отец"}
+	expected := make([][]int64, len(queries))
+	for i, query := range queries {
+		expected[i] = index.Candidates(query, 5)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, len(queries))
+	for i := range queries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if candidates := index.Candidates(queries[i], 5); !equalIDs(candidates, expected[i]) {
+					errs <- queries[i]
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for query := range errs {
+		t.Fatalf("Unexpected candidates for %q in concurrent queries", query)
+	}
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//--------------------------------------------------------------------------------
+// Сравнение скорости поиска по индексу с полным перебором на каталоге из
+// 500 тыс. названий.
+//--------------------------------------------------------------------------------
+
+const (
+	benchCatalogSize  = 500000
+	benchMaxCandidate = 300
+)
+
+var (
+	benchOnce    sync.Once
+	benchCatalog []string
+	benchIndex   *Index
+	benchQueries = []string{
+		"the lion king",
+		"godfather part",
+		"star wars",
+		"интерстеллар",
+	}
+)
+
+// benchSetup формирует каталог случайных названий и индекс по нему.
+func benchSetup() {
+	benchOnce.Do(func() {
+		words := []string{
+			"the", "lion", "king", "star", "wars", "godfather", "part", "return",
+			"night", "day", "dark", "knight", "love", "story", "city", "man",
+			"woman", "last", "first", "war", "house", "blood", "dead", "life",
+			"интерстеллар", "король", "лев", "ночь", "день", "любовь", "война",
+		}
+		rnd := rand.New(rand.NewSource(1))
+		benchCatalog = make([]string, benchCatalogSize)
+		benchIndex = NewIndex(3)
+		for i := range benchCatalog {
+			wordsNum := 1 + rnd.Intn(4)
+			titleWords := make([]string, wordsNum)
+			for j := range titleWords {
+				titleWords[j] = words[rnd.Intn(len(words))]
+			}
+			benchCatalog[i] = strings.Join(titleWords, " ")
+			benchIndex.Add(int64(i), benchCatalog[i])
+		}
+	})
+}
+
+func BenchmarkFullScan500k(b *testing.B) {
+	benchSetup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query := benchQueries[i%len(benchQueries)]
+		for _, title := range benchCatalog {
+			levenshtein.Distance(query, title, 1, 7, 100)
+		}
+	}
+}
+
+func BenchmarkCandidates500k(b *testing.B) {
+	benchSetup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchIndex.Candidates(benchQueries[i%len(benchQueries)], benchMaxCandidate)
+	}
+}
+
+func BenchmarkCandidatesParallel500k(b *testing.B) {
+	benchSetup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			benchIndex.Candidates(benchQueries[i%len(benchQueries)], benchMaxCandidate)
+		}
+	})
+}
+
+func BenchmarkIndexedSearch500k(b *testing.B) {
+	benchSetup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query := benchQueries[i%len(benchQueries)]
+		for _, id := range benchIndex.Candidates(query, benchMaxCandidate) {
+			levenshtein.Distance(query, benchCatalog[id], 1, 7, 100)
+		}
+	}
+}
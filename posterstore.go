@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/journal"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+)
+
+const (
+	// Постер в поле poster таблицы movie_detail.
+	blobPosterQuery = `
+SELECT poster
+  FROM movie_detail
+ WHERE id = ?1;
+`
+
+	blobPosterUpdateQuery = `
+UPDATE movie_detail
+   SET poster = ?2
+ WHERE id = ?1;
+`
+
+	// sha256 постера, который хранится в папке с постерами.
+	filePosterQuery = `
+SELECT sha256
+  FROM poster_file
+ WHERE fk_movie_detail_id = ?1;
+`
+
+	filePosterUpsertQuery = `
+INSERT INTO poster_file (fk_movie_detail_id, sha256)
+     VALUES (?1, ?2)
+ON CONFLICT (fk_movie_detail_id) DO UPDATE SET (sha256, updated_on) = (?2, datetime('now'));
+`
+
+	// Строки movie_detail, постеры которых ещё хранятся в поле poster.
+	blobPosterIDsQuery = `
+  SELECT id
+    FROM movie_detail
+   WHERE poster IS NOT NULL
+ORDER BY id;
+`
+
+	// Количество постеров, которые хранятся в файле с переданным sha256.
+	filePosterRefCountQuery = `
+SELECT count(*)
+  FROM poster_file
+ WHERE sha256 = ?1;
+`
+
+	// sha256 всех постеров, которые хранятся в папке с постерами.
+	filePosterHashesQuery = `
+SELECT DISTINCT sha256
+  FROM poster_file;
+`
+
+	// Количество постеров, переносимых из БД в папку за одну транзакцию.
+	posterMigrateBatchSize = 100
+
+	// Файлы постеров моложе этого возраста не удаляются при очистке папки с
+	// постерами, т.к. они могут принадлежать ещё не подтверждённой
+	// транзакции работающего бота.
+	posterSweepMinAge = time.Hour
+)
+
+// posterStore - хранилище картинок постеров из таблицы movie_detail.
+// Запросы к БД выполняются через переданное в методы соединение conn,
+// поэтому одно хранилище можно использовать из нескольких горутин, если у
+// каждой своё соединение.
+type posterStore interface {
+	// put сохраняет постер строки id таблицы movie_detail. Если put
+	// вызывается внутри транзакции, то постер становится доступен только
+	// после её подтверждения.
+	put(ctx context.Context, conn *sqlite.Conn, id int64, image []byte) error
+	// get возвращает постер строки id таблицы movie_detail.
+	get(ctx context.Context, conn *sqlite.Conn, id int64) ([]byte, error)
+	// ref возвращает ссылку на картинку постера строки id, которую после
+	// замены постера нужно передать в release. Пустая строка означает, что
+	// отдельно удалять картинку не нужно.
+	ref(ctx context.Context, conn *sqlite.Conn, id int64) (string, error)
+	// release удаляет картинки refs, на которые больше не ссылается ни один
+	// постер. Вызывается вне транзакции.
+	release(ctx context.Context, conn *sqlite.Conn, refs []string) error
+}
+
+// newPosterStore возвращает хранилище постеров. Если dir пустая строка, то
+// постеры хранятся в самой БД (в поле poster таблицы movie_detail), иначе -
+// в папке dir.
+func newPosterStore(dir string) (posterStore, error) {
+	if dir == "" {
+		return blobPosterStore{}, nil
+	}
+	return newFilePosterStore(dir)
+}
+
+// blobPosterStore хранит постеры в поле poster таблицы movie_detail.
+type blobPosterStore struct{}
+
+func (blobPosterStore) put(ctx context.Context, conn *sqlite.Conn, id int64, image []byte) error {
+	stmt, err := conn.PrepareCached(blobPosterUpdateQuery)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, id, image)
+	return err
+}
+
+func (blobPosterStore) get(ctx context.Context, conn *sqlite.Conn, id int64) ([]byte, error) {
+	stmt, err := conn.PrepareCached(blobPosterQuery)
+	if err != nil {
+		return nil, err
+	}
+	var image []byte
+	err = stmt.QueryRowContext(ctx, id).Scan(&image)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// Картинка постера заменяется вместе со строкой movie_detail, поэтому
+// отдельно её удалять не нужно.
+func (blobPosterStore) ref(ctx context.Context, conn *sqlite.Conn, id int64) (string, error) {
+	return "", nil
+}
+
+func (blobPosterStore) release(ctx context.Context, conn *sqlite.Conn, refs []string) error {
+	return nil
+}
+
+// filePosterStore хранит постеры в файлах внутри папки dir. Имя файла - это
+// sha256 содержимого постера, поэтому одинаковые постеры хранятся в одном
+// файле. Чтобы в одной папке не было слишком много файлов, постеры
+// раскладываются по подпапкам, названным первыми двумя символами sha256. В
+// БД (в таблице poster_file) хранится только sha256 постера.
+type filePosterStore struct {
+	dir string
+}
+
+func newFilePosterStore(dir string) (*filePosterStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &filePosterStore{dir: dir}, nil
+}
+
+// path возвращает путь к файлу постера с хэшем hash.
+func (s *filePosterStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *filePosterStore) put(ctx context.Context, conn *sqlite.Conn, id int64, image []byte) error {
+	sum := sha256.Sum256(image)
+	hash := hex.EncodeToString(sum[:])
+	path := s.path(hash)
+
+	// Файл с таким содержимым уже может быть, например, от постера другого
+	// фильма или от прерванной транзакции.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		// Постер сначала пишется во временный файл, который затем
+		// переименовывается, чтобы в хранилище не было недописанных файлов.
+		f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(image)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		// Обновляем время изменения уже существующего файла, чтобы
+		// sweepPosterFiles не удалил его до подтверждения транзакции.
+		now := time.Now()
+		err = os.Chtimes(path, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt, err := conn.PrepareCached(filePosterUpsertQuery)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, id, hash)
+	return err
+}
+
+func (s *filePosterStore) get(ctx context.Context, conn *sqlite.Conn, id int64) ([]byte, error) {
+	stmt, err := conn.PrepareCached(filePosterQuery)
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	err = stmt.QueryRowContext(ctx, id).Scan(&hash)
+	if err == sqlite.ErrNoRows {
+		// Постер ещё не перенесён из БД в папку (см. migratePosters).
+		return blobPosterStore{}.get(ctx, conn, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != sha256.Size*2 {
+		return nil, errors.New("incorrect poster sha256 \"" + hash + "\"")
+	}
+	return ioutil.ReadFile(s.path(hash))
+}
+
+// ref возвращает sha256 постера строки id.
+func (s *filePosterStore) ref(ctx context.Context, conn *sqlite.Conn, id int64) (string, error) {
+	stmt, err := conn.PrepareCached(filePosterQuery)
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	err = stmt.QueryRowContext(ctx, id).Scan(&hash)
+	if err == sqlite.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// release удаляет файлы постеров с хэшами refs, если на них не ссылается ни
+// одна строка poster_file. Проверка и удаление выполняются в транзакции с
+// блокировкой на запись, поэтому put другого соединения не может в это
+// время сослаться на удаляемый файл.
+func (s *filePosterStore) release(ctx context.Context, conn *sqlite.Conn, refs []string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	return conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+		stmt, err := conn.PrepareCached(filePosterRefCountQuery)
+		if err != nil {
+			return err
+		}
+		for _, hash := range refs {
+			if len(hash) != sha256.Size*2 {
+				continue
+			}
+			var count int64
+			err = stmt.QueryRowContext(ctx, hash).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			err = os.Remove(s.path(hash))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migratePosters переносит постеры из поля poster таблицы movie_detail в
+// папку dir. Перенесённые постеры удаляются из БД, файлы, на которые не
+// ссылается ни одна строка poster_file, удаляются из папки, после чего БД
+// сжимается командой VACUUM. Перенос можно прервать и запустить заново -
+// он продолжится с постеров, которые остались в БД.
+func migratePosters(dbName, dir string) error {
+	if dir == "" {
+		return errors.New("poster directory is not set")
+	}
+	journal.Info("migrating posters from database " + dbName + " to directory " + dir)
+
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetBusyTimeout(dbBusyTimeoutMS)
+	if err != nil {
+		return err
+	}
+
+	fileStore, err := newFilePosterStore(dir)
+	if err != nil {
+		return err
+	}
+
+	// Сначала получаем все строки с постерами, чтобы не изменять таблицу
+	// movie_detail во время её чтения.
+	idsStmt, err := conn.Prepare(blobPosterIDsQuery)
+	if err != nil {
+		return err
+	}
+	defer idsStmt.Close()
+	rows, err := idsStmt.Query()
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	journal.Info(len(ids), " posters to migrate")
+
+	for start := 0; start < len(ids); start += posterMigrateBatchSize {
+		end := start + posterMigrateBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err = migratePosterBatch(conn, fileStore, ids[start:end])
+		if err != nil {
+			return err
+		}
+		journal.Info(end, "/", len(ids), " posters migrated")
+	}
+
+	removed, err := sweepPosterFiles(conn, fileStore)
+	if err != nil {
+		return err
+	}
+	journal.Info(removed, " unreferenced poster files removed")
+
+	journal.Info("vacuuming database " + dbName)
+	_, err = conn.Exec("VACUUM;")
+	if err != nil {
+		return err
+	}
+	journal.Info("posters migration OK")
+	return nil
+}
+
+// migratePosterBatch переносит постеры строк ids таблицы movie_detail из БД
+// в fileStore одной транзакцией. Перенесённые постеры удаляются из БД (в поле
+// poster записывается NULL).
+func migratePosterBatch(conn *sqlite.Conn, fileStore *filePosterStore, ids []int64) error {
+	var blobStore blobPosterStore
+	ctx := context.Background()
+	return conn.WithTx(ctx, sqlite.Immediate, func(tx *sqlite.Tx) error {
+		for _, id := range ids {
+			image, err := blobStore.get(ctx, conn, id)
+			if err != nil {
+				return err
+			}
+			err = fileStore.put(ctx, conn, id, image)
+			if err != nil {
+				return err
+			}
+			err = blobStore.put(ctx, conn, id, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sweepPosterFiles удаляет из хранилища store файлы постеров, на которые не
+// ссылается ни одна строка таблицы poster_file, например, файлы заменённых
+// постеров. Возвращает количество удалённых файлов.
+func sweepPosterFiles(conn *sqlite.Conn, store *filePosterStore) (int, error) {
+	stmt, err := conn.PrepareCached(filePosterHashesQuery)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]struct{}{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		referenced[hash] = struct{}{}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	minModTime := time.Now().Add(-posterSweepMinAge)
+	err = filepath.Walk(store.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Временные файлы прерванных put тоже удаляются.
+		name := info.Name()
+		if info.IsDir() || info.ModTime().After(minModTime) ||
+			(len(name) != sha256.Size*2 && !strings.HasPrefix(name, ".tmp-")) {
+			return nil
+		}
+		if _, ok := referenced[name]; ok {
+			return nil
+		}
+		err = os.Remove(path)
+		if err == nil {
+			removed++
+		}
+		return err
+	})
+	return removed, err
+}
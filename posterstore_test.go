@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/themoviedb"
+	"github.com/source-farm/movie-promo-bot/themoviedb/themoviedbtest"
+)
+
+// testPosterDB создаёт пустую тестовую БД и возвращает её имя и папку для
+// постеров рядом с ней.
+func testPosterDB(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "movie-promo-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dbName := filepath.Join(dir, "test.db")
+	err = initDB(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbName, filepath.Join(dir, "posters")
+}
+
+// testBlobPosterCount возвращает количество постеров, которые хранятся в
+// самой БД.
+func testBlobPosterCount(t *testing.T, dbName string) int64 {
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("SELECT count(*) FROM movie_detail WHERE poster IS NOT NULL;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var count int64
+	err = stmt.QueryRow().Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestFilePosterStore(t *testing.T) {
+	dbName, posterDir := testPosterDB(t)
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult)
+     VALUES (1, 1, 'Frozen', 'en', '2013-11-20', 0);
+INSERT INTO movie_detail (id, fk_movie_id, lang, title)
+     VALUES (1, 1, 'en', 'Frozen'), (2, 1, 'ru', 'Холодное сердце');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newPosterStore(posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Постер хранится в файле, названном по его sha256.
+	image := []byte("poster")
+	err = store.put(context.Background(), conn, 1, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image)
+	hash := hex.EncodeToString(sum[:])
+	content, err := ioutil.ReadFile(filepath.Join(posterDir, hash[:2], hash))
+	if err != nil || !bytes.Equal(content, image) {
+		t.Fatalf("Unexpected poster file content %q (%v)", content, err)
+	}
+	poster, err := store.get(context.Background(), conn, 1)
+	if err != nil || !bytes.Equal(poster, image) {
+		t.Fatalf("Unexpected poster %q (%v)", poster, err)
+	}
+
+	// Одинаковые постеры хранятся в одном файле.
+	err = store.put(context.Background(), conn, 2, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(posterDir, hash[:2]))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 poster file, got %d (%v)", len(files), err)
+	}
+
+	// Постер можно заменить.
+	err = store.put(context.Background(), conn, 2, []byte("new poster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster, err = store.get(context.Background(), conn, 2)
+	if err != nil || string(poster) != "new poster" {
+		t.Fatalf("Unexpected poster %q (%v)", poster, err)
+	}
+
+	_, err = store.get(context.Background(), conn, 3)
+	if err != sqlite.ErrNoRows {
+		t.Fatalf("Expected ErrNoRows for unknown poster, got %v", err)
+	}
+	if count := testBlobPosterCount(t, dbName); count != 0 {
+		t.Fatalf("Expected no posters in database, got %d", count)
+	}
+}
+
+func TestFilePosterStoreBlobFallback(t *testing.T) {
+	dbName, posterDir := testPosterDB(t)
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult)
+     VALUES (1, 1, 'Frozen', 'en', '2013-11-20', 0);
+INSERT INTO movie_detail (id, fk_movie_id, lang, title, poster)
+     VALUES (1, 1, 'en', 'Frozen', x'626c6f62');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Папка с постерами указана, но постеры ещё не перенесены из БД.
+	store, err := newPosterStore(posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster, err := store.get(context.Background(), conn, 1)
+	if err != nil || string(poster) != "blob" {
+		t.Fatalf("Unexpected poster %q (%v)", poster, err)
+	}
+
+	// После сохранения в папку постер берётся из файла.
+	err = store.put(context.Background(), conn, 1, []byte("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster, err = store.get(context.Background(), conn, 1)
+	if err != nil || string(poster) != "file" {
+		t.Fatalf("Unexpected poster %q (%v)", poster, err)
+	}
+}
+
+func TestSweepPosterFiles(t *testing.T) {
+	dbName, posterDir := testPosterDB(t)
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult)
+     VALUES (1, 1, 'Frozen', 'en', '2013-11-20', 0);
+INSERT INTO movie_detail (id, fk_movie_id, lang, title)
+     VALUES (1, 1, 'en', 'Frozen');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFilePosterStore(posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Старый постер заменён новым, а ещё один файл записан только что и
+	// может принадлежать неподтверждённой транзакции.
+	hashes := map[string]string{}
+	for _, image := range []string{"old", "new", "fresh"} {
+		sum := sha256.Sum256([]byte(image))
+		hashes[image] = hex.EncodeToString(sum[:])
+		err = store.put(context.Background(), conn, 1, []byte(image))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = conn.Exec("UPDATE poster_file SET sha256 = '" + hashes["new"] + "';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-posterSweepMinAge * 2)
+	for _, image := range []string{"old", "new"} {
+		err = os.Chtimes(store.path(hashes[image]), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := sweepPosterFiles(conn, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("Expected 1 removed poster file, got %d", removed)
+	}
+	for image, exists := range map[string]bool{"old": false, "new": true, "fresh": true} {
+		_, err = os.Stat(store.path(hashes[image]))
+		if (err == nil) != exists {
+			t.Fatalf("Unexpected %q poster file state (%v)", image, err)
+		}
+	}
+}
+
+func TestHarvestPosterDir(t *testing.T) {
+	server, dbName := setupTestHarvester(t)
+	posterDir := filepath.Join(filepath.Dir(dbName), "posters")
+
+	runHarvest(t, server.Client(), dbName, posterDir, themoviedb.DefaultLangs)
+
+	if count := testBlobPosterCount(t, dbName); count != 0 {
+		t.Fatalf("Expected no posters in database, got %d", count)
+	}
+	posters := testPosters(t, dbName, posterDir)
+	if len(posters[550]) != 2 || !bytes.Equal(posters[550][iso6391.Ru], themoviedbtest.PosterImage(1)) {
+		t.Fatalf("Unexpected Fight Club posters: %v", posters[550])
+	}
+}
+
+func TestMigratePosters(t *testing.T) {
+	dbName, posterDir := testPosterDB(t)
+	conn, err := sqlite.NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+INSERT INTO movie (id, tmdb_id, original_title, original_lang, released_on, adult)
+     VALUES (1, 1, 'Frozen', 'en', '2013-11-20', 0);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detailStmt, err := conn.Prepare(`
+INSERT INTO movie_detail (id, fk_movie_id, lang, title, poster)
+     VALUES (?1, 1, ?2, 'Frozen', ?3);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detailStmt.Close()
+	// Постеров больше, чем переносится за одну транзакцию.
+	langs := []string{}
+	for i := 0; i < posterMigrateBatchSize+1; i++ {
+		lang := "l" + strconv.Itoa(i)
+		langs = append(langs, lang)
+		_, err = detailStmt.Exec(int64(i+1), lang, testPoster(int64(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = migratePosters(dbName, "")
+	if err == nil {
+		t.Fatal("Expected error for empty poster directory, got nil")
+	}
+	err = migratePosters(dbName, posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := testBlobPosterCount(t, dbName); count != 0 {
+		t.Fatalf("Expected no posters in database after migration, got %d", count)
+	}
+	posters := testPosters(t, dbName, posterDir)
+	if len(posters[1]) != len(langs) {
+		t.Fatalf("Expected %d posters, got %d", len(langs), len(posters[1]))
+	}
+	for i, lang := range langs {
+		if !bytes.Equal(posters[1][lang], testPoster(int64(i+1))) {
+			t.Fatalf("Unexpected poster %d after migration", i+1)
+		}
+	}
+
+	// Повторный перенос ничего не делает.
+	err = migratePosters(dbName, posterDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Год выхода первого фильма. Более ранние года в запросах пользователей
+	// не считаются годами выхода фильмов.
+	minReleaseYear = 1870
+	// На сколько лет вперёд от текущего года в запросах пользователей могут
+	// быть указаны года выхода фильмов.
+	maxReleaseYearAhead = 5
+)
+
+// Год или диапазон годов в конце запроса пользователя: "1994", "(2019)",
+// "1984-2021", "(1984 - 2021)". Вместо дефиса может использоваться короткое
+// или длинное тире.
+var yearSuffixRegexp = regexp.MustCompile(`^(.*?)(?:[\s,]+|[\s,]*\()\s*(\d{4})(?:\s*[-–—]\s*(\d{4}))?\s*\)?$`)
+
+// titleQuery - разобранный запрос пользователя на поиск фильма.
+type titleQuery struct {
+	raw      string // Запрос в исходном виде.
+	title    string // Название фильма без года.
+	yearFrom int    // Начало диапазона годов выхода фильма. Если 0, то год не указан.
+	yearTo   int    // Конец диапазона годов выхода фильма (включительно).
+}
+
+// hasYear возвращает true, если в запросе указан год или диапазон годов.
+func (q titleQuery) hasYear() bool {
+	return q.yearFrom != 0
+}
+
+// yearMatches возвращает true, если фильм, вышедший в год year, подходит
+// под указанный в запросе диапазон годов.
+func (q titleQuery) yearMatches(year int) bool {
+	return !q.hasYear() || (year >= q.yearFrom && year <= q.yearTo)
+}
+
+// withoutYear возвращает запрос, в котором весь исходный текст считается
+// названием фильма. Используется, когда число в конце запроса оказалось
+// частью названия, например, "Blade Runner 2049" или "1917".
+func (q titleQuery) withoutYear() titleQuery {
+	return titleQuery{raw: q.raw, title: q.raw}
+}
+
+// parseTitleQuery разбирает запрос пользователя. Если в конце запроса указан
+// год ("Lion King 1994", "Lion King (2019)") или диапазон годов ("Dune
+// 1984-2021"), то он отделяется от названия фильма. Если после отделения
+// года от названия ничего не остаётся или год не похож на год выхода фильма,
+// то весь запрос считается названием.
+func parseTitleQuery(text string) titleQuery {
+	text = strings.TrimSpace(text)
+	query := titleQuery{raw: text, title: text}
+
+	match := yearSuffixRegexp.FindStringSubmatch(text)
+	if match == nil {
+		return query
+	}
+	title := strings.TrimSpace(match[1])
+	if title == "" {
+		return query
+	}
+	// Открывающая скобка без закрывающей и наоборот.
+	suffix := text[len(match[1]):]
+	if strings.Contains(suffix, "(") != strings.HasSuffix(suffix, ")") {
+		return query
+	}
+
+	yearFrom, _ := strconv.Atoi(match[2])
+	yearTo := yearFrom
+	if match[3] != "" {
+		yearTo, _ = strconv.Atoi(match[3])
+	}
+	if yearFrom > yearTo {
+		yearFrom, yearTo = yearTo, yearFrom
+	}
+	maxYear := time.Now().Year() + maxReleaseYearAhead
+	if yearFrom < minReleaseYear || yearTo > maxYear {
+		return query
+	}
+
+	query.title = title
+	query.yearFrom = yearFrom
+	query.yearTo = yearTo
+	return query
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTitleQuery(t *testing.T) {
+	testCases := []struct {
+		text     string
+		title    string
+		yearFrom int
+		yearTo   int
+	}{
+		{"Lion King 1994", "Lion King", 1994, 1994},
+		{"Lion King (2019)", "Lion King", 2019, 2019},
+		{"Lion King, 1994", "Lion King", 1994, 1994},
+		{"  Lion King 1994  ", "Lion King", 1994, 1994},
+		{"Dune 1984-2021", "Dune", 1984, 2021},
+		{"Dune (1984 – 2021)", "Dune", 1984, 2021},
+		// Диапазон в обратном порядке.
+		{"Dune 2021-1984", "Dune", 1984, 2021},
+		// Года вне допустимого диапазона - часть названия.
+		{"Metropolis 1800", "Metropolis 1800", 0, 0},
+		{"Blade Runner 2049", "Blade Runner 2049", 0, 0},
+		{"Dune 1984-2100", "Dune 1984-2100", 0, 0},
+		// Названия из чисел.
+		{"1917", "1917", 0, 0},
+		{"(1917)", "(1917)", 0, 0},
+		{"2001 a space odyssey", "2001 a space odyssey", 0, 0},
+		{"2001 a space odyssey 1968", "2001 a space odyssey", 1968, 1968},
+		// Непарные скобки и число без разделителя.
+		{"Lion King (1994", "Lion King (1994", 0, 0},
+		{"Lion King 1994)", "Lion King 1994)", 0, 0},
+		{"Lion King1994", "Lion King1994", 0, 0},
+		{"frozen", "frozen", 0, 0},
+	}
+	for _, tc := range testCases {
+		query := parseTitleQuery(tc.text)
+		if query.title != tc.title || query.yearFrom != tc.yearFrom || query.yearTo != tc.yearTo {
+			t.Fatalf("Unexpected query %+v for %q", query, tc.text)
+		}
+		if query.hasYear() != (tc.yearFrom != 0) {
+			t.Fatalf("Unexpected hasYear for %q", tc.text)
+		}
+		if without := query.withoutYear(); without.hasYear() || without.raw != query.raw || without.title != query.raw {
+			t.Fatalf("Unexpected query without year %+v for %q", without, tc.text)
+		}
+	}
+
+	query := parseTitleQuery("Dune 1984-2021")
+	for year, matches := range map[int]bool{1983: false, 1984: true, 2000: true, 2021: true, 2022: false} {
+		if query.yearMatches(year) != matches {
+			t.Fatalf("Unexpected yearMatches(%d) for %+v", year, query)
+		}
+	}
+	if !parseTitleQuery("Dune").yearMatches(1) {
+		t.Fatal("Expected any year to match query without year")
+	}
+}
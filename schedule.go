@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/cron"
+)
+
+const (
+	// The MovieDB публикует файл ежедневного экспорта около 8:00 по UTC,
+	// поэтому обработка начинается через час после этого.
+	exportCronDefault = "0 9 * * *"
+	// Изменившиеся фильмы обрабатываются сразу после файла экспорта.
+	changesCronDefault = "0 9 * * *"
+	// Загружаются только новые названия, поэтому загрузка быстрая и её можно
+	// выполнять часто. Так скачанные фильмы раньше становятся доступны в боте.
+	titlesCronDefault = "0 */3 * * *"
+)
+
+// jobSchedule - расписание периодической задачи.
+type jobSchedule struct {
+	// Расписание в формате cron (см. пакет cron), например "0 9 * * *".
+	Cron string `json:"cron"`
+	// Часовой пояс расписания из базы IANA, например "Europe/Moscow". Если
+	// не указан, то используется UTC.
+	Timezone string `json:"timezone"`
+	// Выполнять ли задачу сразу после запуска бота, не дожидаясь расписания.
+	// Если не указано, то задача выполняется.
+	OnStartup *bool `json:"on_startup"`
+
+	schedule *cron.Schedule
+	loc      *time.Location
+}
+
+// init заполняет незаданные поля расписания значениями по-умолчанию
+// (defaultCron для Cron) и разбирает его.
+func (j *jobSchedule) init(defaultCron string) error {
+	if j.Cron == "" {
+		j.Cron = defaultCron
+	}
+	schedule, err := cron.Parse(j.Cron)
+	if err != nil {
+		return err
+	}
+	loc := time.UTC
+	if j.Timezone != "" {
+		loc, err = time.LoadLocation(j.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+	if schedule.Next(time.Now().In(loc)).IsZero() {
+		return errors.New("schedule \"" + j.Cron + "\" never runs")
+	}
+	j.schedule = schedule
+	j.loc = loc
+	return nil
+}
+
+// runOnStartup возвращает true, если задачу нужно выполнить сразу после
+// запуска бота.
+func (j *jobSchedule) runOnStartup() bool {
+	return j.OnStartup == nil || *j.OnStartup
+}
+
+// next возвращает время следующего запуска задачи после t.
+func (j *jobSchedule) next(t time.Time) time.Time {
+	return j.schedule.Next(t.In(j.loc))
+}
+
+// first возвращает время первого запуска задачи, если бот запущен в момент
+// now.
+func (j *jobSchedule) first(now time.Time) time.Time {
+	if j.runOnStartup() {
+		return now
+	}
+	return j.next(now)
+}
+
+// String возвращает расписание вместе с часовым поясом, например
+// "0 9 * * * (Europe/Moscow)".
+func (j *jobSchedule) String() string {
+	return j.Cron + " (" + j.loc.String() + ")"
+}
+
+// waitUntil ждёт наступления времени t. Возвращает false, если ожидание
+// прервано отменой ctx.
+func waitUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJobSchedule(t *testing.T) {
+	var job jobSchedule
+	err := job.init(exportCronDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	if first := job.first(now); !first.Equal(now) {
+		t.Fatalf("Expected first run on startup, got %v", first)
+	}
+	if next := job.next(now); !next.Equal(time.Date(2020, 5, 2, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected next run %v", next)
+	}
+
+	// Расписание в другом часовом поясе без запуска при старте.
+	onStartup := false
+	job = jobSchedule{Cron: "30 8 * * *", Timezone: "Europe/Moscow", OnStartup: &onStartup}
+	err = job.init(exportCronDefault)
+	if err != nil {
+		t.Skip(err)
+	}
+	if first := job.first(now); !first.Equal(time.Date(2020, 5, 2, 5, 30, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected first run %v", first)
+	}
+	if s := job.String(); s != "30 8 * * * (Europe/Moscow)" {
+		t.Fatalf("Unexpected schedule string %q", s)
+	}
+
+	for _, job := range []jobSchedule{
+		{Cron: "0 9 * *"},
+		{Cron: "0 0 30 2 *"},
+		{Timezone: "Mars/Olympus"},
+	} {
+		if err := job.init(exportCronDefault); err == nil {
+			t.Fatalf("Expected error for schedule %+v", job)
+		}
+	}
+}
+
+func TestWaitUntil(t *testing.T) {
+	if !waitUntil(context.Background(), time.Now().Add(-time.Second)) {
+		t.Fatal("Expected no wait for past time")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if waitUntil(ctx, time.Now().Add(time.Hour)) {
+		t.Fatal("Expected wait to be cancelled")
+	}
+}
@@ -0,0 +1,167 @@
+package sqlite
+
+/*
+#include <stdlib.h>
+#include "sqlite3.h"
+*/
+import "C"
+import (
+	"context"
+	"time"
+	"unsafe"
+)
+
+// Backup - резервное копирование БД через SQLite Online Backup API
+// (https://www.sqlite.org/backup.html). БД копируется по частям (страницам)
+// вызовами Step, а между вызовами с исходной БД можно работать как обычно.
+// Если исходная БД изменяется через другое соединение, то копирование
+// начинается заново при следующем вызове Step. После окончания копирования
+// должен быть вызван метод Finish.
+type Backup struct {
+	backup *C.sqlite3_backup
+	dest   *Conn
+}
+
+// Backup начинает копирование БД соединения c в БД соединения dest.
+// Содержимое БД dest при этом полностью заменяется. Пока копирование не
+// завершено, соединение dest нельзя использовать.
+func (c *Conn) Backup(dest *Conn) (*Backup, error) {
+	if c.db == nil || dest.db == nil {
+		return nil, ErrConnDone
+	}
+
+	mainCStr := C.CString("main")
+	defer C.free(unsafe.Pointer(mainCStr))
+	backup := C.sqlite3_backup_init(dest.db, mainCStr, c.db, mainCStr)
+	if backup == nil {
+		// Код ошибки sqlite3_backup_init сохраняется в соединении dest.
+		return nil, resultCode2GoError(C.sqlite3_errcode(dest.db))
+	}
+
+	return &Backup{backup: backup, dest: dest}, nil
+}
+
+// Step копирует следующие pages страниц БД. Если pages меньше 0, то
+// копируются все оставшиеся страницы. Если скопированы все страницы, то
+// возвращается true. Ошибки ErrBusy и ErrLocked означают, что исходная БД
+// сейчас занята и вызов Step можно повторить позже.
+func (b *Backup) Step(pages int) (bool, error) {
+	if b.backup == nil {
+		return false, ErrMisuse
+	}
+
+	resCode := C.sqlite3_backup_step(b.backup, C.int(pages))
+	err := resultCode2GoError(resCode)
+	switch err {
+	case SQLiteOK:
+		return false, nil
+
+	case SQLiteDone:
+		return true, nil
+	}
+	return false, err
+}
+
+// Remaining возвращает количество страниц, которые ещё не скопированы на
+// момент последнего вызова Step.
+func (b *Backup) Remaining() int {
+	if b.backup == nil {
+		return 0
+	}
+	return int(C.sqlite3_backup_remaining(b.backup))
+}
+
+// PageCount возвращает количество страниц в исходной БД на момент последнего
+// вызова Step.
+func (b *Backup) PageCount() int {
+	if b.backup == nil {
+		return 0
+	}
+	return int(C.sqlite3_backup_pagecount(b.backup))
+}
+
+// Finish завершает копирование и освобождает выделенные под него ресурсы.
+// Если копирование завершилось ошибкой, то она возвращается и здесь.
+func (b *Backup) Finish() error {
+	if b.backup == nil {
+		return nil
+	}
+
+	resCode := C.sqlite3_backup_finish(b.backup)
+	b.backup = nil
+	return resultCode2GoError(resCode)
+}
+
+// BackupProgress вызывается после каждого шага копирования БД. remaining -
+// количество ещё не скопированных страниц, pageCount - количество страниц в
+// исходной БД.
+type BackupProgress func(remaining, pageCount int)
+
+// BackupToFile копирует БД соединения c в файл filename. Если файл уже
+// есть, то его содержимое заменяется. Копируется по pagesPerStep страниц за
+// шаг, а между шагами делается пауза pause, чтобы исходная БД не была
+// заблокирована надолго и другие соединения могли с ней работать. Если
+// исходная БД занята, то шаг повторяется после паузы. После каждого шага
+// вызывается progress, если он не равен nil. Копирование прерывается при
+// отмене ctx.
+// Запись в исходную БД через другое соединение заставляет копирование начаться
+// заново, поэтому при частой записи оно может никогда не закончиться. Если
+// копирование начиналось заново больше maxRestarts раз, то все оставшиеся
+// страницы копируются одним шагом, на время которого запись в исходную БД
+// блокируется. Если maxRestarts меньше 0, то количество повторов не
+// ограничено.
+func (c *Conn) BackupToFile(ctx context.Context, filename string, pagesPerStep int, pause time.Duration, maxRestarts int, progress BackupProgress) error {
+	dest, err := NewConn(filename)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	backup, err := c.Backup(dest)
+	if err != nil {
+		return err
+	}
+	restarts := 0
+	lastRemaining := -1
+	for {
+		pages := pagesPerStep
+		if maxRestarts >= 0 && restarts > maxRestarts {
+			pages = -1
+		}
+		done, err := backup.Step(pages)
+		if err != nil && err != ErrBusy && err != ErrLocked {
+			backup.Finish()
+			return err
+		}
+		remaining := backup.Remaining()
+		if progress != nil {
+			progress(remaining, backup.PageCount())
+		}
+		if done {
+			break
+		}
+		// Количество оставшихся страниц растёт, только если копирование
+		// началось заново.
+		if err == nil {
+			if lastRemaining >= 0 && remaining > lastRemaining {
+				restarts++
+			}
+			lastRemaining = remaining
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			backup.Finish()
+			return ctx.Err()
+		}
+	}
+
+	err = backup.Finish()
+	if err != nil {
+		return err
+	}
+	return dest.Close()
+}
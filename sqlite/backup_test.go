@@ -0,0 +1,164 @@
+package sqlite
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	defer cleanup()
+	backupName := "test-backup.db"
+	defer os.Remove(backupName)
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER, t TEXT);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := conn.Prepare("INSERT INTO test(n, t) VALUES(?, ?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	// Данных должно хватить на несколько страниц БД.
+	N := 500
+	for i := 0; i < N; i++ {
+		_, err = stmt.Exec(i, strings.Repeat("x", 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := 0
+	lastRemaining := -1
+	err = conn.BackupToFile(context.Background(), backupName, 5, time.Millisecond, -1, func(remaining, pageCount int) {
+		steps++
+		lastRemaining = remaining
+		if pageCount <= 0 || remaining > pageCount {
+			t.Errorf("Unexpected backup progress %d/%d", remaining, pageCount)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps < 2 || lastRemaining != 0 {
+		t.Fatalf("Unexpected backup steps count %d with %d remaining pages", steps, lastRemaining)
+	}
+
+	backup, err := NewConn(backupName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	var count int64
+	err = scanQuery(backup, "SELECT count(*) FROM test;", &count)
+	if err != nil || count != int64(N) {
+		t.Fatalf("Expected %d rows in backup, got %d (%v)", N, count, err)
+	}
+
+	// Отменённое копирование.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = conn.BackupToFile(ctx, backupName, 1, time.Millisecond, -1, nil)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBackupRestarts(t *testing.T) {
+	defer cleanup()
+	backupName := "test-backup.db"
+	defer os.Remove(backupName)
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER, t TEXT);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := conn.Prepare("INSERT INTO test(n, t) VALUES(?, ?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	N := 500
+	for i := 0; i < N; i++ {
+		_, err = stmt.Exec(i, strings.Repeat("x", 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Другое соединение постоянно пишет в БД, из-за чего копирование
+	// начинается заново после каждого шага.
+	writer, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	err = writer.SetBusyTimeout(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			writer.Exec("INSERT INTO test(n, t) VALUES(-1, 'w');")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const maxRestarts = 3
+	restarts := 0
+	lastRemaining := -1
+	finished := make(chan error, 1)
+	go func() {
+		finished <- conn.BackupToFile(context.Background(), backupName, 1, time.Millisecond*2, maxRestarts, func(remaining, pageCount int) {
+			if lastRemaining >= 0 && remaining > lastRemaining {
+				restarts++
+			}
+			lastRemaining = remaining
+		})
+	}()
+	select {
+	case err = <-finished:
+	case <-time.After(time.Second * 30):
+		t.Fatal("Backup is not finished in time")
+	}
+	close(stop)
+	<-writerDone
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarts == 0 || restarts > maxRestarts+1 {
+		t.Fatalf("Unexpected backup restarts count %d", restarts)
+	}
+
+	backup, err := NewConn(backupName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	var count int64
+	err = scanQuery(backup, "SELECT count(*) FROM test WHERE n >= 0;", &count)
+	if err != nil || count != int64(N) {
+		t.Fatalf("Expected %d rows in backup, got %d (%v)", N, count, err)
+	}
+}
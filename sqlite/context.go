@@ -0,0 +1,60 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+import "context"
+
+// ContextError возвращается методами с контекстом (ExecContext,
+// QueryContext и т.д.), если выполнение запроса было прервано из-за отмены
+// контекста или истечения его дедлайна. Err - это ошибка контекста
+// (context.Canceled или context.DeadlineExceeded).
+type ContextError struct {
+	Err error
+}
+
+func (e *ContextError) Error() string {
+	return "sqlite: query interrupted: " + e.Err.Error()
+}
+
+// Unwrap позволяет проверять ошибку через errors.Is, например,
+// errors.Is(err, context.DeadlineExceeded).
+func (e *ContextError) Unwrap() error {
+	return e.Err
+}
+
+// contextError возвращает *ContextError, если err - это прерывание запроса
+// из-за отмены ctx. Иначе возвращается err.
+func contextError(ctx context.Context, err error) error {
+	if err == ErrInterrupt && ctx != nil && ctx.Err() != nil {
+		return &ContextError{Err: ctx.Err()}
+	}
+	return err
+}
+
+// watch следит за ctx во время выполнения запроса в соединении c и при
+// отмене ctx прерывает запрос вызовом sqlite3_interrupt. Возвращаемая
+// функция прекращает слежение и должна быть вызвана после окончания
+// запроса. После её возврата запросы соединения уже не будут прерваны.
+func (c *Conn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		// Контекст, который нельзя отменить, например, context.Background().
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			C.sqlite3_interrupt(c.db)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,117 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowQuery выполняется несколько минут, если его не прервать.
+const slowQuery = `
+WITH RECURSIVE counter(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM counter WHERE n < 10000000000)
+SELECT count(*) FROM counter;
+`
+
+func TestExecContext(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare(slowQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	// Запрос прерывается по истечении дедлайна.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	_, err = stmt.ExecContext(ctx)
+	if ctxErr, ok := err.(*ContextError); !ok || ctxErr.Err != context.DeadlineExceeded {
+		t.Fatalf("Expected ContextError with context.DeadlineExceeded, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("ContextError doesn't unwrap to context.DeadlineExceeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Query is interrupted too late (%v)", elapsed)
+	}
+
+	// После прерывания соединение продолжает работать.
+	var n int64
+	err = scanQuery(conn, "SELECT 42;", &n)
+	if err != nil || n != 42 {
+		t.Fatalf("Unexpected result %d after interrupt (%v)", n, err)
+	}
+
+	// Отменённый контекст.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	_, err = conn.ExecContext(ctx, slowQuery)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	_, err = conn.ExecContext(ctx, "SELECT 1;")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled for already cancelled context, got %v", err)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.Prepare("WITH RECURSIVE counter(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM counter) SELECT n FROM counter;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	// Бесконечный запрос прерывается между строками.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for rows.Next() {
+		count++
+		if count == 100 {
+			cancel()
+			// Даём время горутине, которая прерывает запрос.
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+	rows.Close()
+	if !errors.Is(rows.Err(), context.Canceled) {
+		t.Fatalf("Expected context.Canceled after %d rows, got %v", count, rows.Err())
+	}
+
+	// Запрос без отмены контекста выполняется как обычно.
+	rows, err = stmt.QueryContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	var n int64
+	err = rows.Scan(&n)
+	if err != nil || n != 1 {
+		t.Fatalf("Unexpected first row %d (%v)", n, err)
+	}
+	rows.Close()
+}
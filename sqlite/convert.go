@@ -0,0 +1,429 @@
+package sqlite
+
+/*
+#include <stdlib.h>
+#include "sqlite3.h"
+*/
+import "C"
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// TimeFormat - формат по-умолчанию, в котором значения типа time.Time
+// сохраняются в БД. Такой формат понимают функции даты и времени SQLite.
+// Формат соединения можно изменить методом Conn.SetTimeFormat.
+const TimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// timeFormats - форматы, в которых может храниться время в колонках типа
+// TEXT. Это форматы, которые понимают функции даты и времени SQLite. Время
+// без часового пояса считается временем в UTC, т.к. в UTC его возвращают
+// функции SQLite, например, datetime('now').
+var timeFormats = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04Z07:00",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Юлианский день начала эпохи Unix. Функция julianday SQLite возвращает время
+// в виде юлианского дня типа REAL.
+const unixEpochJulianDay = 2440587.5
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// bindValue подставляет аргумент arg в параметр с номером n (нумерация
+// начинается с 1). arg может быть:
+//   - nil или nil указателем, тогда подставляется NULL;
+//   - bool, подставляется 1 или 0;
+//   - целым числом любого типа (uint64 не должно превышать math.MaxInt64);
+//   - float32 или float64;
+//   - строкой или []byte (nil слайс подставляется как NULL);
+//   - time.Time, подставляется строка в формате соединения (см.
+//     Conn.SetTimeFormat);
+//   - driver.Valuer (например, sql.NullString), подставляется результат
+//     метода Value;
+//   - указателем на значение одного из перечисленных типов.
+func (s *Stmt) bindValue(n int, arg interface{}) error {
+	if arg == nil {
+		return resultCode2GoError(C.sqlite3_bind_null(s.stmt, C.int(n)))
+	}
+
+	value := reflect.ValueOf(arg)
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return resultCode2GoError(C.sqlite3_bind_null(s.stmt, C.int(n)))
+	}
+	if valuer, ok := arg.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		return s.bindValue(n, v)
+	}
+	if value.Kind() == reflect.Ptr {
+		return s.bindValue(n, value.Elem().Interface())
+	}
+	if t, ok := arg.(time.Time); ok {
+		return s.bindText(n, t.Format(s.conn.timeFormat))
+	}
+
+	var resCode C.int
+	switch value.Kind() {
+	case reflect.Bool:
+		v := 0
+		if value.Bool() {
+			v = 1
+		}
+		resCode = C.sqlite3_bind_int(s.stmt, C.int(n), C.int(v))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		resCode = C.sqlite3_bind_int64(s.stmt, C.int(n), C.sqlite3_int64(value.Int()))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v := value.Uint()
+		if v > math.MaxInt64 {
+			return errors.New("sqlite: value " + strconv.FormatUint(v, 10) + " overflows INTEGER")
+		}
+		resCode = C.sqlite3_bind_int64(s.stmt, C.int(n), C.sqlite3_int64(v))
+
+	case reflect.Float32, reflect.Float64:
+		resCode = C.sqlite3_bind_double(s.stmt, C.int(n), C.double(value.Float()))
+
+	case reflect.String:
+		return s.bindText(n, value.String())
+
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.Uint8 { // не []byte
+			argTypeStr := fmt.Sprintf("%T", arg)
+			return errors.New("sqlite: unsupported type (" + argTypeStr + ")")
+		}
+		data := value.Bytes()
+		if data == nil {
+			resCode = C.sqlite3_bind_null(s.stmt, C.int(n))
+			break
+		}
+		if len(data) == 0 {
+			// Пустой слайс подставляется как BLOB нулевой длины, а не NULL.
+			resCode = C.sqlite3_bind_zeroblob(s.stmt, C.int(n), 0)
+			break
+		}
+		cData := C.CBytes(data)
+		defer C.free(unsafe.Pointer(cData))
+		// C.SQLITE_TRANSIENT приводит к копированию данных слайса во
+		// внутреннюю память SQLite. Так и не смог понять из документации
+		// (https://www.sqlite.org/c3ref/bind_blob.html), когда безопасно
+		// освобождать передаваемый в SQLite указатель на данные cData.
+		resCode = C.sqlite3_bind_blob(s.stmt, C.int(n), cData, C.int(len(data)), C.SQLITE_TRANSIENT)
+
+	default:
+		argTypeStr := fmt.Sprintf("%T", arg)
+		return errors.New("sqlite: unsupported type (" + argTypeStr + ")")
+	}
+
+	return resultCode2GoError(resCode)
+}
+
+// bindText подставляет строку str в параметр с номером n.
+func (s *Stmt) bindText(n int, str string) error {
+	cStr := C.CString(str)
+	defer C.free(unsafe.Pointer(cStr))
+	// C.SQLITE_TRANSIENT приводит к копированию строки во внутреннюю
+	// память SQLite. Так и не смог понять из документации
+	// (https://www.sqlite.org/c3ref/bind_blob.html), когда безопасно
+	// освобождать передаваемый в SQLite указатель на строку cStr.
+	resCode := C.sqlite3_bind_text(s.stmt, C.int(n), cStr, C.int(len(str)), C.SQLITE_TRANSIENT)
+	return resultCode2GoError(resCode)
+}
+
+// columnValue возвращает значение колонки с номером i (нумерация начинается
+// с 0) текущей строки в виде int64, float64, string, []byte или nil для
+// колонок типа INTEGER, REAL, TEXT, BLOB или NULL соответственно.
+func (s *Stmt) columnValue(i int) interface{} {
+	colNum := C.int(i)
+	switch C.sqlite3_column_type(s.stmt, colNum) {
+	case C.SQLITE_INTEGER:
+		return int64(C.sqlite3_column_int64(s.stmt, colNum))
+
+	case C.SQLITE_FLOAT:
+		return float64(C.sqlite3_column_double(s.stmt, colNum))
+
+	case C.SQLITE_TEXT:
+		cStr := C.sqlite3_column_text(s.stmt, colNum)
+		size := C.sqlite3_column_bytes(s.stmt, colNum)
+		return C.GoStringN((*C.char)(unsafe.Pointer(cStr)), size)
+
+	case C.SQLITE_BLOB:
+		blob := C.sqlite3_column_blob(s.stmt, colNum)
+		size := C.sqlite3_column_bytes(s.stmt, colNum)
+		return C.GoBytes(blob, size)
+	}
+	return nil
+}
+
+// assign записывает значение колонки src (см. columnValue) в dest. Значения
+// преобразуются между типами так же, как это делает SQLite: например,
+// строка "42" записывается в целое число, а число - в строку. Значение NULL
+// записывается в dest как нулевое значение его типа, а в указатель на
+// указатель (например, **int64) - как nil. Строки времени разбираются сначала
+// в формате timeFormat, а потом в форматах, которые понимает SQLite.
+func assign(dest, src interface{}, timeFormat string) error {
+	switch d := dest.(type) {
+	case *interface{}:
+		*d = src
+		return nil
+
+	case *time.Time:
+		t, err := toTime(src, timeFormat)
+		if err != nil {
+			return err
+		}
+		*d = t
+		return nil
+
+	case sql.Scanner:
+		return d.Scan(src)
+	}
+
+	destPtr := reflect.ValueOf(dest)
+	if destPtr.Kind() != reflect.Ptr || destPtr.IsNil() {
+		return ErrColumnType
+	}
+	v := destPtr.Elem()
+
+	// Указатель на указатель: NULL записывается как nil, остальные значения
+	// записываются в новое значение, на которое затем указывает *dest.
+	if v.Kind() == reflect.Ptr {
+		if src == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		newValue := reflect.New(v.Type().Elem())
+		err := assign(newValue.Interface(), src, timeFormat)
+		if err != nil {
+			return err
+		}
+		v.Set(newValue)
+		return nil
+	}
+	if v.Type() == timeType {
+		t, err := toTime(src, timeFormat)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt64(src)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return errors.New("value " + strconv.FormatInt(n, 10) + " overflows " + v.Type().String())
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := toInt64(src)
+		if err != nil {
+			return err
+		}
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return errors.New("value " + strconv.FormatInt(n, 10) + " overflows " + v.Type().String())
+		}
+		v.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(src)
+		if err != nil {
+			return err
+		}
+		if v.OverflowFloat(f) {
+			return errors.New("value " + strconv.FormatFloat(f, 'g', -1, 64) + " overflows " + v.Type().String())
+		}
+		v.SetFloat(f)
+
+	case reflect.Bool:
+		b, err := toBool(src)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.String:
+		v.SetString(toString(src))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return ErrColumnType
+		}
+		v.SetBytes(toBytes(src))
+
+	default:
+		return ErrColumnType
+	}
+	return nil
+}
+
+// columnTypeName возвращает название типа SQLite, которому соответствует
+// значение колонки src.
+func columnTypeName(src interface{}) string {
+	switch src.(type) {
+	case int64:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	case string:
+		return "TEXT"
+	case []byte:
+		return "BLOB"
+	}
+	return "NULL"
+}
+
+func conversionError(src interface{}, to string) error {
+	return errors.New("cannot convert " + columnTypeName(src) + " value " + fmt.Sprintf("%q", toString(src)) + " to " + to)
+}
+
+// toInt64 преобразует значение колонки в целое число. Вещественные числа
+// округляются к нулю, строки должны содержать число.
+func toInt64(src interface{}) (int64, error) {
+	switch v := src.(type) {
+	case nil:
+		return 0, nil
+
+	case int64:
+		return v, nil
+
+	case float64:
+		if v < math.MinInt64 || v >= math.MaxInt64 || math.IsNaN(v) {
+			return 0, conversionError(src, "INTEGER")
+		}
+		return int64(v), nil
+
+	case string, []byte:
+		str := strings.TrimSpace(toString(v))
+		if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			return toInt64(f)
+		}
+	}
+	return 0, conversionError(src, "INTEGER")
+}
+
+// toFloat64 преобразует значение колонки в вещественное число.
+func toFloat64(src interface{}) (float64, error) {
+	switch v := src.(type) {
+	case nil:
+		return 0, nil
+
+	case int64:
+		return float64(v), nil
+
+	case float64:
+		return v, nil
+
+	case string, []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(toString(v)), 64)
+		if err == nil {
+			return f, nil
+		}
+	}
+	return 0, conversionError(src, "REAL")
+}
+
+// toBool преобразует значение колонки в bool. Числа, отличные от 0,
+// считаются true, также поддерживаются строки "true" и "false".
+func toBool(src interface{}) (bool, error) {
+	if str, ok := src.(string); ok {
+		if b, err := strconv.ParseBool(strings.TrimSpace(str)); err == nil {
+			return b, nil
+		}
+	}
+	f, err := toFloat64(src)
+	if err != nil {
+		return false, conversionError(src, "bool")
+	}
+	return f != 0, nil
+}
+
+// toString преобразует значение колонки в строку. Вещественные числа
+// записываются так же, как их записывает SQLite, например, "1.0".
+func toString(src interface{}) string {
+	switch v := src.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+
+	case float64:
+		str := strconv.FormatFloat(v, 'g', 15, 64)
+		if !strings.ContainsAny(str, ".eEn") { // n - для NaN и Inf.
+			str += ".0"
+		}
+		return str
+
+	case string:
+		return v
+
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// toBytes преобразует значение колонки в []byte. NULL преобразуется в nil.
+func toBytes(src interface{}) []byte {
+	switch v := src.(type) {
+	case nil:
+		return nil
+
+	case []byte:
+		return v
+	}
+	return []byte(toString(src))
+}
+
+// toTime преобразует значение колонки во время. Строки разбираются в
+// формате timeFormat или в одном из форматов timeFormats, целые числа
+// считаются временем Unix в секундах, а вещественные - юлианским днём.
+func toTime(src interface{}, timeFormat string) (time.Time, error) {
+	switch v := src.(type) {
+	case nil:
+		return time.Time{}, nil
+
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+
+	case float64:
+		sec, frac := math.Modf((v - unixEpochJulianDay) * 86400)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+
+	case string, []byte:
+		str := strings.TrimSpace(toString(v))
+		if t, err := time.Parse(timeFormat, str); err == nil {
+			return t, nil
+		}
+		for _, format := range timeFormats {
+			if t, err := time.Parse(format, str); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, conversionError(src, "time")
+}
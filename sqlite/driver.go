@@ -0,0 +1,378 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DriverName - название, под которым драйвер пакета регистрируется в
+// database/sql:
+//
+//	db, err := sql.Open(sqlite.DriverName, "movies.db")
+//
+// Имя источника данных (DSN) - это имя файла БД, после которого через "?"
+// можно указать параметры в виде URL query. Поддерживается параметр
+// busy_timeout - таймаут ожидания занятой БД в миллисекундах, который
+// устанавливается для каждого нового соединения, например,
+// "movies.db?busy_timeout=10000", и параметр time_format - формат времени
+// (см. Conn.SetTimeFormat).
+const DriverName = "sqlite-source-farm"
+
+func init() {
+	sql.Register(DriverName, &Driver{})
+}
+
+// Driver реализует интерфейс driver.Driver поверх соединений Conn. Собственный
+// интерфейс пакета (Conn, Stmt, Rows) при этом остаётся доступен.
+type Driver struct{}
+
+// Open открывает новое соединение с БД. Формат name описан в DriverName.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	filename, params := name, url.Values{}
+	if i := strings.LastIndex(name, "?"); i != -1 {
+		var err error
+		filename = name[:i]
+		params, err = url.ParseQuery(name[i+1:])
+		if err != nil {
+			return nil, errors.New("sqlite: incorrect DSN parameters: " + err.Error())
+		}
+	}
+
+	conn, err := NewConn(filename)
+	if err != nil {
+		return nil, err
+	}
+	if busyTimeout := params.Get("busy_timeout"); busyTimeout != "" {
+		ms, err := strconv.Atoi(busyTimeout)
+		if err == nil {
+			err = conn.SetBusyTimeout(ms)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, errors.New("sqlite: incorrect busy_timeout \"" + busyTimeout + "\"")
+		}
+	}
+	if timeFormat := params.Get("time_format"); timeFormat != "" {
+		conn.SetTimeFormat(timeFormat)
+	}
+	return &driverConn{conn: conn}, nil
+}
+
+// driverConn реализует интерфейсы соединения database/sql/driver.
+type driverConn struct {
+	conn *Conn
+}
+
+var (
+	_ driver.Conn               = (*driverConn)(nil)
+	_ driver.ConnPrepareContext = (*driverConn)(nil)
+	_ driver.ConnBeginTx        = (*driverConn)(nil)
+	_ driver.ExecerContext      = (*driverConn)(nil)
+	_ driver.QueryerContext     = (*driverConn)(nil)
+	_ driver.NamedValueChecker  = (*driverConn)(nil)
+)
+
+func (c *driverConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *driverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &driverStmt{stmt: stmt}, nil
+}
+
+func (c *driverConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *driverConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx начинает транзакцию. В SQLite все транзакции изолированы
+// полностью, поэтому поддерживаются только уровни изоляции по-умолчанию и
+// sql.LevelSerializable.
+func (c *driverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	level := sql.IsolationLevel(opts.Isolation)
+	if level != sql.LevelDefault && level != sql.LevelSerializable {
+		return nil, errors.New("sqlite: unsupported isolation level " + level.String())
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("sqlite: read-only transactions are not supported")
+	}
+	tx, err := c.conn.BeginTx(Deferred)
+	if err != nil {
+		return nil, err
+	}
+	return &driverTx{tx: tx}, nil
+}
+
+// ExecContext выполняет запрос query. Запрос без аргументов может состоять из
+// нескольких SQL-предложений, разделённых ";".
+func (c *driverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		_, err := c.conn.ExecContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return newDriverResult(c.conn), nil
+	}
+
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return (&driverStmt{stmt: stmt}).ExecContext(ctx, args)
+}
+
+func (c *driverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (&driverStmt{stmt: stmt}).QueryContext(ctx, args)
+	if err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	// SQL-предложение создано только для этого запроса, поэтому закрывается
+	// вместе с rows.
+	rows.(*driverRows).closeStmt = true
+	return rows, nil
+}
+
+// CheckNamedValue проверяет, что значение аргумента запроса можно подставить
+// в SQL-предложение. Значения преобразуются стандартным для database/sql
+// образом, а time.Time подставляется в формате соединения (см.
+// Conn.SetTimeFormat).
+func (c *driverConn) CheckNamedValue(nv *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	nv.Value = value
+	return nil
+}
+
+// driverTx реализует интерфейс driver.Tx.
+type driverTx struct {
+	tx *Tx
+}
+
+func (tx *driverTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *driverTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// driverResult - результат выполнения запроса. В отличие от sqliteResult
+// значения получаются сразу после выполнения запроса, т.к. соединение может
+// быть использовано database/sql для других запросов до обращения к
+// результату.
+type driverResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func newDriverResult(conn *Conn) *driverResult {
+	return &driverResult{
+		lastInsertID: int64(C.sqlite3_last_insert_rowid(conn.db)),
+		rowsAffected: int64(C.sqlite3_changes(conn.db)),
+	}
+}
+
+func (r *driverResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r *driverResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// driverStmt реализует интерфейсы SQL-предложения database/sql/driver.
+type driverStmt struct {
+	stmt *Stmt
+}
+
+var (
+	_ driver.Stmt             = (*driverStmt)(nil)
+	_ driver.StmtExecContext  = (*driverStmt)(nil)
+	_ driver.StmtQueryContext = (*driverStmt)(nil)
+)
+
+func (s *driverStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput возвращает количество параметров SQL-предложения.
+func (s *driverStmt) NumInput() int {
+	if s.stmt.stmt == nil {
+		return -1
+	}
+	return int(C.sqlite3_bind_parameter_count(s.stmt.stmt))
+}
+
+func (s *driverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *driverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *driverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	stop := s.stmt.conn.watch(ctx)
+	resCode := C.sqlite3_step(s.stmt.stmt)
+	err = resultCode2GoError(resCode)
+	if err == SQLiteRow {
+		// Строки результата не нужны, но запрос должен быть выполнен до
+		// конца.
+		for err == SQLiteRow {
+			resCode = C.sqlite3_step(s.stmt.stmt)
+			err = resultCode2GoError(resCode)
+		}
+	}
+	stop()
+	if err != SQLiteDone {
+		C.sqlite3_reset(s.stmt.stmt)
+		return nil, contextError(ctx, err)
+	}
+	result := newDriverResult(s.stmt.conn)
+	C.sqlite3_reset(s.stmt.stmt)
+	return result, nil
+}
+
+func (s *driverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	rows := &Rows{stmt: s.stmt, ctx: ctx, stop: s.stmt.conn.watch(ctx)}
+	return &driverRows{rows: rows}, nil
+}
+
+// bind подставляет аргументы args в SQL-предложение. Именованные аргументы
+// (sql.Named) подставляются в параметры вида :name, @name или $name.
+func (s *driverStmt) bind(args []driver.NamedValue) error {
+	err := s.stmt.clearBindings()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		n := arg.Ordinal
+		if arg.Name != "" {
+			n = s.stmt.paramIndex(arg.Name)
+			if n == 0 {
+				return errors.New("sqlite: unknown named parameter \"" + arg.Name + "\"")
+			}
+		}
+		err = s.stmt.bindValue(n, arg.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func valuesToNamedValues(args []driver.Value) []driver.NamedValue {
+	namedArgs := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		namedArgs[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return namedArgs
+}
+
+// driverRows реализует интерфейсы строк результата database/sql/driver.
+type driverRows struct {
+	rows      *Rows
+	closeStmt bool // Закрывать SQL-предложение вместе с driverRows.
+}
+
+var (
+	_ driver.Rows                           = (*driverRows)(nil)
+	_ driver.RowsColumnTypeDatabaseTypeName = (*driverRows)(nil)
+)
+
+func (r *driverRows) Columns() []string {
+	stmt := r.rows.stmt.stmt
+	columns := make([]string, int(C.sqlite3_column_count(stmt)))
+	for i := range columns {
+		columns[i] = C.GoString(C.sqlite3_column_name(stmt, C.int(i)))
+	}
+	return columns
+}
+
+// ColumnTypeDatabaseTypeName возвращает тип колонки, с которым она объявлена
+// в таблице, например, "INTEGER". Для выражений возвращается пустая строка.
+func (r *driverRows) ColumnTypeDatabaseTypeName(index int) string {
+	declType := C.sqlite3_column_decltype(r.rows.stmt.stmt, C.int(index))
+	if declType == nil {
+		return ""
+	}
+	return strings.ToUpper(C.GoString(declType))
+}
+
+func (r *driverRows) Close() error {
+	err := r.rows.Close()
+	if r.closeStmt {
+		closeErr := r.rows.stmt.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Next сканирует следующую строку в dest. Колонка со значением NULL
+// сканируется в nil.
+func (r *driverRows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	for i := range dest {
+		dest[i] = r.rows.stmt.columnValue(i)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDriver(t *testing.T) {
+	defer cleanup()
+
+	db, err := sql.Open(DriverName, dbName+"?busy_timeout=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Запрос из нескольких SQL-предложений.
+	_, err = db.Exec(`
+CREATE TABLE test(n INTEGER, f REAL, t TEXT, b BLOB, nullable TEXT);
+CREATE TABLE other(id INTEGER PRIMARY KEY);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := db.Prepare("INSERT INTO test(n, f, t, b, nullable) VALUES(?, ?, ?, ?, ?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	deadbeef := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	for i := 1; i <= 3; i++ {
+		nullable := sql.NullString{String: "foo", Valid: i%2 == 0}
+		result, err := stmt.Exec(i, 1.5, "foo", deadbeef, nullable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil || id != int64(i) {
+			t.Fatalf("Expected last insert id %d, got %d (%v)", i, id, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil || affected != 1 {
+			t.Fatalf("Expected 1 affected row, got %d (%v)", affected, err)
+		}
+	}
+
+	rows, err := db.Query("SELECT n, f, t, b, nullable FROM test WHERE n >= ? ORDER BY n;", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err := rows.Columns()
+	if err != nil || !reflect.DeepEqual(columns, []string{"n", "f", "t", "b", "nullable"}) {
+		t.Fatalf("Unexpected columns %v (%v)", columns, err)
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil || columnTypes[0].DatabaseTypeName() != "INTEGER" || columnTypes[3].DatabaseTypeName() != "BLOB" {
+		t.Fatalf("Unexpected column types %v (%v)", columnTypes, err)
+	}
+	rowNum := 0
+	for rows.Next() {
+		rowNum++
+		var n int
+		var f float64
+		var s string
+		var b []byte
+		var nullable sql.NullString
+		err = rows.Scan(&n, &f, &s, &b, &nullable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != rowNum || f != 1.5 || s != "foo" || !reflect.DeepEqual(b, deadbeef) {
+			t.Fatalf("Unexpected row %d: %v %v %v %v", rowNum, n, f, s, b)
+		}
+		if nullable.Valid != (rowNum%2 == 0) {
+			t.Fatalf("Unexpected nullable %+v in row %d", nullable, rowNum)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if rowNum != 3 {
+		t.Fatalf("Expected 3 rows, got %d", rowNum)
+	}
+
+	// Именованные параметры.
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM test WHERE n > :min AND t = @text;", sql.Named("min", 1), sql.Named("text", "foo")).Scan(&count)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 rows, got %d (%v)", count, err)
+	}
+	_, err = db.Exec("SELECT n FROM test WHERE n = :n;", sql.Named("unknown", 1))
+	if err == nil {
+		t.Fatal("Expected error for unknown named parameter, got nil")
+	}
+
+	// time.Time передаётся в формате, который понимает SQLite.
+	var year string
+	date := time.Date(2020, time.May, 7, 10, 0, 0, 0, time.UTC)
+	err = db.QueryRow("SELECT strftime('%Y', ?);", date).Scan(&year)
+	if err != nil || year != "2020" {
+		t.Fatalf("Unexpected year %q (%v)", year, err)
+	}
+
+	err = db.QueryRow("SELECT n FROM test WHERE n = 100;").Scan(&count)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestDriverTx(t *testing.T) {
+	defer cleanup()
+
+	db, err := sql.Open(DriverName, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("INSERT INTO test(n) VALUES(?);", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("INSERT INTO test(n) VALUES(?);", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err = db.QueryRow("SELECT group_concat(n) FROM test;").Scan(&n)
+	if err != nil || n != 2 {
+		t.Fatalf("Unexpected rows after transactions: %d (%v)", n, err)
+	}
+
+	_, err = db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err == nil {
+		t.Fatal("Expected error for unsupported isolation level, got nil")
+	}
+
+	// Отменённый контекст.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.ExecContext(ctx, "INSERT INTO test(n) VALUES(3);")
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDriverPool(t *testing.T) {
+	defer cleanup()
+
+	db, err := sql.Open(DriverName, dbName+"?busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(4)
+	_, err = db.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Одновременная работа с БД через несколько соединений.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.Exec("INSERT INTO test(n) VALUES(?);", i)
+			if err == nil {
+				var count int
+				err = db.QueryRow("SELECT count(*) FROM test;").Scan(&count)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	err = db.QueryRow("SELECT count(*) FROM test;").Scan(&count)
+	if err != nil || count != 8 {
+		t.Fatalf("Expected 8 rows, got %d (%v)", count, err)
+	}
+
+	// Ошибка в DSN обнаруживается при открытии соединения.
+	badDB, err := sql.Open(DriverName, dbName+"?busy_timeout=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer badDB.Close()
+	if err = badDB.Ping(); err == nil {
+		t.Fatal("Expected error for incorrect busy_timeout, got nil")
+	}
+}
@@ -0,0 +1,61 @@
+package sqlite
+
+/*
+#include <stdlib.h>
+#include "sqlite3.h"
+*/
+import "C"
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// CompileOptionUsed возвращает true, если библиотека SQLite собрана с опцией
+// name. Префикс "SQLITE_" в name можно не указывать, например,
+// CompileOptionUsed("ENABLE_FTS5").
+func CompileOptionUsed(name string) bool {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.sqlite3_compileoption_used(cName) != 0
+}
+
+// HasFTS5 возвращает true, если в библиотеку SQLite включено расширение
+// полнотекстового поиска FTS5 (https://sqlite.org/fts5.html).
+func HasFTS5() bool {
+	return CompileOptionUsed("ENABLE_FTS5")
+}
+
+// FTS5PrefixQuery составляет из произвольного текста text запрос для MATCH
+// таблицы FTS5, которому соответствуют строки со словами, начинающимися с
+// каждого из слов text. Например, для текста "godfather par" возвращается
+// `"godfather"* "par"*`. Слова заключаются в кавычки, поэтому операторы FTS5
+// в text (AND, OR, NOT, NEAR) не имеют специального значения.
+// Слова короче minPrefixLen символов ищутся целиком, а не как начало слова,
+// т.к. с одной-двух букв начинаются слова большей части строк таблицы и
+// bm25 пришлось бы считать почти для всей таблицы. По той же причине, если в
+// text нет ни одного слова длиной хотя бы minPrefixLen символов, то
+// возвращается пустая строка.
+func FTS5PrefixQuery(text string, minPrefixLen int) string {
+	// Слова разделяются так же, как в токенизаторе unicode61, поэтому в них
+	// нет кавычек и других символов синтаксиса FTS5.
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	quoted := make([]string, len(words))
+	hasPrefix := false
+	for i, word := range words {
+		if utf8.RuneCountInString(word) < minPrefixLen {
+			quoted[i] = `"` + word + `"`
+			continue
+		}
+		quoted[i] = `"` + word + `"*`
+		hasPrefix = true
+	}
+	if !hasPrefix {
+		return ""
+	}
+	return strings.Join(quoted, " ")
+}
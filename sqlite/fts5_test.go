@@ -0,0 +1,171 @@
+package sqlite
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFTS5PrefixQuery(t *testing.T) {
+	testCases := []struct {
+		text         string
+		minPrefixLen int
+		query        string
+	}{
+		{"godfather par", 1, `"godfather"* "par"*`},
+		{"  Брат-2 ", 1, `"Брат"* "2"*`},
+		{`"quoted" OR *star* NEAR(x)`, 1, `"quoted"* "OR"* "star"* "NEAR"* "x"*`},
+		{" - * ", 1, ""},
+		// Короткие слова ищутся целиком.
+		{"godfather pa", 3, `"godfather"* "pa"`},
+		{"Брат-2", 3, `"Брат"* "2"`},
+		{"a b", 3, ""},
+		{"up", 3, ""},
+	}
+	for _, tc := range testCases {
+		if query := FTS5PrefixQuery(tc.text, tc.minPrefixLen); query != tc.query {
+			t.Fatalf("Expected query %s for %q, got %s", tc.query, tc.text, query)
+		}
+	}
+}
+
+func TestFTS5(t *testing.T) {
+	if !HasFTS5() {
+		t.Skip("SQLite is built without FTS5")
+	}
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+CREATE VIRTUAL TABLE movie USING fts5(title);
+INSERT INTO movie(rowid, title) VALUES (1, 'The Godfather'),
+                                       (2, 'The Godfather Part II'),
+                                       (3, 'Part of the Family'),
+                                       (4, 'Крёстный отец');
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := conn.Prepare("SELECT rowid FROM movie WHERE movie MATCH ?1 ORDER BY bm25(movie), rowid;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	testCases := []struct {
+		text string
+		ids  []int64
+	}{
+		{"godfather part", []int64{2}},
+		{"part godf", []int64{2}},
+		{"the", []int64{1, 2, 3}},
+		{"КРЁСТНЫЙ", []int64{4}},
+		{"godfather NOT part", nil},
+	}
+	for _, tc := range testCases {
+		rows, err := stmt.Query(FTS5PrefixQuery(tc.text, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			err = rows.Scan(&id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Fatalf("Expected rows %v for %q, got %v", tc.ids, tc.text, ids)
+		}
+	}
+}
+
+// BenchmarkFTS5Query500k сравнивает скорость поиска по таблице FTS5 из 500
+// тыс. названий с сортировкой по bm25 для запросов с короткими и длинными
+// префиксами.
+func BenchmarkFTS5Query500k(b *testing.B) {
+	if !HasFTS5() {
+		b.Skip("SQLite is built without FTS5")
+	}
+	const benchDBName = "bench-fts5.db"
+	os.Remove(benchDBName)
+	defer os.Remove(benchDBName)
+	conn, err := NewConn(benchDBName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE VIRTUAL TABLE movie USING fts5(title);")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	words := []string{
+		"the", "lion", "king", "star", "wars", "godfather", "part", "return",
+		"night", "day", "dark", "knight", "love", "story", "city", "man",
+		"woman", "last", "first", "war", "house", "blood", "dead", "life",
+		"интерстеллар", "король", "лев", "ночь", "день", "любовь", "война",
+	}
+	rnd := rand.New(rand.NewSource(1))
+	_, err = conn.Exec("BEGIN;")
+	if err != nil {
+		b.Fatal(err)
+	}
+	insert, err := conn.Prepare("INSERT INTO movie(title) VALUES (?1);")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 500000; i++ {
+		titleWords := make([]string, 1+rnd.Intn(4))
+		for j := range titleWords {
+			titleWords[j] = words[rnd.Intn(len(words))]
+		}
+		_, err = insert.Exec(strings.Join(titleWords, " "))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	insert.Close()
+	_, err = conn.Exec("COMMIT;")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stmt, err := conn.Prepare("SELECT rowid, bm25(movie) FROM movie WHERE movie MATCH ?1 ORDER BY bm25(movie) LIMIT 100;")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stmt.Close()
+	for _, bc := range []struct {
+		name  string
+		query string
+	}{
+		{"OneLetterPrefix", `"godfather"* "p"*`},
+		{"ShortWordExact", FTS5PrefixQuery("godfather p", 3)},
+		{"LongPrefixes", FTS5PrefixQuery("godfather part", 3)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rows, err := stmt.Query(bc.query)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for rows.Next() {
+				}
+				rows.Close()
+			}
+		})
+	}
+}
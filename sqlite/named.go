@@ -0,0 +1,217 @@
+package sqlite
+
+/*
+#include <stdlib.h>
+#include "sqlite3.h"
+*/
+import "C"
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Тег полей структуры, в котором указывается название параметра или колонки,
+// например, `sqlite:"tmdb_id"`. Поля без тега и с тегом "-" пропускаются.
+const structTag = "sqlite"
+
+// Соответствие названий параметров и колонок индексам полей структуры (см.
+// reflect.Value.FieldByIndex) для каждого типа структуры.
+var structFieldsCache sync.Map // reflect.Type -> map[string][]int
+
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// namedArg проверяет, является ли arg набором именованных аргументов:
+// map[string]interface{}, структурой или указателем на структуру. time.Time
+// и структуры, реализующие driver.Valuer, подставляются как одно значение.
+func namedArg(arg interface{}) bool {
+	if _, ok := arg.(map[string]interface{}); ok {
+		return true
+	}
+
+	t := reflect.TypeOf(arg)
+	if t == nil || t.Implements(valuerType) {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// bindNamed подставляет именованные аргументы arg (см. namedArg) в
+// параметры вида :name, @name или $name. Ключи map'а должны совпадать с
+// параметрами SQL-предложения, а для структуры подставляются поля с тегом
+// sqlite, для которых есть параметр с таким названием. Если после подстановки
+// остались параметры без значения, то возвращается ошибка, т.к. вместо них
+// SQLite молча подставил бы NULL.
+func (s *Stmt) bindNamed(arg interface{}) error {
+	count := int(C.sqlite3_bind_parameter_count(s.stmt))
+	bound := make([]bool, count+1)
+
+	if params, ok := arg.(map[string]interface{}); ok {
+		for name, param := range params {
+			n := s.paramIndex(name)
+			if n == 0 {
+				return errors.New("sqlite: unknown named parameter \"" + name + "\"")
+			}
+			err := s.bindValue(n, param)
+			if err != nil {
+				return errors.New("sqlite: parameter \"" + name + "\": " + err.Error())
+			}
+			bound[n] = true
+		}
+	} else {
+		value := reflect.ValueOf(arg)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return errors.New("sqlite: nil struct pointer passed as named parameters")
+			}
+			value = value.Elem()
+		}
+		for name, index := range structFields(value.Type()) {
+			n := s.paramIndex(name)
+			if n == 0 {
+				continue
+			}
+			err := s.bindValue(n, value.FieldByIndex(index).Interface())
+			if err != nil {
+				return errors.New("sqlite: parameter \"" + name + "\": " + err.Error())
+			}
+			bound[n] = true
+		}
+	}
+
+	for n := 1; n <= count; n++ {
+		if bound[n] {
+			continue
+		}
+		cName := C.sqlite3_bind_parameter_name(s.stmt, C.int(n))
+		if cName == nil {
+			return errors.New("sqlite: positional parameter " + strconv.Itoa(n) + " cannot be bound by name")
+		}
+		return errors.New("sqlite: parameter \"" + C.GoString(cName) + "\" is not bound")
+	}
+
+	return nil
+}
+
+// paramIndex возвращает номер параметра SQL-предложения с именем name или 0,
+// если такого параметра нет. name может быть как с префиксом (":name"), так
+// и без него, тогда ищутся параметры :name, @name и $name.
+func (s *Stmt) paramIndex(name string) int {
+	prefixes := []string{":", "@", "$"}
+	if name != "" && strings.ContainsAny(name[:1], ":@$") {
+		prefixes = []string{""}
+	}
+
+	for _, prefix := range prefixes {
+		cName := C.CString(prefix + name)
+		n := C.sqlite3_bind_parameter_index(s.stmt, cName)
+		C.free(unsafe.Pointer(cName))
+		if n != 0 {
+			return int(n)
+		}
+	}
+	return 0
+}
+
+// structFields возвращает названия из тегов sqlite полей структуры типа t и
+// индексы этих полей. Поля встроенных (embedded) структур без тега тоже
+// учитываются, но поля внешней структуры имеют приоритет.
+func structFields(t reflect.Type) map[string][]int {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+
+	fields := make(map[string][]int)
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get(structTag)
+		if tag == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, field)
+			continue
+		}
+		// Значения неэкспортируемых полей недоступны через reflect.
+		if tag == "" || tag == "-" || field.PkgPath != "" {
+			continue
+		}
+		if _, ok := fields[tag]; !ok {
+			fields[tag] = field.Index
+		}
+	}
+	for _, field := range embedded {
+		for name, index := range structFields(field.Type) {
+			if _, ok := fields[name]; !ok {
+				fields[name] = append([]int{field.Index[0]}, index...)
+			}
+		}
+	}
+
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+// ScanStruct сканирует колонки текущей строки в поля структуры, на которую
+// указывает dest. Колонка записывается в поле, у которого в теге sqlite
+// указано название колонки (см. AS в запросе), например:
+//
+//	type movie struct {
+//		ID    int64  `sqlite:"id"`
+//		Title string `sqlite:"original_title"`
+//	}
+//
+// Значения преобразуются так же, как в методе Scan. Если для колонки нет
+// поля, то возвращается ошибка. Поля, для которых нет колонок, не меняются.
+func (r *Rows) ScanStruct(dest interface{}) error {
+	if r.stmt.stmt == nil {
+		return ErrStmtDone
+	}
+
+	value := reflect.ValueOf(dest)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return errors.New("sqlite: ScanStruct destination must be a non-nil pointer to struct")
+	}
+	value = value.Elem()
+
+	colsCount := int(C.sqlite3_data_count(r.stmt.stmt))
+	if colsCount <= 0 {
+		return ErrNoRows
+	}
+
+	fields := structFields(value.Type())
+	for i := 0; i < colsCount; i++ {
+		name := C.GoString(C.sqlite3_column_name(r.stmt.stmt, C.int(i)))
+		index, ok := fields[name]
+		if !ok {
+			return errors.New("sqlite: no struct field for column \"" + name + "\"")
+		}
+		field := value.FieldByIndex(index).Addr().Interface()
+		err := assign(field, r.stmt.columnValue(i), r.stmt.conn.timeFormat)
+		if err == ErrColumnType {
+			return err
+		}
+		if err != nil {
+			return errors.New("sqlite: column \"" + name + "\": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ScanStruct сканирует первую строку в структуру dest. Более подробно можно
+// прочитать в описании метода Rows.ScanStruct.
+func (r *Row) ScanStruct(dest interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	err := r.rows.ScanStruct(dest)
+	r.rows.Close()
+	return err
+}
@@ -0,0 +1,165 @@
+package sqlite
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+type testMovie struct {
+	ID       int64          `sqlite:"id"`
+	Title    string         `sqlite:"title"`
+	Rating   float64        `sqlite:"rating"`
+	Released time.Time      `sqlite:"released"`
+	Note     sql.NullString `sqlite:"note"`
+	Ignored  string
+	Skipped  string `sqlite:"-"`
+}
+
+type testMovieRow struct {
+	testMovie
+	// Поле внешней структуры имеет приоритет над полем встроенной.
+	Title string `sqlite:"title"`
+	Count int    `sqlite:"count"`
+}
+
+func TestNamedParams(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE movie(id INTEGER PRIMARY KEY, title TEXT, rating REAL, released TEXT, note TEXT);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Параметры с разными префиксами и повторное использование параметра.
+	stmt, err := conn.Prepare("INSERT INTO movie(id, title, rating, released, note) VALUES(:id, @title, $rating, :released, :note || @title);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	released := time.Date(2020, time.May, 7, 0, 0, 0, 0, time.UTC)
+	movie := testMovie{ID: 1, Title: "Alien", Rating: 8.4, Released: released, Note: sql.NullString{String: "note ", Valid: true}}
+	_, err = stmt.Exec(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stmt.Exec(&testMovie{ID: 2, Title: "Aliens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stmt.Exec(map[string]interface{}{
+		"id":        3,
+		"@title":    "Alien 3",
+		"rating":    6.4,
+		":released": released,
+		"note":      nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Неизвестный параметр в map'е.
+	_, err = stmt.Exec(map[string]interface{}{"id": 4, "title": "", "rating": 0, "released": nil, "note": nil, "unknown": 1})
+	if err == nil {
+		t.Fatal("Expected error for unknown parameter")
+	}
+	// Параметр без значения.
+	_, err = stmt.Exec(map[string]interface{}{"id": 4, "title": "", "rating": 0, "released": nil})
+	if err == nil {
+		t.Fatal("Expected error for unbound parameter")
+	}
+	_, err = stmt.Exec(struct {
+		ID int64 `sqlite:"id"`
+	}{ID: 4})
+	if err == nil {
+		t.Fatal("Expected error for unbound struct parameter")
+	}
+	// Позиционные параметры нельзя подставить по имени.
+	positional, err := conn.Prepare("SELECT ?, :id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer positional.Close()
+	_, err = positional.Query(map[string]interface{}{"id": 1})
+	if err == nil {
+		t.Fatal("Expected error for positional parameter")
+	}
+
+	// Ошибочные запросы ничего не добавили.
+	var n int64
+	err = scanQuery(conn, "SELECT count(*) FROM movie;", &n)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 movies, got %d (%v)", n, err)
+	}
+
+	// ScanStruct.
+	query, err := conn.Prepare("SELECT id, title, rating, released, note FROM movie ORDER BY id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+	rows, err := query.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var movies []testMovie
+	for rows.Next() {
+		m := testMovie{Ignored: "ignored", Skipped: "skipped"}
+		err = rows.ScanStruct(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		movies = append(movies, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 3 {
+		t.Fatalf("Expected 3 movies, got %d", len(movies))
+	}
+	if movies[0].ID != 1 || movies[0].Title != "Alien" || movies[0].Rating != 8.4 || !movies[0].Released.Equal(released) ||
+		movies[0].Note.String != "note Alien" || movies[0].Ignored != "ignored" || movies[0].Skipped != "skipped" {
+		t.Fatalf("Unexpected first movie %+v", movies[0])
+	}
+	if movies[1].Title != "Aliens" || movies[1].Note.Valid || !movies[1].Released.IsZero() {
+		t.Fatalf("Unexpected second movie %+v", movies[1])
+	}
+	if movies[2].Title != "Alien 3" || movies[2].Rating != 6.4 || movies[2].Note.Valid {
+		t.Fatalf("Unexpected third movie %+v", movies[2])
+	}
+
+	// Встроенная структура и псевдонимы колонок.
+	row, err := conn.Prepare("SELECT id, title || '!' AS title, 42 AS count FROM movie WHERE id = :id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer row.Close()
+	var movieRow testMovieRow
+	err = row.QueryRow(map[string]interface{}{"id": 2}).ScanStruct(&movieRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movieRow.ID != 2 || movieRow.Title != "Aliens!" || movieRow.testMovie.Title != "" || movieRow.Count != 42 {
+		t.Fatalf("Unexpected movie row %+v", movieRow)
+	}
+
+	// Колонка без поля.
+	var short struct {
+		ID int64 `sqlite:"id"`
+	}
+	err = query.QueryRow().ScanStruct(&short)
+	if err == nil {
+		t.Fatal("Expected error for column without field")
+	}
+	err = query.QueryRow().ScanStruct(short)
+	if err == nil {
+		t.Fatal("Expected error for non-pointer destination")
+	}
+}
@@ -0,0 +1,160 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("sqlite: pool is already closed")
+
+// Pool - пул соединений с одной БД. Соединения открываются по мере
+// необходимости, но одновременно открыто не больше maxSize соединений.
+// Соединение берётся из пула методом Get и после окончания работы с ним
+// обязательно возвращается методом Put. У каждого соединения свой кэш
+// SQL-предложений (см. Conn.PrepareCached), поэтому соединение из пула не
+// нужно настраивать заново.
+// Методы Pool можно вызывать из разных горутин.
+type Pool struct {
+	dbFilename    string
+	busyTimeoutMS int
+	// Свободные соединения.
+	idle chan *Conn
+	// Семафор открытых соединений: в канале столько значений, сколько
+	// соединений открыто.
+	opened chan struct{}
+	// Закрывается при закрытии пула.
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPool создаёт пул соединений с БД из файла dbFilename, в котором
+// одновременно открыто не больше maxSize соединений. Сами соединения
+// открываются при вызове Get.
+func NewPool(dbFilename string, maxSize int) (*Pool, error) {
+	if maxSize < 1 {
+		return nil, errors.New("sqlite: pool size must be positive")
+	}
+
+	pool := &Pool{
+		dbFilename: dbFilename,
+		idle:       make(chan *Conn, maxSize),
+		opened:     make(chan struct{}, maxSize),
+		done:       make(chan struct{}),
+	}
+	return pool, nil
+}
+
+// SetBusyTimeout устанавливает таймаут ожидания занятой БД (см.
+// Conn.SetBusyTimeout) для соединений, которые будут открыты пулом.
+// Должен быть вызван до первого вызова Get.
+func (p *Pool) SetBusyTimeout(ms int) {
+	p.busyTimeoutMS = ms
+}
+
+// Get возвращает свободное соединение из пула. Если свободных соединений нет
+// и открыто уже максимальное количество соединений, то Get ждёт возвращения
+// соединения в пул или отмены ctx.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Свободное соединение предпочтительнее нового.
+	var conn *Conn
+	select {
+	case conn = <-p.idle:
+	default:
+		select {
+		case conn = <-p.idle:
+
+		case p.opened <- struct{}{}:
+			var err error
+			conn, err = p.open()
+			if err != nil {
+				<-p.opened
+				return nil, err
+			}
+
+		case <-p.done:
+			return nil, ErrPoolClosed
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// Пул мог быть закрыт, пока соединение открывалось.
+	select {
+	case <-p.done:
+		p.Put(conn)
+		return nil, ErrPoolClosed
+	default:
+		return conn, nil
+	}
+}
+
+// open открывает новое соединение пула.
+func (p *Pool) open() (*Conn, error) {
+	conn, err := NewConn(p.dbFilename)
+	if err != nil {
+		return nil, err
+	}
+	if p.busyTimeoutMS > 0 {
+		err = conn.SetBusyTimeout(p.busyTimeoutMS)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Put возвращает соединение conn, полученное методом Get, в пул. Если в
+// соединении осталась незавершённая транзакция, то она откатывается. После
+// вызова Put соединение conn использовать нельзя.
+func (p *Pool) Put(conn *Conn) {
+	if conn.db != nil {
+		conn.resetStmts()
+		if conn.inTransaction() {
+			conn.Rollback()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || conn.db == nil {
+		conn.Close()
+		<-p.opened
+		return
+	}
+	// В idle помещаются все соединения пула, поэтому запись не блокируется.
+	p.idle <- conn
+}
+
+// Close закрывает свободные соединения пула. Соединения, которые ещё не
+// возвращены в пул, закрываются при их возвращении методом Put. После
+// закрытия пула Get возвращает ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+
+	var err error
+	for {
+		select {
+		case conn := <-p.idle:
+			if closeErr := conn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			<-p.opened
+		default:
+			return err
+		}
+	}
+}
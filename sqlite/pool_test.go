@@ -0,0 +1,153 @@
+package sqlite
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	defer cleanup()
+
+	pool, err := NewPool(dbName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.SetBusyTimeout(5000)
+
+	ctx := context.Background()
+	conn1, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn1.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := conn1.PrepareCached("INSERT INTO test(n) VALUES(?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn1 == conn2 {
+		t.Fatal("Pool returned the same connection twice")
+	}
+
+	// Все соединения заняты, поэтому Get ждёт до отмены контекста.
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	_, err = pool.Get(timeoutCtx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Незавершённая транзакция откатывается при возвращении соединения в
+	// пул, а кэш SQL-предложений сохраняется.
+	err = conn1.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stmt.Exec(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn1)
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != conn1 {
+		t.Fatal("Expected idle connection to be reused")
+	}
+	cachedStmt, err := conn.PrepareCached("INSERT INTO test(n) VALUES(?);")
+	if err != nil || cachedStmt != stmt {
+		t.Fatalf("Expected cached statement (%v)", err)
+	}
+	var count int64
+	err = scanQuery(conn, "SELECT count(*) FROM test;", &count)
+	if err != nil || count != 0 {
+		t.Fatalf("Expected rolled back transaction, got %d rows (%v)", count, err)
+	}
+	pool.Put(conn)
+	pool.Put(conn2)
+
+	// Закрытый пул не выдаёт соединений.
+	err = pool.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Get(ctx)
+	if err != ErrPoolClosed {
+		t.Fatalf("Expected ErrPoolClosed, got %v", err)
+	}
+
+	_, err = NewPool(dbName, 0)
+	if err == nil {
+		t.Fatal("Expected error for zero pool size, got nil")
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	defer cleanup()
+
+	pool, err := NewPool(dbName, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.SetBusyTimeout(5000)
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn)
+
+	// Горутин больше, чем соединений в пуле.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := pool.Get(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer pool.Put(conn)
+			stmt, err := conn.PrepareCached("INSERT INTO test(n) VALUES(?);")
+			if err == nil {
+				_, err = stmt.Exec(i)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(conn)
+	var count int64
+	err = scanQuery(conn, "SELECT count(*) FROM test;", &count)
+	if err != nil || count != 10 {
+		t.Fatalf("Expected 10 rows, got %d (%v)", count, err)
+	}
+}
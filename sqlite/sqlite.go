@@ -9,9 +9,8 @@ package sqlite
 */
 import "C"
 import (
+	"context"
 	"errors"
-	"fmt"
-	"reflect"
 	"strconv"
 	"unsafe"
 )
@@ -29,6 +28,9 @@ type Rows struct {
 	stmt *Stmt
 	done bool
 	err  error
+	// Контекст запроса и функция остановки слежения за ним (см. Conn.watch).
+	ctx  context.Context
+	stop func()
 }
 
 // Next переходит к следующей строке запроса, которую можно вычитать с помощью
@@ -53,7 +55,7 @@ func (r *Rows) Next() bool {
 			return true
 
 		default:
-			r.err = err
+			r.err = contextError(r.ctx, err)
 		}
 	} else {
 		// Пока Rows не дошёл до конца был закрыт Stmt, из которого и был
@@ -61,18 +63,39 @@ func (r *Rows) Next() bool {
 		r.err = ErrStmtDone
 	}
 
+	// Больше строк не будет, поэтому запрос уже не нужно прерывать.
+	r.stopWatch()
 	return false
 }
 
+// stopWatch прекращает слежение за контекстом запроса.
+func (r *Rows) stopWatch() {
+	if r.stop != nil {
+		r.stop()
+		r.stop = nil
+	}
+}
+
 // Err возвращает последнюю ошибку, которая могла возникнуть после вызова Next.
 func (r *Rows) Err() error {
 	return r.err
 }
 
 // Scan сканирует по очереди колонки в текущей строке в указатели из dest.
-// Указатели могут быть типа *int64, *float64, *string, *[]byte для получения
-// значения целочисленной, вещественной, строковой или бинарной колонки
-// соответственно.
+// Указатели могут быть на:
+//   - целые и вещественные числа любого типа, bool, string, []byte,
+//     time.Time;
+//   - interface{}, тогда в него записывается int64, float64, string, []byte
+//     или nil в зависимости от типа значения колонки;
+//   - указатель на один из перечисленных типов (например, **int64), тогда
+//     для NULL в него записывается nil;
+//   - тип, реализующий sql.Scanner (например, sql.NullString).
+//
+// Значения колонок преобразуются по правилам SQLite: например, строка "42"
+// сканируется в int64, а число - в string. NULL сканируется как нулевое
+// значение типа. Время может храниться как строка (в формате соединения,
+// см. Conn.SetTimeFormat, или в любом формате, который понимает SQLite), как
+// время Unix в секундах или как юлианский день.
 func (r *Rows) Scan(dest ...interface{}) error {
 	if r.stmt.stmt == nil {
 		return ErrStmtDone
@@ -88,38 +111,12 @@ func (r *Rows) Scan(dest ...interface{}) error {
 	}
 
 	for i := range dest {
-		colNum := C.int(i)
-		colType := C.sqlite3_column_type(r.stmt.stmt, colNum)
-		switch value := dest[i].(type) {
-		case *int64:
-			if colType != C.SQLITE_INTEGER {
-				return errors.New("sqlite: column " + strconv.Itoa(i) + " isn't INTEGER (it's " + sqliteColumnTypeToString(colType) + ")")
-			}
-			*value = int64(C.sqlite3_column_int64(r.stmt.stmt, colNum))
-
-		case *float64:
-			if colType != C.SQLITE_FLOAT {
-				return errors.New("sqlite: column " + strconv.Itoa(i) + " isn't REAL (it's " + sqliteColumnTypeToString(colType) + ")")
-			}
-			*value = float64(C.sqlite3_column_double(r.stmt.stmt, colNum))
-
-		case *string:
-			if colType != C.SQLITE_TEXT {
-				return errors.New("sqlite: column " + strconv.Itoa(i) + " isn't TEXT (it's " + sqliteColumnTypeToString(colType) + ")")
-			}
-			cStr := C.sqlite3_column_text(r.stmt.stmt, colNum)
-			*value = C.GoString((*C.char)(unsafe.Pointer(cStr)))
-
-		case *[]byte:
-			if colType != C.SQLITE_BLOB {
-				return errors.New("sqlite: column " + strconv.Itoa(i) + " isn't BLOB (it's " + sqliteColumnTypeToString(colType) + ")")
-			}
-			blob := C.sqlite3_column_blob(r.stmt.stmt, colNum)
-			blobSize := C.sqlite3_column_bytes(r.stmt.stmt, colNum)
-			*value = C.GoBytes(blob, blobSize)
-
-		default:
-			return ErrColumnType
+		err := assign(dest[i], r.stmt.columnValue(i), r.stmt.conn.timeFormat)
+		if err == ErrColumnType {
+			return err
+		}
+		if err != nil {
+			return errors.New("sqlite: column " + strconv.Itoa(i) + ": " + err.Error())
 		}
 	}
 
@@ -128,6 +125,7 @@ func (r *Rows) Scan(dest ...interface{}) error {
 
 // Close закрывает Rows.
 func (r *Rows) Close() error {
+	r.stopWatch()
 	if r.stmt.stmt == nil {
 		return ErrStmtDone
 	}
@@ -198,22 +196,34 @@ type Stmt struct {
 // подставляются в предложение перед его выполнением. Какого типа аргументы
 // можно передавать можно узнать в описании метода Stmt.bind.
 func (s *Stmt) Exec(args ...interface{}) (Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+// ExecContext работает как Exec, но прерывает выполнение SQL-предложения при
+// отмене ctx или истечении его дедлайна. В этом случае возвращается ошибка
+// типа *ContextError.
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (Result, error) {
 	if s.stmt == nil {
 		return nil, ErrStmtDone
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, &ContextError{Err: err}
+	}
 
 	err := s.bind(args...)
 	if err != nil {
 		return nil, err
 	}
 
+	stop := s.conn.watch(ctx)
 	resCode := C.sqlite3_step(s.stmt)
+	stop()
 	err = resultCode2GoError(resCode)
 	if err == SQLiteDone {
 		return &sqliteResult{conn: s.conn}, nil
 	}
 
-	return nil, err
+	return nil, contextError(ctx, err)
 }
 
 // Query выполняет скомпилированный запрос. Аргументы args подставляются в
@@ -221,16 +231,27 @@ func (s *Stmt) Exec(args ...interface{}) (Result, error) {
 // узнать в описании метода Stmt.bind. Если нет ошибок, то *Rows позволяет
 // получить все строки выполненного запроса.
 func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+// QueryContext работает как Query, но прерывает выполнение запроса при
+// отмене ctx или истечении его дедлайна, пока строки результата не
+// вычитаны до конца или не закрыт *Rows. В этом случае Rows.Err возвращает
+// ошибку типа *ContextError.
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*Rows, error) {
 	if s.stmt == nil {
 		return nil, ErrStmtDone
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, &ContextError{Err: err}
+	}
 
 	err := s.bind(args...)
 	if err != nil {
 		return nil, err
 	}
 
-	rows := Rows{stmt: s, done: false, err: nil}
+	rows := Rows{stmt: s, done: false, err: nil, ctx: ctx, stop: s.conn.watch(ctx)}
 	return &rows, nil
 }
 
@@ -241,7 +262,13 @@ func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
 // множество строк, то Scan для *Row возвращает ErrNoRows. Иначе Scan сканирует
 // первую строку и игнорирует остальные.
 func (s *Stmt) QueryRow(args ...interface{}) *Row {
-	rows, err := s.Query(args...)
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+// QueryRowContext работает как QueryRow, но прерывает выполнение запроса при
+// отмене ctx или истечении его дедлайна.
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *Row {
+	rows, err := s.QueryContext(ctx, args...)
 	switch {
 	case err != nil:
 		return &Row{rows: nil, err: err}
@@ -257,9 +284,31 @@ func (s *Stmt) QueryRow(args ...interface{}) *Row {
 	}
 }
 
-// bind подставляет аргументы args с SQL-предложение. args может содержать
-// только значения типа int, int64, float64, string или []byte.
+// bind подставляет аргументы args с SQL-предложение. Допустимые типы
+// аргументов перечислены в описании метода bindValue. Если передан один
+// аргумент типа map[string]interface{} или структура (указатель на структуру),
+// то значения подставляются в именованные параметры (см. Stmt.bindNamed).
 func (s *Stmt) bind(args ...interface{}) error {
+	err := s.clearBindings()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 && namedArg(args[0]) {
+		return s.bindNamed(args[0])
+	}
+	for i, arg := range args {
+		err = s.bindValue(i+1, arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearBindings сбрасывает s.stmt в начало и очищает подстановки.
+func (s *Stmt) clearBindings() error {
 	if s.stmt == nil {
 		return ErrStmtDone
 	}
@@ -273,65 +322,7 @@ func (s *Stmt) bind(args ...interface{}) error {
 
 	// Очищаем подставновки (sqlite3_reset этого не делает).
 	resCode = C.sqlite3_clear_bindings(s.stmt)
-	err = resultCode2GoError(resCode)
-	if err != nil {
-		return err
-	}
-
-	for i, arg := range args {
-		argType := reflect.TypeOf(arg)
-		switch argType.Kind() {
-		case reflect.Bool:
-			v := 0
-			if arg.(bool) {
-				v = 1
-			}
-			resCode = C.sqlite3_bind_int(s.stmt, C.int(i+1), C.int(v))
-
-		case reflect.Int:
-			resCode = C.sqlite3_bind_int(s.stmt, C.int(i+1), C.int(arg.(int)))
-
-		case reflect.Int64:
-			resCode = C.sqlite3_bind_int64(s.stmt, C.int(i+1), C.sqlite3_int64(arg.(int64)))
-
-		case reflect.Float64:
-			resCode = C.sqlite3_bind_double(s.stmt, C.int(i+1), C.double(arg.(float64)))
-
-		case reflect.String:
-			str := arg.(string)
-			cStr := C.CString(str)
-			defer C.free(unsafe.Pointer(cStr))
-			// C.SQLITE_TRANSIENT приводит к копированию строки во внутреннюю
-			// память SQLite. Так и не смог понять из документации
-			// (https://www.sqlite.org/c3ref/bind_blob.html), когда безопасно
-			// освобождать передаваемый в SQLite указатель на строку cStr.
-			resCode = C.sqlite3_bind_text(s.stmt, C.int(i+1), cStr, C.int(len(str)), C.SQLITE_TRANSIENT)
-
-		case reflect.Slice:
-			if argType.Elem().Kind() != reflect.Uint8 { // не []byte
-				argTypeStr := fmt.Sprintf("%T", arg)
-				return errors.New("sqlite: unsupported type (" + argTypeStr + ")")
-			}
-			data := arg.([]byte)
-			cData := C.CBytes(data)
-			defer C.free(unsafe.Pointer(cData))
-			// C.SQLITE_TRANSIENT приводит к копированию данных слайса во
-			// внутреннюю память SQLite. Так и не смог понять из документации
-			// (https://www.sqlite.org/c3ref/bind_blob.html), когда безопасно
-			// освобождать передаваемый в SQLite указатель на данные cData.
-			resCode = C.sqlite3_bind_blob(s.stmt, C.int(i+1), cData, C.int(len(data)), C.SQLITE_TRANSIENT)
-
-		default:
-			argTypeStr := fmt.Sprintf("%T", arg)
-			return errors.New("sqlite: unsupported type (" + argTypeStr + ")")
-		}
-		err := resultCode2GoError(resCode)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return resultCode2GoError(resCode)
 }
 
 // Close освобождает ресурсы, выделенные под SQL-предложение.
@@ -352,7 +343,11 @@ func (s *Stmt) Close() error {
 
 // Conn - это одно соединение с БД.
 type Conn struct {
-	db *C.struct_sqlite3
+	db         *C.struct_sqlite3
+	timeFormat string // Формат, в котором time.Time подставляется в запросы.
+	// Кэш SQL-предложений, скомпилированных методом PrepareCached.
+	// Индексирование идёт по тексту запроса.
+	stmts map[string]*Stmt
 }
 
 // NewConn создаёт новое соединение с БД. dbFilename является названием файла
@@ -363,7 +358,7 @@ func NewConn(dbFilename string) (*Conn, error) {
 	dbFilenameCStr := C.CString(dbFilename)
 	defer C.free(unsafe.Pointer(dbFilenameCStr))
 
-	conn := new(Conn)
+	conn := &Conn{timeFormat: TimeFormat}
 	resCode := C.sqlite3_open(dbFilenameCStr, &conn.db)
 	err := resultCode2GoError(resCode)
 	if err != nil {
@@ -376,16 +371,28 @@ func NewConn(dbFilename string) (*Conn, error) {
 
 // Exec выполняет запрос query.
 func (c *Conn) Exec(query string) (Result, error) {
+	return c.ExecContext(context.Background(), query)
+}
+
+// ExecContext работает как Exec, но прерывает выполнение запроса при отмене
+// ctx или истечении его дедлайна. В этом случае возвращается ошибка типа
+// *ContextError.
+func (c *Conn) ExecContext(ctx context.Context, query string) (Result, error) {
 	if c.db == nil {
 		return nil, ErrConnDone
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, &ContextError{Err: err}
+	}
 
 	queryCStr := C.CString(query)
 	defer C.free(unsafe.Pointer(queryCStr))
+	stop := c.watch(ctx)
 	resCode := C.sqlite3_exec(c.db, queryCStr, nil, nil, nil)
+	stop()
 	err := resultCode2GoError(resCode)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 
 	return &sqliteResult{conn: c}, nil
@@ -410,6 +417,28 @@ func (c *Conn) Prepare(query string) (*Stmt, error) {
 	return stmt, nil
 }
 
+// PrepareCached компилирует запрос query или возвращает уже
+// скомпилированное этим методом SQL-предложение с тем же текстом. Такие
+// SQL-предложения не нужно закрывать - они закрываются вместе с
+// соединением. Удобно для соединений из пула, которые используются разными
+// горутинами по очереди, т.к. каждый запрос компилируется один раз на
+// соединение.
+func (c *Conn) PrepareCached(query string) (*Stmt, error) {
+	if stmt, ok := c.stmts[query]; ok && stmt.stmt != nil {
+		return stmt, nil
+	}
+
+	stmt, err := c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = map[string]*Stmt{}
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
 // SetBusyTimeout устанавливает таймаут ожидания выполнения запроса, если БД
 // была в этот момент занята чем-то другим.
 func (c *Conn) SetBusyTimeout(ms int) error {
@@ -418,7 +447,16 @@ func (c *Conn) SetBusyTimeout(ms int) error {
 	return err
 }
 
-// Begin начинает транзакцию.
+// SetTimeFormat устанавливает формат layout (в виде, принятом в пакете time),
+// в котором значения типа time.Time подставляются в запросы. При сканировании
+// времени этот формат пробуется первым. По-умолчанию используется TimeFormat.
+func (c *Conn) SetTimeFormat(layout string) {
+	c.timeFormat = layout
+}
+
+// Begin начинает транзакцию. Для выбора режима транзакции и точек
+// сохранения используется BeginTx, а для повтора транзакции при занятой БД -
+// WithTx.
 func (c *Conn) Begin() error {
 	_, err := c.Exec("BEGIN TRANSACTION;")
 	return err
@@ -439,12 +477,21 @@ func (c *Conn) Rollback() error {
 // Close закрывает соединение с БД. Должен быть объязательно вызван после
 // окончания работ с соединением, чтобы не было утечек ресурсов. Нельзя
 // закрыть соединение пока есть не закрытые Stmt, которые были созданы из этого
-// соединения.
+// соединения методом Prepare (SQL-предложения из PrepareCached закрываются
+// автоматически).
 func (c *Conn) Close() error {
 	if c.db == nil {
 		return nil
 	}
 
+	for query, stmt := range c.stmts {
+		err := stmt.Close()
+		if err != nil {
+			return err
+		}
+		delete(c.stmts, query)
+	}
+
 	resCode := C.sqlite3_close(c.db)
 	err := resultCode2GoError(resCode)
 	if err != nil {
@@ -455,29 +502,23 @@ func (c *Conn) Close() error {
 	return nil
 }
 
-// Version возвращает версию библиотеки SQLite.
-func Version() string {
-	return C.GoString(C.sqlite3_libversion())
+// inTransaction возвращает true, если в соединении начата и не завершена
+// транзакция.
+func (c *Conn) inTransaction() bool {
+	return C.sqlite3_get_autocommit(c.db) == 0
 }
 
-// sqliteColumnTypeToString преобразовывает тип SQLite в строковый вид.
-func sqliteColumnTypeToString(columnType C.int) string {
-	switch columnType {
-	case C.SQLITE_INTEGER:
-		return "INTEGER"
-
-	case C.SQLITE_FLOAT:
-		return "REAL"
-
-	case C.SQLITE_TEXT:
-		return "TEXT"
-
-	case C.SQLITE_BLOB:
-		return "BLOB"
-
-	case C.SQLITE_NULL:
-		return "NULL"
+// resetStmts сбрасывает в начало все SQL-предложения из кэша PrepareCached,
+// чтобы не вычитанные до конца запросы не удерживали блокировки БД.
+func (c *Conn) resetStmts() {
+	for _, stmt := range c.stmts {
+		if stmt.stmt != nil {
+			C.sqlite3_reset(stmt.stmt)
+		}
 	}
+}
 
-	return "UNKNOWN"
+// Version возвращает версию библиотеки SQLite.
+func Version() string {
+	return C.GoString(C.sqlite3_libversion())
 }
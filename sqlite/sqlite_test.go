@@ -1,10 +1,13 @@
 package sqlite
 
 import (
+	"database/sql"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var dbName = "test.db"
@@ -269,6 +272,254 @@ func TestRowScan(t *testing.T) {
 	}
 }
 
+func TestScanNull(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER, f REAL, t TEXT, b BLOB);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertStmt, err := conn.Prepare("INSERT INTO test(n, f, t, b) VALUES(?, ?, ?, ?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insertStmt.Close()
+	var nilInt *int
+	_, err = insertStmt.Exec(nil, nilInt, sql.NullString{}, []byte(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, f, str := 42, 1.5, "foo"
+	_, err = insertStmt.Exec(&n, &f, &str, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selectStmt, err := conn.Prepare("SELECT n, f, t, b FROM test ORDER BY rowid;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer selectStmt.Close()
+	rows, err := selectStmt.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NULL сканируется в nil для указателей на указатели и в нулевое значение
+	// для остальных типов.
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	nPtr, fPtr, strPtr := &n, &f, &str
+	var nullStr sql.NullString
+	var b []byte = []byte{1}
+	err = rows.Scan(&nPtr, &fPtr, &nullStr, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nPtr != nil || fPtr != nil || nullStr.Valid || b != nil {
+		t.Fatalf("Unexpected NULL values %v %v %v %v", nPtr, fPtr, nullStr, b)
+	}
+
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	var nValue int
+	var raw interface{}
+	err = rows.Scan(&nPtr, &nValue, &strPtr, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Пустой []byte сохраняется как BLOB нулевой длины, а не NULL.
+	if nPtr == nil || *nPtr != 42 || nValue != 1 || strPtr == nil || *strPtr != "foo" || !reflect.DeepEqual(raw, []byte{}) {
+		t.Fatalf("Unexpected values %v %v %v %#v", nPtr, nValue, strPtr, raw)
+	}
+	rows.Close()
+
+	var zero int64 = 7
+	var zeroStr string = "bar"
+	err = scanQuery(conn, "SELECT NULL, NULL;", &zero, &zeroStr)
+	if err != nil || zero != 0 || zeroStr != "" {
+		t.Fatalf("Unexpected NULL values %v %q (%v)", zero, zeroStr, err)
+	}
+}
+
+func TestScanConversions(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var (
+		i8  int8
+		u16 uint16
+		u   uint
+		i   int
+		f32 float32
+		b   bool
+		s   string
+		bs  []byte
+	)
+	err = scanQuery(conn, "SELECT 100, 65535, 7, '42', ' 3.75 ', 'true', 2.0, 17;", &i8, &u16, &u, &i, &f32, &b, &s, &bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i8 != 100 || u16 != 65535 || u != 7 || i != 42 || f32 != 3.75 || !b || s != "2.0" || string(bs) != "17" {
+		t.Fatalf("Unexpected values %v %v %v %v %v %v %q %q", i8, u16, u, i, f32, b, s, bs)
+	}
+
+	// Вещественное число округляется к нулю, 0 - это false.
+	err = scanQuery(conn, "SELECT 2.9, '-1.5', 0;", &i, &i8, &b)
+	if err != nil || i != 2 || i8 != -1 || b {
+		t.Fatalf("Unexpected values %v %v %v (%v)", i, i8, b, err)
+	}
+
+	// Ошибки преобразования.
+	for _, test := range []struct {
+		query string
+		dest  interface{}
+	}{
+		{"SELECT 128;", &i8},
+		{"SELECT -1;", &u},
+		{"SELECT 65536;", &u16},
+		{"SELECT 'foo';", &i},
+		{"SELECT x'00';", &f32},
+		{"SELECT 'maybe';", &b},
+	} {
+		err = scanQuery(conn, test.query, test.dest)
+		if err == nil {
+			t.Fatalf("Expected conversion error for %q into %T, got nil", test.query, test.dest)
+		}
+	}
+	var ch chan int
+	err = scanQuery(conn, "SELECT 1;", &ch)
+	if err != ErrColumnType {
+		t.Fatalf("Expected ErrColumnType, got %v", err)
+	}
+}
+
+func TestBindTypes(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	type myString string
+	stmt, err := conn.Prepare("SELECT ?, ?, ?, ?, ?, ?, typeof(?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var (
+		u64 uint64
+		i8  int8
+		f32 float32
+		b   bool
+		s   myString
+		v   sql.NullInt64
+		typ string
+	)
+	err = stmt.QueryRow(uint64(math.MaxInt64), int8(-5), float32(0.5), true, myString("foo"), sql.NullInt64{Int64: 3, Valid: true}, nil).
+		Scan(&u64, &i8, &f32, &b, &s, &v, &typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u64 != math.MaxInt64 || i8 != -5 || f32 != 0.5 || !b || s != "foo" || v.Int64 != 3 || typ != "null" {
+		t.Fatalf("Unexpected values %v %v %v %v %v %v %v", u64, i8, f32, b, s, v, typ)
+	}
+
+	_, err = stmt.Exec(uint64(math.MaxInt64)+1, 0, 0, 0, 0, 0, 0)
+	if err == nil {
+		t.Fatal("Expected error for uint64 overflow, got nil")
+	}
+	_, err = stmt.Exec(struct{}{}, 0, 0, 0, 0, 0, 0)
+	if err == nil {
+		t.Fatal("Expected error for unsupported type, got nil")
+	}
+}
+
+func TestTime(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Время сохраняется и сканируется без потерь.
+	moscow := time.FixedZone("MSK", 3*60*60)
+	date := time.Date(2020, time.May, 7, 10, 30, 15, 123456789, moscow)
+	stmt, err := conn.Prepare("SELECT ?, datetime(?);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var scanned time.Time
+	var utc string
+	err = stmt.QueryRow(date, date).Scan(&scanned, &utc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanned.Equal(date) || utc != "2020-05-07 07:30:15" {
+		t.Fatalf("Unexpected time %v, %q", scanned, utc)
+	}
+
+	// Форматы функций SQLite, время Unix и юлианский день.
+	var fromDatetime, fromDate, fromUnix, fromJulian time.Time
+	var nullTime *time.Time = &date
+	err = scanQuery(conn, "SELECT datetime(1588847415, 'unixepoch'), '2020-05-07', 1588847415, julianday(1588847415, 'unixepoch'), NULL;",
+		&fromDatetime, &fromDate, &fromUnix, &fromJulian, &nullTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := time.Unix(1588847415, 0)
+	if !fromDatetime.Equal(unix) || !fromUnix.Equal(unix) || fromJulian.Sub(unix) > time.Millisecond || unix.Sub(fromJulian) > time.Millisecond || nullTime != nil {
+		t.Fatalf("Unexpected times %v %v %v %v", fromDatetime, fromUnix, fromJulian, nullTime)
+	}
+	if !fromDate.Equal(time.Date(2020, time.May, 7, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected date %v", fromDate)
+	}
+
+	// Собственный формат времени соединения.
+	conn.SetTimeFormat(time.RFC1123Z)
+	var text string
+	err = stmt.QueryRow(date, date).Scan(&text, &utc)
+	if err != nil || text != date.Format(time.RFC1123Z) {
+		t.Fatalf("Unexpected time text %q (%v)", text, err)
+	}
+	err = stmt.QueryRow(date, date).Scan(&scanned, &utc)
+	if err != nil || !scanned.Equal(date.Truncate(time.Second)) {
+		t.Fatalf("Unexpected time %v (%v)", scanned, err)
+	}
+	err = scanQuery(conn, "SELECT 'yesterday';", &scanned)
+	if err == nil {
+		t.Fatal("Expected error for incorrect time, got nil")
+	}
+}
+
+// scanQuery выполняет запрос query и сканирует его первую строку в dest.
+func scanQuery(conn *Conn, query string, dest ...interface{}) error {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return stmt.QueryRow().Scan(dest...)
+}
+
 func cleanup() {
 	_, err := os.Stat(dbName)
 	if err == nil {
@@ -0,0 +1,214 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// TxMode - это режим начала транзакции (см. https://sqlite.org/lang_transaction.html).
+type TxMode int
+
+const (
+	// Deferred - блокировки берутся при первом обращении к БД: на чтение
+	// при первом чтении, на запись при первой записи.
+	Deferred TxMode = iota
+	// Immediate - блокировка на запись берётся сразу, поэтому другие
+	// соединения не могут начать запись до окончания транзакции. Такие
+	// транзакции не получают SQLITE_BUSY посреди транзакции при переходе от
+	// чтения к записи.
+	Immediate
+	// Exclusive - как Immediate, но в режиме журнала, отличном от WAL, другие
+	// соединения не могут и читать БД.
+	Exclusive
+)
+
+const (
+	// Количество повторов транзакции в WithTx, если БД занята.
+	txBusyRetries = 5
+	// Пауза перед первым повтором транзакции. Каждая следующая пауза вдвое
+	// больше предыдущей.
+	txBusyRetryPause = time.Millisecond * 50
+)
+
+var ErrTxDone = errors.New("sqlite: transaction has already been committed or rolled back")
+
+// Tx - это транзакция соединения, начатая методом Conn.BeginTx. Запросы
+// транзакции выполняются обычными методами соединения и его SQL-предложений.
+// Внутри транзакции можно создавать вложенные точки сохранения (SAVEPOINT).
+type Tx struct {
+	conn *Conn
+	done bool
+	// Стек названий точек сохранения, последняя - самая вложенная.
+	savepoints []string
+}
+
+// BeginTx начинает транзакцию в режиме mode.
+func (c *Conn) BeginTx(mode TxMode) (*Tx, error) {
+	var query string
+	switch mode {
+	case Deferred:
+		query = "BEGIN DEFERRED TRANSACTION;"
+	case Immediate:
+		query = "BEGIN IMMEDIATE TRANSACTION;"
+	case Exclusive:
+		query = "BEGIN EXCLUSIVE TRANSACTION;"
+	default:
+		return nil, errors.New("sqlite: unknown transaction mode")
+	}
+
+	_, err := c.Exec(query)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{conn: c}, nil
+}
+
+// Commit завершает транзакцию. Если Commit вернул ErrBusy, то транзакция
+// остаётся незавершённой и её можно завершить повторным вызовом Commit или
+// откатить методом Rollback.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	_, err := tx.conn.Exec("COMMIT;")
+	if err != nil {
+		return err
+	}
+	tx.done = true
+	return nil
+}
+
+// Rollback откатывает изменения транзакции.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.done = true
+	// Транзакция может быть уже откачена самим SQLite, например, при
+	// SQLITE_FULL или SQLITE_IOERR. Тогда ROLLBACK вернул бы ошибку.
+	if !tx.conn.inTransaction() {
+		return nil
+	}
+	_, err := tx.conn.Exec("ROLLBACK;")
+	return err
+}
+
+// Savepoint создаёт точку сохранения name внутри транзакции. Точки
+// сохранения могут быть вложенными.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	_, err := tx.conn.Exec("SAVEPOINT " + quoteIdent(name) + ";")
+	if err != nil {
+		return err
+	}
+	tx.savepoints = append(tx.savepoints, name)
+	return nil
+}
+
+// Release удаляет точку сохранения name и все вложенные в неё точки. Изменения
+// после этих точек остаются в транзакции.
+func (tx *Tx) Release(name string) error {
+	i, err := tx.savepoint(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.conn.Exec("RELEASE SAVEPOINT " + quoteIdent(name) + ";")
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// RollbackTo откатывает изменения, сделанные после создания точки сохранения
+// name. Вложенные в name точки удаляются, а сама точка name остаётся, так что
+// к ней можно снова откатиться или удалить её методом Release.
+func (tx *Tx) RollbackTo(name string) error {
+	i, err := tx.savepoint(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.conn.Exec("ROLLBACK TRANSACTION TO SAVEPOINT " + quoteIdent(name) + ";")
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// savepoint возвращает позицию самой вложенной точки сохранения name в стеке
+// tx.savepoints.
+func (tx *Tx) savepoint(name string) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i] == name {
+			return i, nil
+		}
+	}
+	return 0, errors.New("sqlite: no such savepoint \"" + name + "\"")
+}
+
+// WithTx выполняет f в транзакции в режиме mode. Если f вернула nil, то
+// транзакция завершается, иначе откатывается и возвращается ошибка f. Если
+// БД оказалась занята (ErrBusy) при начале транзакции, в f или при её
+// завершении, то транзакция откатывается и f выполняется заново после паузы,
+// но не больше txBusyRetries раз. Поэтому f не должна иметь побочных
+// эффектов вне БД, которые нельзя повторять. ctx прерывает ожидание перед
+// повтором.
+func (c *Conn) WithTx(ctx context.Context, mode TxMode, f func(tx *Tx) error) error {
+	pause := txBusyRetryPause
+	for retry := 0; ; retry++ {
+		err := c.runTx(mode, f)
+		if !errors.Is(err, ErrBusy) || retry == txBusyRetries {
+			return err
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &ContextError{Err: ctx.Err()}
+		}
+		pause *= 2
+	}
+}
+
+// runTx выполняет одну попытку транзакции WithTx. Если f паникует, то
+// транзакция откатывается.
+func (c *Conn) runTx(mode TxMode, f func(tx *Tx) error) (err error) {
+	tx, err := c.BeginTx(mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !tx.done {
+			// Ошибка отката не так важна, как ошибка, из-за которой
+			// транзакция откатывается.
+			tx.Rollback()
+		}
+	}()
+
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// quoteIdent заключает идентификатор name в двойные кавычки.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
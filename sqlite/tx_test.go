@@ -0,0 +1,202 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTx(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(n int) {
+		t.Helper()
+		_, err := conn.Exec("INSERT INTO test(n) VALUES(" + strconv.Itoa(n) + ");")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int64 {
+		t.Helper()
+		var n int64
+		err := scanQuery(conn, "SELECT count(*) FROM test;", &n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, mode := range []TxMode{Deferred, Immediate, Exclusive} {
+		tx, err := conn.BeginTx(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		insert(1)
+		err = tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(); n != 0 {
+			t.Fatalf("Expected no rows after rollback in mode %d, got %d", mode, n)
+		}
+		if tx.Commit() != ErrTxDone || tx.Rollback() != ErrTxDone {
+			t.Fatal("Expected ErrTxDone for finished transaction")
+		}
+	}
+	_, err = conn.BeginTx(TxMode(42))
+	if err == nil {
+		t.Fatal("Expected error for unknown transaction mode")
+	}
+
+	// Вложенные точки сохранения.
+	tx, err := conn.BeginTx(Immediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(1)
+	err = tx.Savepoint("outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(2)
+	err = tx.Savepoint(`in"ner`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(3)
+	// Откат к внешней точке удаляет вложенную.
+	err = tx.RollbackTo("outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("Expected 1 row after rollback to savepoint, got %d", n)
+	}
+	if tx.Release(`in"ner`) == nil {
+		t.Fatal("Expected error for removed savepoint")
+	}
+	insert(4)
+	err = tx.Savepoint("inner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(5)
+	err = tx.Release("outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.RollbackTo("inner") == nil {
+		t.Fatal("Expected error for released savepoint")
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Fatalf("Expected 3 rows after commit, got %d", n)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	defer cleanup()
+
+	conn, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE test(n INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ошибка f откатывает транзакцию.
+	errTest := errors.New("test error")
+	err = conn.WithTx(context.Background(), Deferred, func(tx *Tx) error {
+		_, err := conn.Exec("INSERT INTO test(n) VALUES(1);")
+		if err != nil {
+			return err
+		}
+		return errTest
+	})
+	if err != errTest {
+		t.Fatalf("Expected test error, got %v", err)
+	}
+	// Паника в f тоже откатывает транзакцию.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected panic")
+			}
+		}()
+		conn.WithTx(context.Background(), Deferred, func(tx *Tx) error {
+			conn.Exec("INSERT INTO test(n) VALUES(1);")
+			panic("test panic")
+		})
+	}()
+	if conn.inTransaction() {
+		t.Fatal("Transaction is not finished")
+	}
+	var n int64
+	err = scanQuery(conn, "SELECT count(*) FROM test;", &n)
+	if err != nil || n != 0 {
+		t.Fatalf("Expected no rows after rollback, got %d (%v)", n, err)
+	}
+
+	// Транзакция повторяется, пока БД занята другим соединением.
+	other, err := NewConn(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	otherTx, err := other.BeginTx(Immediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(txBusyRetryPause * 2)
+		otherTx.Commit()
+	}()
+	attempts := 0
+	err = conn.WithTx(context.Background(), Immediate, func(tx *Tx) error {
+		attempts++
+		_, err := conn.Exec("INSERT INTO test(n) VALUES(1);")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected f to be called once after BEGIN succeeded, got %d", attempts)
+	}
+	err = scanQuery(conn, "SELECT count(*) FROM test;", &n)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 row, got %d (%v)", n, err)
+	}
+
+	// Ожидание повтора прерывается контекстом.
+	otherTx, err = other.BeginTx(Immediate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherTx.Rollback()
+	ctx, cancel := context.WithTimeout(context.Background(), txBusyRetryPause/2)
+	defer cancel()
+	err = conn.WithTx(ctx, Immediate, func(tx *Tx) error {
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
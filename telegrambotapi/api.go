@@ -2,14 +2,27 @@ package telegrambotapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
+// Error - ошибка, которую вернул Telegram Bot API в ответ на запрос.
+type Error struct {
+	Code        int    // Код ошибки, обычно совпадает с HTTP кодом ответа.
+	Description string // Описание ошибки, например, "Bad Request: chat not found".
+}
+
+func (e *Error) Error() string {
+	return "telegrambotapi: " + e.Description
+}
+
 // Client используется для выполнения запросов к Telegram Bot API.
 type Client struct {
 	token      string
@@ -151,6 +164,59 @@ func (c *Client) AnswerCallbackQuery(callbackQueryID string) error {
 	return nil
 }
 
+// AnswerInlineQuery реализует метод answerInlineQuery Telegram Bot API.
+// results может содержать значения типа InlineQueryResultPhoto и
+// InlineQueryResultCachedPhoto. cacheTime - время в секундах, в течение
+// которого результаты могут храниться в кэше на серверах Telegram.
+// https://core.telegram.org/bots/api#answerinlinequery
+// TODO: добавить недостающие параметры.
+func (c *Client) AnswerInlineQuery(inlineQueryID string, results []interface{}, cacheTime int) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	// Параметр inline_query_id.
+	fw, err := mw.CreateFormField("inline_query_id")
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write([]byte(inlineQueryID))
+	if err != nil {
+		return err
+	}
+
+	// Параметр results.
+	if results == nil {
+		results = []interface{}{}
+	}
+	resultsJSONed, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	fw, err = mw.CreateFormField("results")
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(resultsJSONed)
+	if err != nil {
+		return err
+	}
+
+	// Параметр cache_time.
+	fw, err = mw.CreateFormField("cache_time")
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write([]byte(strconv.Itoa(cacheTime)))
+	if err != nil {
+		return err
+	}
+
+	mw.Close()
+
+	_, err = c.Post("answerInlineQuery", mw.FormDataContentType(), &buf)
+	return err
+}
+
 // sendMessage отправляет текстовое сообщение.
 // https://core.telegram.org/bots/api#sendmessage
 // TODO: добавить недостающие параметры.
@@ -193,17 +259,66 @@ func (c *Client) SendMessage(chatID int64, message string) error {
 	return nil
 }
 
+// GetUpdates реализует метод getUpdates Telegram Bot API. Метод работает в
+// режиме long polling: если новых сообщений нет, то Telegram держит запрос
+// открытым до timeout секунд. Поэтому таймаут http.Client'а, с которым был
+// создан Client, должен быть больше timeout. Запрос прерывается при отмене
+// ctx. Метод не работает, если для бота установлен webhook.
+// https://core.telegram.org/bots/api#getupdates
+// TODO: добавить недостающие параметры.
+func (c *Client) GetUpdates(ctx context.Context, offset, timeout int) ([]Update, error) {
+	query := url.Values{}
+	query.Add("offset", strconv.Itoa(offset))
+	query.Add("timeout", strconv.Itoa(timeout))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.apiBaseURL+"/getUpdates?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	tlgrmResp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []Update
+	err = json.Unmarshal(tlgrmResp.Result, &updates)
+	if err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// Post выполняет метод method Telegram Bot API. Параметры метода передаются
+// в body, тип содержимого которого указывается в contentType (например,
+// multipart/form-data). Возвращает поле result ответа Telegram.
+func (c *Client) Post(method, contentType string, body io.Reader) (json.RawMessage, error) {
+	req, err := http.NewRequest(http.MethodPost, c.apiBaseURL+"/"+method, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	tlgrmResp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return tlgrmResp.Result, nil
+}
+
 // get выполняет GET запросы к Telegram Bot API.
 func (c *Client) get(path string) (*telegramResponse, error) {
-	resp, err := c.httpClient.Get(c.apiBaseURL + path)
+	req, err := http.NewRequest(http.MethodGet, c.apiBaseURL+path, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return c.do(req)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("telegrambotapi: " + resp.Status)
+// do выполняет запрос req к Telegram Bot API и разбирает ответ.
+func (c *Client) do(req *http.Request) (*telegramResponse, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -213,10 +328,13 @@ func (c *Client) get(path string) (*telegramResponse, error) {
 	var tlgrmResp telegramResponse
 	err = json.Unmarshal(body, &tlgrmResp)
 	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("telegrambotapi: " + resp.Status)
+		}
 		return nil, err
 	}
 	if !tlgrmResp.OK {
-		return nil, errors.New("telegrambotapi: " + tlgrmResp.Description)
+		return nil, &Error{Code: tlgrmResp.ErrorCode, Description: tlgrmResp.Description}
 	}
 	return &tlgrmResp, nil
 }
@@ -0,0 +1,530 @@
+// Пакет telegrambotapitest реализует поддельный сервер Telegram Bot API для
+// тестирования ботов без обращения к настоящему Telegram. Сервер запоминает
+// все вызванные у него методы, а также умеет передавать сообщения (Update)
+// в webhook обработчик бота и разбирать ответы этого обработчика.
+package telegrambotapitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+)
+
+// Call - это один вызов метода Telegram Bot API.
+type Call struct {
+	Method  string            // Название метода, например, "sendMessage".
+	Params  map[string]string // Параметры метода, кроме файлов.
+	Files   map[string][]byte // Файлы, переданные в multipart/form-data запросе.
+	Webhook bool              // true, если метод был вызван в ответе на webhook запрос.
+}
+
+// Server - поддельный сервер Telegram Bot API.
+type Server struct {
+	// Пользователь, которого возвращает метод getMe.
+	Bot telegrambotapi.User
+
+	token  string
+	server *httptest.Server
+
+	mu           sync.Mutex
+	calls        []Call
+	updates      []telegrambotapi.Update // Очередь сообщений для метода getUpdates.
+	lastUpdateID int
+	newUpdate    chan struct{} // Сигнал о добавлении сообщения в updates.
+	webhookURL   string
+	certSet      bool
+	messageID    int
+	fileID       int
+	files        map[string][]byte   // Загруженные фотографии по их file_id.
+	failures     map[string][]string // Ошибки, которые нужно вернуть при следующих вызовах методов.
+}
+
+// NewServer запускает поддельный сервер Telegram Bot API, который принимает
+// запросы бота с токеном token. По окончанию работы с сервером должен быть
+// вызван метод Close.
+func NewServer(token string) *Server {
+	s := &Server{
+		Bot: telegrambotapi.User{
+			ID:        1,
+			IsBot:     true,
+			FirstName: "TestBot",
+			UserName:  "TestBot",
+		},
+		token:     token,
+		newUpdate: make(chan struct{}, 1),
+		failures:  map[string][]string{},
+		files:     map[string][]byte{},
+	}
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Close останавливает сервер.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Addr возвращает адрес сервера в виде host:port, который можно передавать
+// в telegrambotapi.NewClient в качестве botAPIAddr.
+func (s *Server) Addr() string {
+	return s.server.Listener.Addr().String()
+}
+
+// HTTPClient возвращает http.Client, который доверяет сертификату сервера.
+func (s *Server) HTTPClient() *http.Client {
+	return s.server.Client()
+}
+
+// Client возвращает клиента Telegram Bot API, настроенного на работу с
+// сервером.
+func (s *Server) Client() *telegrambotapi.Client {
+	return telegrambotapi.NewClient(s.token, s.Addr(), s.HTTPClient())
+}
+
+// Calls возвращает все вызовы методов в порядке их выполнения.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := make([]Call, len(s.calls))
+	copy(calls, s.calls)
+	return calls
+}
+
+// CallsTo возвращает все вызовы метода method в порядке их выполнения.
+func (s *Server) CallsTo(method string) []Call {
+	var calls []Call
+	for _, call := range s.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset удаляет информацию о всех ранее выполненных вызовах методов.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+// WebhookURL возвращает адрес webhook'а, установленный ботом.
+func (s *Server) WebhookURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhookURL
+}
+
+// FailNext настраивает сервер на возврат ошибки с описанием description при
+// следующем вызове метода method.
+func (s *Server) FailNext(method, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = append(s.failures[method], description)
+}
+
+// File возвращает фотографию, загруженную на сервер под идентификатором
+// fileID.
+func (s *Server) File(fileID string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image, ok := s.files[fileID]
+	return image, ok
+}
+
+// ForgetFiles удаляет все загруженные на сервер фотографии, после чего их
+// file_id становятся недействительными.
+func (s *Server) ForgetFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = map[string][]byte{}
+}
+
+// AddUpdate добавляет сообщение в очередь, из которой сообщения отдаются
+// методом getUpdates. Если у сообщения не установлен идентификатор, то он
+// назначается автоматически.
+func (s *Server) AddUpdate(update telegrambotapi.Update) {
+	s.mu.Lock()
+	if update.ID == 0 {
+		update.ID = s.lastUpdateID + 1
+	}
+	if update.ID > s.lastUpdateID {
+		s.lastUpdateID = update.ID
+	}
+	s.updates = append(s.updates, update)
+	s.mu.Unlock()
+
+	select {
+	case s.newUpdate <- struct{}{}:
+	default:
+	}
+}
+
+// PushUpdate передаёт сообщение update в webhook обработчик бота handler так,
+// как это делает Telegram. Если в ответ обработчик вызвал какой-либо метод
+// Telegram Bot API, то этот вызов запоминается и возвращается. Если
+// обработчик ответил пустым телом, то возвращается nil.
+func (s *Server) PushUpdate(handler http.Handler, update telegrambotapi.Update) (*Call, error) {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest(http.MethodPost, "/"+s.token, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("telegrambotapitest: webhook handler replied " + resp.Status + ": " + strings.TrimSpace(string(respBody)))
+	}
+
+	params, files, err := parseParams(resp.Header.Get("Content-Type"), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) == 0 && len(files) == 0 {
+		return nil, nil
+	}
+	call := Call{Method: params["method"], Params: params, Files: files, Webhook: true}
+	delete(call.Params, "method")
+	if call.Method == "" {
+		return nil, errors.New("telegrambotapitest: webhook reply has no method")
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+	return &call, nil
+}
+
+// handle обрабатывает запросы к серверу. Путь запроса имеет вид
+// /bot<token>/<method>.
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	slash := strings.Index(path, "/")
+	if slash == -1 || path[:slash] != "bot"+s.token {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	method := path[slash+1:]
+
+	params, files, err := parseParams(req.Header.Get("Content-Type"), req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	for name, values := range req.URL.Query() {
+		if len(values) > 0 {
+			params[name] = values[0]
+		}
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Method: method, Params: params, Files: files})
+	failures := s.failures[method]
+	var failure string
+	if len(failures) > 0 {
+		failure = failures[0]
+		s.failures[method] = failures[1:]
+	}
+	s.mu.Unlock()
+	if failure != "" {
+		writeError(w, http.StatusBadRequest, failure)
+		return
+	}
+
+	var result interface{}
+	switch method {
+	case "getMe":
+		result = s.Bot
+
+	case "getWebhookInfo":
+		s.mu.Lock()
+		result = telegrambotapi.WebhookInfo{URL: s.webhookURL, HasCustomCertificate: s.certSet}
+		s.mu.Unlock()
+
+	case "setWebhook":
+		s.mu.Lock()
+		s.webhookURL = params["url"]
+		_, s.certSet = files["certificate"]
+		s.mu.Unlock()
+		result = true
+
+	case "deleteWebhook":
+		s.mu.Lock()
+		s.webhookURL = ""
+		s.certSet = false
+		s.mu.Unlock()
+		result = true
+
+	case "getUpdates":
+		s.mu.Lock()
+		webhookSet := s.webhookURL != ""
+		s.mu.Unlock()
+		if webhookSet {
+			writeError(w, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first")
+			return
+		}
+		offset, _ := strconv.Atoi(params["offset"])
+		timeout, _ := strconv.Atoi(params["timeout"])
+		result = s.getUpdates(req, offset, timeout)
+
+	case "sendMessage":
+		result = s.newMessage(params, nil)
+
+	case "sendPhoto", "editMessageMedia":
+		// Фотография передаётся либо файлом, либо через file_id ранее
+		// загруженной фотографии. В editMessageMedia она указывается в
+		// параметре media.
+		field, fileID := "photo", params["photo"]
+		if method == "editMessageMedia" {
+			var media telegrambotapi.InputMediaPhoto
+			err := json.Unmarshal([]byte(params["media"]), &media)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Bad Request: can't parse InputMedia JSON object")
+				return
+			}
+			field, fileID = strings.TrimPrefix(media.Media, "attach://"), media.Media
+		}
+		var photo []map[string]interface{}
+		if image, ok := files[field]; ok {
+			photo = s.newPhoto(image)
+		} else {
+			photo, ok = s.photo(fileID)
+			if !ok {
+				writeError(w, http.StatusBadRequest, "Bad Request: wrong file identifier/HTTP URL specified")
+				return
+			}
+		}
+		result = s.newMessage(params, photo)
+
+	case "answerCallbackQuery", "answerInlineQuery":
+		result = true
+
+	default:
+		writeError(w, http.StatusNotFound, "Not Found: method not found")
+		return
+	}
+
+	writeResult(w, result)
+}
+
+// getUpdates возвращает сообщения из очереди, идентификатор которых не
+// меньше offset. Если таких сообщений нет, то ждёт их появления не дольше
+// timeout секунд.
+func (s *Server) getUpdates(req *http.Request, offset, timeout int) []telegrambotapi.Update {
+	deadline := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		// Как и в настоящем Telegram, вызов getUpdates подтверждает получение
+		// всех сообщений с идентификатором меньше offset.
+		var updates []telegrambotapi.Update
+		for _, update := range s.updates {
+			if update.ID >= offset {
+				updates = append(updates, update)
+			}
+		}
+		s.updates = updates
+		s.mu.Unlock()
+		if len(updates) > 0 || timeout <= 0 {
+			return updates
+		}
+
+		select {
+		case <-s.newUpdate:
+		case <-deadline.C:
+			return []telegrambotapi.Update{}
+		case <-req.Context().Done():
+			return []telegrambotapi.Update{}
+		}
+	}
+}
+
+// newMessage формирует сообщение, которое возвращают методы отправки
+// сообщений.
+func (s *Server) newMessage(params map[string]string, photo []map[string]interface{}) map[string]interface{} {
+	s.mu.Lock()
+	s.messageID++
+	messageID := s.messageID
+	s.mu.Unlock()
+	if id, err := strconv.Atoi(params["message_id"]); err == nil {
+		messageID = id
+	}
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+
+	message := map[string]interface{}{
+		"message_id": messageID,
+		"from":       s.Bot,
+		"date":       time.Now().Unix(),
+		"chat":       telegrambotapi.Chat{ID: chatID, Type: "private"},
+	}
+	if text, ok := params["text"]; ok {
+		message["text"] = text
+	}
+	if caption, ok := params["caption"]; ok {
+		message["caption"] = caption
+	}
+	if photo != nil {
+		message["photo"] = photo
+	}
+	return message
+}
+
+// newPhoto запоминает загруженную фотографию image под новым file_id и
+// формирует её описание.
+func (s *Server) newPhoto(image []byte) []map[string]interface{} {
+	s.mu.Lock()
+	s.fileID++
+	fileID := "file-" + strconv.Itoa(s.fileID)
+	s.files[fileID] = image
+	s.files[fileID+"-small"] = image
+	s.mu.Unlock()
+	return photoSizes(fileID)
+}
+
+// photo формирует описание ранее загруженной фотографии по её file_id.
+func (s *Server) photo(fileID string) ([]map[string]interface{}, bool) {
+	s.mu.Lock()
+	_, ok := s.files[fileID]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return photoSizes(strings.TrimSuffix(fileID, "-small")), true
+}
+
+// photoSizes формирует описание фотографии в двух размерах.
+func photoSizes(fileID string) []map[string]interface{} {
+	return []map[string]interface{}{
+		{"file_id": fileID + "-small", "file_unique_id": fileID + "-small", "width": 90, "height": 135},
+		{"file_id": fileID, "file_unique_id": fileID, "width": 500, "height": 750},
+	}
+}
+
+// parseParams извлекает параметры метода из тела запроса (или ответа) в
+// формате multipart/form-data, application/x-www-form-urlencoded или JSON.
+func parseParams(contentType string, body io.Reader) (map[string]string, map[string][]byte, error) {
+	params := map[string]string{}
+	files := map[string][]byte{}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) == 0 {
+		return params, files, nil
+	}
+
+	mediaType, mediaParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		reader := multipart.NewReader(bytes.NewReader(data), mediaParams["boundary"])
+		form, err := reader.ReadForm(32 << 20)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer form.RemoveAll()
+		for name, values := range form.Value {
+			if len(values) > 0 {
+				params[name] = values[0]
+			}
+		}
+		for name, headers := range form.File {
+			if len(headers) == 0 {
+				continue
+			}
+			f, err := headers[0].Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			content, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			files[name] = content
+		}
+
+	case "application/x-www-form-urlencoded":
+		req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		err = req.ParseForm()
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, values := range req.PostForm {
+			if len(values) > 0 {
+				params[name] = values[0]
+			}
+		}
+
+	case "application/json":
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, value := range fields {
+			var str string
+			if json.Unmarshal(value, &str) == nil {
+				params[name] = str
+			} else {
+				params[name] = string(value)
+			}
+		}
+
+	default:
+		return nil, nil, errors.New("unsupported content type " + mediaType)
+	}
+
+	return params, files, nil
+}
+
+// writeResult отправляет успешный ответ Telegram Bot API.
+func writeResult(w http.ResponseWriter, result interface{}) {
+	resultJSONed, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := map[string]interface{}{
+		"ok":     true,
+		"result": json.RawMessage(resultJSONed),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeError отправляет ответ Telegram Bot API с ошибкой.
+func writeError(w http.ResponseWriter, code int, description string) {
+	resp := map[string]interface{}{
+		"ok":          false,
+		"error_code":  code,
+		"description": description,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,166 @@
+package telegrambotapitest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+)
+
+const testToken = "123456:TEST"
+
+func TestGetMe(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+
+	user, err := server.Client().GetMe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsBot || user.ID != server.Bot.ID {
+		t.Fatalf("Unexpected user %+v", user)
+	}
+	if calls := server.CallsTo("getMe"); len(calls) != 1 {
+		t.Fatalf("Expected 1 getMe call, got %d", len(calls))
+	}
+}
+
+func TestWrongToken(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+
+	client := telegrambotapi.NewClient("654321:WRONG", server.Addr(), server.HTTPClient())
+	_, err := client.GetMe()
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+	client := server.Client()
+
+	url := "https://1.2.3.4:8443/" + testToken
+	err := client.SetWebhook(url, []byte("certificate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.GetWebhookInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL != url || !info.HasCustomCertificate {
+		t.Fatalf("Unexpected webhook info %+v", info)
+	}
+
+	// Пока установлен webhook, getUpdates должен возвращать ошибку.
+	_, err = client.GetUpdates(context.Background(), 0, 0)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	err = client.DeleteWebhook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.WebhookURL() != "" {
+		t.Fatal("Webhook is not deleted")
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+
+	err := server.Client().SendMessage(42, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.CallsTo("sendMessage")
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 sendMessage call, got %d", len(calls))
+	}
+	if calls[0].Params["chat_id"] != "42" || calls[0].Params["text"] != "hello" {
+		t.Fatalf("Unexpected params %v", calls[0].Params)
+	}
+
+	server.FailNext("sendMessage", "Bad Request: chat not found")
+	err = server.Client().SendMessage(42, "hello")
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+}
+
+func TestAnswerInlineQuery(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+
+	err := server.Client().AnswerInlineQuery("1", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := server.CallsTo("answerInlineQuery")
+	if len(calls) != 1 || calls[0].Params["inline_query_id"] != "1" || calls[0].Params["cache_time"] != "10" {
+		t.Fatalf("Unexpected answerInlineQuery calls %+v", calls)
+	}
+
+	// Описание ошибки из ответа Telegram доступно вызывающему.
+	description := "Bad Request: query is too old and response timeout expired or query ID is invalid"
+	server.FailNext("answerInlineQuery", description)
+	err = server.Client().AnswerInlineQuery("1", nil, 10)
+	var apiErr *telegrambotapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Description != description {
+		t.Fatalf("Expected Bot API error %q, got %v", description, err)
+	}
+}
+
+func TestGetUpdates(t *testing.T) {
+	server := NewServer(testToken)
+	defer server.Close()
+	client := server.Client()
+
+	server.AddUpdate(telegrambotapi.Update{Message: telegrambotapi.Message{ID: 1, Text: "first"}})
+	server.AddUpdate(telegrambotapi.Update{Message: telegrambotapi.Message{ID: 2, Text: "second"}})
+
+	updates, err := client.GetUpdates(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[0].Message.Text != "first" || updates[1].Message.Text != "second" {
+		t.Fatalf("Unexpected updates %+v", updates)
+	}
+
+	// Получение обоих сообщений подтверждается offset'ом.
+	offset := updates[1].ID + 1
+	updates, err = client.GetUpdates(context.Background(), offset, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 0 {
+		t.Fatalf("Expected no updates, got %+v", updates)
+	}
+
+	// Long polling должен вернуть сообщение, добавленное во время ожидания.
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		server.AddUpdate(telegrambotapi.Update{Message: telegrambotapi.Message{ID: 3, Text: "third"}})
+	}()
+	updates, err = client.GetUpdates(context.Background(), offset, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Message.Text != "third" {
+		t.Fatalf("Unexpected updates %+v", updates)
+	}
+
+	// Отмена контекста прерывает long polling.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = client.GetUpdates(ctx, updates[0].ID+1, 5)
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+}
@@ -54,17 +54,31 @@ type Message struct {
 	Chat        Chat                 `json:"chat"`
 	Text        string               `json:"text"`
 	Entity      []Entity             `json:"entities"`
+	Photo       []PhotoSize          `json:"photo"`
 	ReplyMarkup InlineKeyboardMarkup `json:"reply_markup"`
 }
 
+// PhotoSize - один из размеров фотографии. Telegram хранит каждую
+// фотографию в нескольких размерах.
+// https://core.telegram.org/bots/api#photosize
+type PhotoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FileSize     int    `json:"file_size"`
+}
+
 // Update - новое сообщение от Telegram.
 // https://core.telegram.org/bots/api#update
 // TODO: добавить остальные параметры.
 type Update struct {
-	ID            int           `json:"update_id"`
-	Message       Message       `json:"message"`
-	EditedMessage Message       `json:"edited_message"`
-	CallbackQuery CallbackQuery `json:"callback_query"`
+	ID                 int                `json:"update_id"`
+	Message            Message            `json:"message"`
+	EditedMessage      Message            `json:"edited_message"`
+	InlineQuery        InlineQuery        `json:"inline_query"`
+	ChosenInlineResult ChosenInlineResult `json:"chosen_inline_result"`
+	CallbackQuery      CallbackQuery      `json:"callback_query"`
 }
 
 // InlineKeyboardMarkup - inline клавиатура.
@@ -110,3 +124,55 @@ type Entity struct {
 	Offset int    `json:"offset"`
 	Length int    `json:"length"`
 }
+
+// InlineQuery - входящий inline запрос. Такой запрос получает бот, когда
+// пользователь в любом чате набирает имя бота и текст после него.
+// https://core.telegram.org/bots/api#inlinequery
+// TODO: добавить остальные параметры.
+type InlineQuery struct {
+	ID     string `json:"id"`
+	From   User   `json:"from"`
+	Query  string `json:"query"`
+	Offset string `json:"offset"`
+}
+
+// ChosenInlineResult - результат inline запроса, который был выбран
+// пользователем и отправлен в чат. Бот получает такие сообщения, только если
+// для него включен inline feedback (команда /setinlinefeedback у BotFather).
+// https://core.telegram.org/bots/api#choseninlineresult
+// TODO: добавить остальные параметры.
+type ChosenInlineResult struct {
+	ResultID        string `json:"result_id"`
+	From            User   `json:"from"`
+	InlineMessageID string `json:"inline_message_id"`
+	Query           string `json:"query"`
+}
+
+// InlineQueryResultPhoto - фотография, которая отправляется в ответ на inline
+// запрос. Фотография должна быть в формате JPEG и доступна по ссылке PhotoURL.
+// https://core.telegram.org/bots/api#inlinequeryresultphoto
+// TODO: добавить остальные параметры.
+type InlineQueryResultPhoto struct {
+	Type        string `json:"type"` // Всегда должен быть равен "photo".
+	ID          string `json:"id"`
+	PhotoURL    string `json:"photo_url"`
+	ThumbURL    string `json:"thumb_url"`
+	PhotoWidth  int    `json:"photo_width,omitempty"`
+	PhotoHeight int    `json:"photo_height,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Caption     string `json:"caption,omitempty"`
+}
+
+// InlineQueryResultCachedPhoto - фотография, которая уже хранится на серверах
+// Telegram и отправляется в ответ на inline запрос по её file_id.
+// https://core.telegram.org/bots/api#inlinequeryresultcachedphoto
+// TODO: добавить остальные параметры.
+type InlineQueryResultCachedPhoto struct {
+	Type        string `json:"type"` // Всегда должен быть равен "photo".
+	ID          string `json:"id"`
+	PhotoFileID string `json:"photo_file_id"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Caption     string `json:"caption,omitempty"`
+}
@@ -0,0 +1,73 @@
+package themoviedb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter ограничивает частоту запросов Client'а.
+type Limiter interface {
+	// Wait блокируется до тех пор, пока не будет разрешён следующий запрос.
+	// Если ctx отменяется раньше, то возвращается ошибка ctx.
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket - это Limiter, работающий по алгоритму "ведро токенов": в ведре
+// помещается size токенов, каждый запрос забирает один токен, а новые токены
+// добавляются равномерно, по size штук за период per. Т.е. запросы
+// выполняются пачками не больше size, а в среднем не чаще size за период per.
+// Если токенов нет, то Wait ждёт своей очереди: ожидающие запросы
+// выполняются в порядке вызова Wait.
+type TokenBucket struct {
+	mu       sync.Mutex
+	size     float64
+	interval time.Duration // Время добавления одного токена.
+	// Количество токенов. Становится отрицательным, если есть ожидающие
+	// токенов вызовы Wait.
+	tokens float64
+	last   time.Time // Время последнего пересчёта tokens.
+}
+
+// NewTokenBucket возвращает полное ведро, которое разрешает size запросов за
+// период per.
+func NewTokenBucket(size int, per time.Duration) *TokenBucket {
+	return &TokenBucket{
+		size:     float64(size),
+		interval: per / time.Duration(size),
+		tokens:   float64(size),
+		last:     time.Now(),
+	}
+}
+
+// Wait забирает токен из ведра, при необходимости дожидаясь его появления.
+// Если ожидание прервано отменой ctx, то токен возвращается в ведро.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > b.size {
+		b.tokens = b.size
+	}
+	b.last = now
+	b.tokens--
+	// Токен занимается сразу, даже если его ещё нет, поэтому каждый
+	// следующий вызов Wait ждёт дольше предыдущего.
+	delay := time.Duration(-b.tokens * float64(b.interval))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
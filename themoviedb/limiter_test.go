@@ -0,0 +1,66 @@
+package themoviedb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	const interval = time.Millisecond * 50
+	bucket := NewTokenBucket(2, interval*2)
+
+	// Полное ведро пропускает пачку запросов без ожидания.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		err := bucket.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= interval/2 {
+		t.Fatalf("Expected no wait for full bucket, got %v", elapsed)
+	}
+
+	// Прерванное ожидание не занимает токен.
+	ctx, cancel := context.WithTimeout(context.Background(), interval/5)
+	defer cancel()
+	err := bucket.Wait(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Следующие запросы ждут появления токенов по очереди.
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		err := bucket.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < interval || elapsed > interval*3 {
+		t.Fatalf("Expected wait of about %v, got %v", interval*2, elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", time.Minute * 2, true},
+		{"-1", 0, false},
+		{"Fri, 01 May 2020 12:00:30 GMT", time.Second * 30, true},
+		{"Fri, 01 May 2020 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tc := range testCases {
+		wait, ok := parseRetryAfter(tc.value, now)
+		if wait != tc.wait || ok != tc.ok {
+			t.Fatalf("Expected %v, %v for %q, got %v, %v", tc.wait, tc.ok, tc.value, wait, ok)
+		}
+	}
+}
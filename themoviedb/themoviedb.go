@@ -3,6 +3,7 @@ package themoviedb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,10 +11,12 @@ import (
 	"image/png"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +29,14 @@ const (
 	apiRateLimit    = 40
 	APIRateLimitDur = time.Millisecond * 10000
 
+	// Количество повторов запроса по-умолчанию при ответах 429 Too Many
+	// Requests и 5xx.
+	DefaultMaxRetries = 3
+	// Пауза перед первым повтором запроса по-умолчанию, если сервер не
+	// передал заголовок Retry-After. Каждая следующая пауза вдвое больше
+	// предыдущей.
+	DefaultRetryPause = time.Second
+
 	// Файл с базой фильмов, который предоставляет The MovieDB API, не должен
 	// превышать эту константу.
 	movieDailyExportMaxSize = 50 * 1024 * 1024 // 50MiB
@@ -39,14 +50,10 @@ const (
 	ChangedMoviesMaxPage = 1000
 )
 
-// Переменные для контроля лимита запросов. Т.к. The MovieDB API устанавливает
-// лимит запросов на основе IP адреса, создаём эти переменные на уровне пакета,
-// т.е. они будут общими для всех Client'ов.
-var (
-	mu            sync.Mutex
-	reqLimit      int       // Количество доступных запросов.
-	reqLimitStart time.Time // Начало нового отсчёта лимита запросов.
-)
+// Лимит запросов по-умолчанию. Т.к. The MovieDB API устанавливает лимит
+// запросов на основе IP адреса, лимит создаётся на уровне пакета, т.е. он
+// общий для всех Client'ов.
+var defaultLimiter = NewTokenBucket(apiRateLimit, APIRateLimitDur)
 
 type configuration struct {
 	Images struct {
@@ -56,11 +63,9 @@ type configuration struct {
 	posterSize string
 }
 
-// Языки, которые поддерживаются Client'ом.
-var supportedLangs = map[iso6391.LangCode]struct{}{
-	iso6391.En: struct{}{},
-	iso6391.Ru: struct{}{},
-}
+// Языки, названия и постеры на которых получает Client, если они не заданы
+// методом SetLangs.
+var DefaultLangs = []iso6391.LangCode{iso6391.En, iso6391.Ru}
 
 type translation struct {
 	Lang iso6391.LangCode `json:"iso_639_1"`
@@ -70,7 +75,8 @@ type translation struct {
 }
 
 var (
-	// Превышение лимита запросов к The MovieDB API.
+	// Превышение лимита запросов к The MovieDB API: сервер отвечал 429 Too
+	// Many Requests на все повторы запроса.
 	ErrRateLimit = errors.New("themoviedb: API rate limit exceeded")
 
 	// Клиент не настроен.
@@ -81,13 +87,44 @@ var (
 	ErrPage = errors.New("themoviedb: page not found")
 )
 
+// BaseURLs - адреса сервисов The MovieDB, к которым обращается Client.
+// Адреса указываются без завершающего '/'.
+type BaseURLs struct {
+	// Адрес The MovieDB API вместе с версией API.
+	API string `json:"api"`
+	// Адрес сервиса с постерами. Если не указан, то используется адрес,
+	// полученный методом Configure.
+	Image string `json:"image"`
+	// Адрес сервиса с файлами ежедневного экспорта.
+	Files string `json:"files"`
+}
+
+// DefaultBaseURLs - адреса настоящих сервисов The MovieDB.
+var DefaultBaseURLs = BaseURLs{
+	API:   "http://api.themoviedb.org/3",
+	Files: "http://files.tmdb.org",
+}
+
 // Client позволяет выполнять запросы к TheMovieDB API.
 type Client struct {
-	key        string
-	httpClient *http.Client
-	apiBaseURL string
-	configMu   sync.Mutex
-	config     configuration
+	key          string
+	httpClient   *http.Client
+	apiBaseURL   string
+	imageBaseURL string
+	filesBaseURL string
+	configMu     sync.Mutex
+	config       configuration
+	langs        map[iso6391.LangCode]struct{} // Защищается configMu.
+
+	// Лимит и повторы запросов. Отдельный мьютекс нужен, т.к. configMu
+	// удерживается во время запроса в методе Configure.
+	limitMu    sync.Mutex
+	limiter    Limiter
+	maxRetries int
+	retryPause time.Duration
+	// До этого времени запросы не выполняются, т.к. сервер ответил 429 Too
+	// Many Requests.
+	retryAt time.Time
 }
 
 // Poster хранит информацию о постере фильма.
@@ -122,24 +159,82 @@ type Movie struct {
 // NewClient возвращает новый TheMovieDB API клиент. Если httpClient равен
 // nil, то возвращаемый клиент будет пользоваться http.DefaultClient'ом.
 func NewClient(key string, httpClient *http.Client) *Client {
-	client := Client{
-		key:        key,
-		httpClient: httpClient,
-		apiBaseURL: "http://api.themoviedb.org/3",
+	return NewClientWithBaseURLs(key, httpClient, DefaultBaseURLs)
+}
+
+// NewClientWithBaseURLs возвращает новый TheMovieDB API клиент, который
+// обращается к сервисам по адресам из baseURLs. Незаполненные поля baseURLs
+// берутся из DefaultBaseURLs. Позволяет работать, например, с поддельным
+// сервером из пакета themoviedbtest.
+func NewClientWithBaseURLs(key string, httpClient *http.Client, baseURLs BaseURLs) *Client {
+	if baseURLs.API == "" {
+		baseURLs.API = DefaultBaseURLs.API
+	}
+	if baseURLs.Image == "" {
+		baseURLs.Image = DefaultBaseURLs.Image
+	}
+	if baseURLs.Files == "" {
+		baseURLs.Files = DefaultBaseURLs.Files
 	}
+	client := Client{
+		key:          key,
+		httpClient:   httpClient,
+		apiBaseURL:   strings.TrimSuffix(baseURLs.API, "/"),
+		imageBaseURL: strings.TrimSuffix(baseURLs.Image, "/"),
+		filesBaseURL: strings.TrimSuffix(baseURLs.Files, "/"),
+		limiter:      defaultLimiter,
+		maxRetries:   DefaultMaxRetries,
+		retryPause:   DefaultRetryPause,
+	}
+	client.SetLangs(DefaultLangs)
 	if client.httpClient == nil {
 		client.httpClient = http.DefaultClient
 	}
 	return &client
 }
 
+// SetLangs задаёт языки, названия и постеры на которых возвращает метод
+// GetMovie. Названия и постеры на остальных языках отбрасываются.
+func (c *Client) SetLangs(langs []iso6391.LangCode) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	c.langs = make(map[iso6391.LangCode]struct{}, len(langs))
+	for _, lang := range langs {
+		c.langs[lang] = struct{}{}
+	}
+}
+
+// SetLimiter задаёт лимит запросов клиента. По-умолчанию клиент пользуется
+// общим для всех клиентов лимитом The MovieDB API в 40 запросов за 10 секунд.
+// Если limiter равен nil, то запросы не ограничиваются.
+func (c *Client) SetLimiter(limiter Limiter) {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	c.limiter = limiter
+}
+
+// SetRetryPolicy задаёт количество повторов запроса maxRetries при ответах
+// 429 Too Many Requests и 5xx и паузу pause перед первым повтором, если сервер
+// не передал заголовок Retry-After. Если maxRetries равен 0, то запросы не
+// повторяются.
+func (c *Client) SetRetryPolicy(maxRetries int, pause time.Duration) {
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+	c.maxRetries = maxRetries
+	c.retryPause = pause
+}
+
 // Configure получает настройки TheMovieDB API (GET /configuration). Удачный
 // вызов этого метода заполняет поле config клиента, который необходим при
 // выполнении запросов для получения постеров. В документации к TheMovieDB API
 // рекомендуют получать настройки раз в несколько дней.
-// При возврате ошибки ErrRateLimit нужно ждать некоторое время перед
-// выполнением следующим вызовом.
 func (c *Client) Configure() error {
+	return c.ConfigureContext(context.Background())
+}
+
+// ConfigureContext - это Configure с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) ConfigureContext(ctx context.Context) error {
 	c.configMu.Lock()
 	defer c.configMu.Unlock()
 
@@ -151,19 +246,11 @@ func (c *Client) Configure() error {
 	query.Add("api_key", c.key)
 	url.RawQuery = query.Encode()
 
-	err = c.checkRateLimit()
-	if err != nil {
-		return err
-	}
-
-	resp, err := c.httpClient.Get(url.String())
+	resp, err := c.get(ctx, url.String())
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("themoviedb: " + resp.Status)
-	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -204,20 +291,23 @@ func (c *Client) Configure() error {
 // Параметр filename - это путь к файлу, куда нужно сохранять базу фильмов.
 // Для вызова этой функции клиент может не обладать ключом.
 func (c *Client) GetDailyExport(year, month, day int, filename string) (err error) {
+	return c.GetDailyExportContext(context.Background(), year, month, day, filename)
+}
+
+// GetDailyExportContext - это GetDailyExport с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) GetDailyExportContext(ctx context.Context, year, month, day int, filename string) (err error) {
 	// Формируем URL вида
 	//
 	// http://files.tmdb.org/p/exports/movie_ids_MM_DD_YEAR.json.gz"
 	//
 	date := fmt.Sprintf("%02d_%02d_%d", month, day, year)
-	url := "http://files.tmdb.org/p/exports/movie_ids_" + date + ".json.gz"
-	resp, err := c.httpClient.Get(url)
+	url := c.filesBaseURL + "/p/exports/movie_ids_" + date + ".json.gz"
+	resp, err := c.get(ctx, url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("themoviedb: " + resp.Status)
-	}
 
 	bodySize, err := strconv.Atoi(resp.Header.Get("Content-Length"))
 	if err != nil {
@@ -249,9 +339,14 @@ func (c *Client) GetDailyExport(year, month, day int, filename string) (err erro
 }
 
 // GetMovie возвращает информацию о фильме с идентификатором id в базе
-// The MovieDB API. При возврате ошибки ErrRateLimit нужно ждать некоторое время
-// перед выполнением следующего вызова.
+// The MovieDB API.
 func (c *Client) GetMovie(id int) (Movie, error) {
+	return c.GetMovieContext(context.Background(), id)
+}
+
+// GetMovieContext - это GetMovie с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) GetMovieContext(ctx context.Context, id int) (Movie, error) {
 	// Формируем URL вида
 	//
 	// http://api.themoviedb.org/3/movie/<id>?api_key=<key>&append_to_response=translations,images
@@ -265,19 +360,15 @@ func (c *Client) GetMovie(id int) (Movie, error) {
 	query.Add("append_to_response", "translations,images")
 	url.RawQuery = query.Encode()
 
-	err = c.checkRateLimit()
-	if err != nil {
-		return Movie{}, err
-	}
-
-	resp, err := c.httpClient.Get(url.String())
+	resp, err := c.get(ctx, url.String())
 	if err != nil {
 		return Movie{}, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return Movie{}, errors.New("themoviedb: " + resp.Status)
-	}
+
+	c.configMu.Lock()
+	supportedLangs := c.langs
+	c.configMu.Unlock()
 
 	movie := Movie{}
 	//- Настройка сканирования ответного JSON'а.
@@ -330,7 +421,7 @@ func (c *Client) GetMovie(id int) (Movie, error) {
 		movie.ReleaseDate = releaseDate
 	}
 
-	// Отбираем названия фильмов на поддерживаемых пакетом языках.
+	// Отбираем названия фильмов на поддерживаемых клиентом языках.
 	_, ok := supportedLangs[movie.OriginalLang]
 	if len(translations) > 0 || ok {
 		movie.Title = map[iso6391.LangCode]string{}
@@ -373,6 +464,12 @@ func (c *Client) GetMovie(id int) (Movie, error) {
 // Фильмы разбиты по страницам, начиная с 1. Если страниц не осталось, то
 // возвращается ошибка ErrPage.
 func (c *Client) GetNowPlaying(page int) ([]Movie, error) {
+	return c.GetNowPlayingContext(context.Background(), page)
+}
+
+// GetNowPlayingContext - это GetNowPlaying с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) GetNowPlayingContext(ctx context.Context, page int) ([]Movie, error) {
 	// Формируем URL вида
 	//
 	// http://api.themoviedb.org/3/movie/now_playing?api_key=<key>&page=<pageNum>
@@ -386,19 +483,11 @@ func (c *Client) GetNowPlaying(page int) ([]Movie, error) {
 	query.Add("page", strconv.Itoa(page))
 	url.RawQuery = query.Encode()
 
-	err = c.checkRateLimit()
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.httpClient.Get(url.String())
+	resp, err := c.get(ctx, url.String())
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("themoviedb: " + resp.Status)
-	}
 
 	var movies []Movie
 	scanner := jsonstream.NewScanner()
@@ -421,6 +510,12 @@ func (c *Client) GetNowPlaying(page int) ([]Movie, error) {
 // Фильмы разбиты по страницам, начиная с 1. Если страниц не осталось, то
 // возвращается ошибка ErrPage.
 func (c *Client) GetChangedMovies(page int) ([]int, error) {
+	return c.GetChangedMoviesContext(context.Background(), page)
+}
+
+// GetChangedMoviesContext - это GetChangedMovies с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) GetChangedMoviesContext(ctx context.Context, page int) ([]int, error) {
 	// Формируем URL вида
 	//
 	// http://api.themoviedb.org/3/movie/changes?api_key=<key>&end_date=<end_date>&start_date=<start_date>&page=<pageNum>
@@ -438,19 +533,11 @@ func (c *Client) GetChangedMovies(page int) ([]int, error) {
 	query.Add("start_date", prevDay.Format("2006-01-02"))
 	url.RawQuery = query.Encode()
 
-	err = c.checkRateLimit()
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.httpClient.Get(url.String())
+	resp, err := c.get(ctx, url.String())
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("themoviedb: " + resp.Status)
-	}
 
 	var changedMovies []Movie
 	scanner := jsonstream.NewScanner()
@@ -474,9 +561,13 @@ func (c *Client) GetChangedMovies(page int) ([]int, error) {
 }
 
 // GetPoster закачивает постер через путь к нему.
-// При возврате ошибки ErrRateLimit нужно ждать некоторое время перед
-// выполнением следующим вызовом.
 func (c *Client) GetPoster(path string) ([]byte, error) {
+	return c.GetPosterContext(context.Background(), path)
+}
+
+// GetPosterContext - это GetPoster с контекстом ctx. Отмена ctx прерывает
+// ожидание лимита запросов и выполняющийся HTTP запрос.
+func (c *Client) GetPosterContext(ctx context.Context, path string) ([]byte, error) {
 	// Формируем URL вида
 	//
 	// http://image.tmdb.org/t/p/<size>/<poster>
@@ -486,25 +577,21 @@ func (c *Client) GetPoster(path string) ([]byte, error) {
 		c.configMu.Unlock()
 		return nil, ErrConfigure
 	}
-	url, err := url.Parse(c.config.Images.BaseURL + "/" + c.config.posterSize + path)
-	c.configMu.Unlock()
-	if err != nil {
-		return nil, err
+	imageBaseURL := c.config.Images.BaseURL
+	if c.imageBaseURL != "" {
+		imageBaseURL = c.imageBaseURL
 	}
-
-	err = c.checkRateLimit()
+	url, err := url.Parse(imageBaseURL + "/" + c.config.posterSize + path)
+	c.configMu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.httpClient.Get(url.String())
+	resp, err := c.get(ctx, url.String())
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("themoviedb: " + resp.Status)
-	}
 	poster, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -523,16 +610,120 @@ func (c *Client) GetPoster(path string) ([]byte, error) {
 	return poster, nil
 }
 
-func (c *Client) checkRateLimit() error {
-	mu.Lock()
-	defer mu.Unlock()
-	if reqLimitStart.IsZero() || time.Since(reqLimitStart) > APIRateLimitDur {
-		reqLimit = apiRateLimit
-		reqLimitStart = time.Now()
+// get выполняет GET запрос по адресу url, дождавшись разрешения лимита
+// запросов. Ответы 429 Too Many Requests и 5xx повторяются до maxRetries раз.
+// Пауза перед повтором берётся из заголовка Retry-After, а если его нет, то
+// растёт вдвое с каждым повтором начиная с retryPause и случайно
+// уменьшается до половины (jitter), чтобы параллельные запросы не
+// повторялись одновременно. После ответа 429 паузу выдерживают все запросы
+// клиента. Если ответ не 200 OK, то возвращается ошибка, иначе тело ответа
+// должен закрыть вызывающий.
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	c.limitMu.Lock()
+	limiter, maxRetries, pause := c.limiter, c.maxRetries, c.retryPause
+	c.limitMu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	if reqLimit == 0 {
-		return ErrRateLimit
+	for retry := 0; ; retry++ {
+		c.limitMu.Lock()
+		retryAt := c.retryAt
+		c.limitMu.Unlock()
+		err = sleep(ctx, time.Until(retryAt))
+		if err != nil {
+			return nil, err
+		}
+		if limiter != nil {
+			err = limiter.Wait(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		// Тело вычитывается, чтобы соединение можно было использовать повторно.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		tooManyRequests := resp.StatusCode == http.StatusTooManyRequests
+		if tooManyRequests {
+			err = fmt.Errorf("%w (%s)", ErrRateLimit, resp.Status)
+		} else {
+			err = errors.New("themoviedb: " + resp.Status)
+		}
+		if (!tooManyRequests && resp.StatusCode < 500) || retry >= maxRetries {
+			return nil, err
+		}
+
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = withJitter(pause << retry)
+		}
+		if tooManyRequests {
+			c.limitMu.Lock()
+			if at := time.Now().Add(wait); at.After(c.retryAt) {
+				c.retryAt = at
+			}
+			c.limitMu.Unlock()
+		} else {
+			err = sleep(ctx, wait)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseRetryAfter разбирает значение заголовка Retry-After, которое может
+// быть количеством секунд или датой, и возвращает паузу относительно now.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// withJitter возвращает случайную паузу от d/2 до d.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// sleep ждёт d или отмены ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
 	}
-	reqLimit--
-	return nil
 }
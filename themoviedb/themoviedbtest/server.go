@@ -0,0 +1,515 @@
+// Пакет themoviedbtest реализует поддельный сервер The MovieDB для
+// тестирования без обращения к настоящим api.themoviedb.org, image.tmdb.org и
+// files.tmdb.org. Сервер отдаёт заранее добавленные в него фильмы, постеры и
+// файлы ежедневного экспорта, запоминает все поступившие к нему запросы и
+// умеет имитировать превышение лимита запросов, ошибки сервера и медленные
+// ответы.
+package themoviedbtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/themoviedb"
+)
+
+const (
+	// Количество фильмов на одной странице ответов /movie/now_playing и
+	// /movie/changes.
+	PageSize = 20
+
+	// Пауза перед первым повтором запроса у клиента, который возвращает
+	// метод Client.
+	ClientRetryPause = time.Millisecond * 10
+
+	apiPrefix     = "/3"
+	imagePrefix   = "/t/p"
+	exportsPrefix = "/p/exports/"
+)
+
+// Movie - фильм, который отдаёт сервер по пути /movie/{id}.
+type Movie struct {
+	TMDBID        int
+	IMDBID        string
+	OriginalTitle string
+	OriginalLang  iso6391.LangCode
+	ReleaseDate   string // В формате "2006-01-02".
+	Adult         bool
+	VoteCount     int
+	VoteAverage   float64
+	Collection    themoviedb.MovieCollection // Если ID равен 0, то фильм не входит в коллекцию.
+	// Названия фильма на разных языках (переводы).
+	Title map[iso6391.LangCode]string
+	// Постеры фильма. Сами картинки добавляются в сервер методом AddPoster.
+	Posters []themoviedb.Poster
+}
+
+// Fault описывает сбой, который сервер вносит в ответы на запросы.
+type Fault struct {
+	// Префикс пути запроса, например, "/3/movie/" или "/t/p/". Если пустой,
+	// то сбой затрагивает любые запросы.
+	Path string
+	// Код ответа. Если равен 0, то запрос обрабатывается как обычно (имеет
+	// смысл вместе с Delay).
+	Status int
+	// Значение заголовка Retry-After в секундах. Если равно 0, то заголовок
+	// не передаётся.
+	RetryAfter int
+	// Задержка перед ответом.
+	Delay time.Duration
+	// Количество запросов, которые затрагивает сбой. Если равно 0, то сбой
+	// затрагивает все последующие запросы до вызова ClearFaults.
+	Count int
+}
+
+// Server - поддельный сервер The MovieDB.
+type Server struct {
+	key    string
+	server *httptest.Server
+
+	mu         sync.Mutex
+	movies     map[int]Movie
+	posters    map[string][]byte
+	exports    map[string][]int // Идентификаторы фильмов ежедневного экспорта по дате в виде MM_DD_YYYY.
+	changed    []int
+	nowPlaying []int
+	faults     []*Fault
+	requests   []string
+}
+
+// NewServer запускает поддельный сервер The MovieDB, который принимает
+// запросы к API с ключом key. По окончанию работы с сервером должен быть
+// вызван метод Close.
+func NewServer(key string) *Server {
+	s := &Server{
+		key:     key,
+		movies:  map[int]Movie{},
+		posters: map[string][]byte{},
+		exports: map[string][]int{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Close останавливает сервер.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// BaseURLs возвращает адреса сервера, которые можно передавать в
+// themoviedb.NewClientWithBaseURLs. Сервер заменяет собой все три сервиса
+// The MovieDB.
+func (s *Server) BaseURLs() themoviedb.BaseURLs {
+	return themoviedb.BaseURLs{
+		API:   s.server.URL + apiPrefix,
+		Image: s.server.URL + imagePrefix,
+		Files: s.server.URL,
+	}
+}
+
+// Client возвращает The MovieDB API клиент, настроенный на работу с сервером.
+// Лимит запросов настоящего The MovieDB API у клиента отключён, а паузы между
+// повторами запросов сокращены до ClientRetryPause, чтобы тесты со сбоями
+// сервера не ждали.
+func (s *Server) Client() *themoviedb.Client {
+	client := themoviedb.NewClientWithBaseURLs(s.key, s.server.Client(), s.BaseURLs())
+	client.SetLimiter(nil)
+	client.SetRetryPolicy(themoviedb.DefaultMaxRetries, ClientRetryPause)
+	return client
+}
+
+// AddMovie добавляет фильм в сервер или заменяет уже добавленный фильм с
+// тем же TMDBID.
+func (s *Server) AddMovie(movie Movie) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.movies[movie.TMDBID] = movie
+}
+
+// AddPoster добавляет картинку постера, доступную по пути path (например,
+// "/abc.jpg"), для любого размера постера.
+func (s *Server) AddPoster(path string, image []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posters[path] = image
+}
+
+// SetDailyExport задаёт идентификаторы фильмов, которые попадут в файл
+// ежедневного экспорта за дату date.
+func (s *Server) SetDailyExport(date time.Time, ids []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports[exportDate(date.Year(), int(date.Month()), date.Day())] = ids
+}
+
+// SetChangedMovies задаёт идентификаторы фильмов, которые возвращаются по
+// пути /movie/changes.
+func (s *Server) SetChangedMovies(ids []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changed = ids
+}
+
+// SetNowPlaying задаёт идентификаторы фильмов, которые возвращаются по пути
+// /movie/now_playing. Сами фильмы должны быть добавлены методом AddMovie.
+func (s *Server) SetNowPlaying(ids []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nowPlaying = ids
+}
+
+// Inject добавляет сбой. Если запрос подходит под несколько сбоев, то
+// применяется добавленный раньше других.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// FailNext делает так, что следующие count запросов с путём, начинающимся на
+// path, завершатся с кодом status. Для имитации превышения лимита запросов
+// нужно передать http.StatusTooManyRequests.
+func (s *Server) FailNext(path string, status, count int) {
+	s.Inject(Fault{Path: path, Status: status, Count: count})
+}
+
+// ClearFaults удаляет все добавленные сбои.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests возвращает пути всех поступивших на сервер запросов в порядке их
+// поступления.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// RequestCount возвращает количество запросов, путь которых начинается на
+// prefix.
+func (s *Server) RequestCount(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, path := range s.requests {
+		if strings.HasPrefix(path, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// PosterImage возвращает небольшую JPEG картинку, залитую цветом, который
+// зависит от n. Картинки для разных n различаются.
+func PosterImage(n int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 30))
+	c := color.RGBA{R: uint8(n * 37), G: uint8(n * 91), B: uint8(n * 13), A: 255}
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 30; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	return buf.Bytes()
+}
+
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	fault := s.takeFault(path)
+
+	if fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if fault.Status != 0 {
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+		}
+		writeError(w, fault.Status, http.StatusText(fault.Status))
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(path, apiPrefix+"/"):
+		if s.key != "" && req.URL.Query().Get("api_key") != s.key {
+			writeError(w, http.StatusUnauthorized, "Invalid API key: You must be granted a valid key.")
+			return
+		}
+		s.handleAPI(w, req, strings.TrimPrefix(path, apiPrefix))
+
+	case strings.HasPrefix(path, imagePrefix+"/"):
+		// Путь вида /t/p/<size>/<poster>. Базовый адрес из /configuration
+		// заканчивается на '/', поэтому клиент может запрашивать и /t/p//<size>/<poster>.
+		rest := strings.TrimLeft(strings.TrimPrefix(path, imagePrefix), "/")
+		slash := strings.Index(rest, "/")
+		if slash == -1 {
+			http.NotFound(w, req)
+			return
+		}
+		s.mu.Lock()
+		poster, ok := s.posters[rest[slash:]]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(poster)
+
+	case strings.HasPrefix(path, exportsPrefix):
+		s.handleExport(w, req, strings.TrimPrefix(path, exportsPrefix))
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// takeFault записывает запрос и находит сбой, который нужно к нему применить.
+func (s *Server) takeFault(path string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, path)
+	for i, fault := range s.faults {
+		if !strings.HasPrefix(path, fault.Path) {
+			continue
+		}
+		applied := *fault
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return applied
+	}
+	return Fault{}
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, req *http.Request, path string) {
+	query := req.URL.Query()
+	switch {
+	case path == "/configuration":
+		config := map[string]interface{}{
+			"images": map[string]interface{}{
+				"base_url":        s.server.URL + imagePrefix + "/",
+				"secure_base_url": s.server.URL + imagePrefix + "/",
+				"poster_sizes":    []string{"w92", "w154", "w185", "w342", "w500", "w780", "original"},
+			},
+		}
+		writeJSON(w, config)
+
+	case path == "/movie/now_playing":
+		page, ok := parsePage(w, query)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		ids := pageOf(s.nowPlaying, page)
+		results := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			movie := s.movies[id]
+			results = append(results, map[string]interface{}{
+				"id":                movie.TMDBID,
+				"original_title":    movie.OriginalTitle,
+				"original_language": movie.OriginalLang,
+				"adult":             movie.Adult,
+				"release_date":      movie.ReleaseDate,
+				"vote_count":        movie.VoteCount,
+				"vote_average":      movie.VoteAverage,
+			})
+		}
+		total := len(s.nowPlaying)
+		s.mu.Unlock()
+		writeJSON(w, pageResponse(results, page, total))
+
+	case path == "/movie/changes":
+		page, ok := parsePage(w, query)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		ids := pageOf(s.changed, page)
+		results := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			results = append(results, map[string]interface{}{"id": id, "adult": s.movies[id].Adult})
+		}
+		total := len(s.changed)
+		s.mu.Unlock()
+		writeJSON(w, pageResponse(results, page, total))
+
+	case strings.HasPrefix(path, "/movie/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(path, "/movie/"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "The resource you requested could not be found.")
+			return
+		}
+		s.mu.Lock()
+		movie, ok := s.movies[id]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "The resource you requested could not be found.")
+			return
+		}
+		writeJSON(w, movieResponse(movie))
+
+	default:
+		writeError(w, http.StatusNotFound, "The resource you requested could not be found.")
+	}
+}
+
+// handleExport отдаёт файл ежедневного экспорта с названием вида
+// movie_ids_MM_DD_YYYY.json.gz.
+func (s *Server) handleExport(w http.ResponseWriter, req *http.Request, filename string) {
+	if !strings.HasPrefix(filename, "movie_ids_") || !strings.HasSuffix(filename, ".json.gz") {
+		http.NotFound(w, req)
+		return
+	}
+	date := strings.TrimSuffix(strings.TrimPrefix(filename, "movie_ids_"), ".json.gz")
+	s.mu.Lock()
+	ids, ok := s.exports[date]
+	var buf bytes.Buffer
+	if ok {
+		gzipWriter := gzip.NewWriter(&buf)
+		for _, id := range ids {
+			line, _ := json.Marshal(map[string]interface{}{
+				"adult":          s.movies[id].Adult,
+				"id":             id,
+				"original_title": s.movies[id].OriginalTitle,
+				"popularity":     float64(s.movies[id].VoteCount) / 10,
+				"video":          false,
+			})
+			gzipWriter.Write(line)
+			gzipWriter.Write([]byte("\n"))
+		}
+		gzipWriter.Close()
+	}
+	s.mu.Unlock()
+	if !ok {
+		// Настоящий сервер отвечает 403 на запрос несуществующего файла.
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// movieResponse формирует ответ на запрос
+// /movie/{id}?append_to_response=translations,images.
+func movieResponse(movie Movie) map[string]interface{} {
+	var collection interface{}
+	if movie.Collection.ID != 0 {
+		collection = movie.Collection
+	}
+	translations := []map[string]interface{}{}
+	for lang, title := range movie.Title {
+		translations = append(translations, map[string]interface{}{
+			"iso_639_1": lang,
+			"data":      map[string]interface{}{"title": title},
+		})
+	}
+	posters := movie.Posters
+	if posters == nil {
+		posters = []themoviedb.Poster{}
+	}
+	return map[string]interface{}{
+		"id":                    movie.TMDBID,
+		"imdb_id":               movie.IMDBID,
+		"original_title":        movie.OriginalTitle,
+		"original_language":     movie.OriginalLang,
+		"adult":                 movie.Adult,
+		"release_date":          movie.ReleaseDate,
+		"vote_count":            movie.VoteCount,
+		"vote_average":          movie.VoteAverage,
+		"belongs_to_collection": collection,
+		"translations":          map[string]interface{}{"translations": translations},
+		"images":                map[string]interface{}{"posters": posters},
+	}
+}
+
+// parsePage извлекает номер страницы из запроса. Если номер некорректен, то
+// записывает ошибку в w и возвращает false.
+func parsePage(w http.ResponseWriter, query map[string][]string) (int, bool) {
+	page := 1
+	if values := query["page"]; len(values) > 0 {
+		var err error
+		page, err = strconv.Atoi(values[0])
+		if err != nil || page < 1 || page > themoviedb.ChangedMoviesMaxPage {
+			writeError(w, http.StatusUnprocessableEntity, "page must be less than or equal to 1000")
+			return 0, false
+		}
+	}
+	return page, true
+}
+
+// pageOf возвращает идентификаторы со страницы page.
+func pageOf(ids []int, page int) []int {
+	start := (page - 1) * PageSize
+	if start >= len(ids) {
+		return nil
+	}
+	end := start + PageSize
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[start:end]
+}
+
+func pageResponse(results interface{}, page, total int) map[string]interface{} {
+	return map[string]interface{}{
+		"page":          page,
+		"results":       results,
+		"total_pages":   (total + PageSize - 1) / PageSize,
+		"total_results": total,
+	}
+}
+
+func exportDate(year, month, day int) string {
+	return fmt.Sprintf("%02d_%02d_%d", month, day, year)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Write(body)
+}
+
+// writeError отправляет ошибку в формате The MovieDB API.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(code)
+	body, _ := json.Marshal(map[string]interface{}{
+		"status_code":    code,
+		"status_message": message,
+		"success":        false,
+	})
+	w.Write(body)
+}
@@ -0,0 +1,293 @@
+package themoviedbtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/themoviedb"
+)
+
+const testKey = "test-key"
+
+var testMovie = Movie{
+	TMDBID:        550,
+	IMDBID:        "tt0137523",
+	OriginalTitle: "Fight Club",
+	OriginalLang:  iso6391.En,
+	ReleaseDate:   "1999-10-15",
+	VoteCount:     20000,
+	VoteAverage:   8.4,
+	Title: map[iso6391.LangCode]string{
+		iso6391.En: "Fight Club",
+		iso6391.Ru: "Бойцовский клуб",
+		iso6391.De: "Fight Club",
+	},
+	Posters: []themoviedb.Poster{
+		{Lang: iso6391.En, Path: "/en1.jpg", VoteAverage: 5.3},
+		{Lang: iso6391.En, Path: "/en2.jpg", VoteAverage: 5.6},
+		{Lang: iso6391.Ru, Path: "/ru.jpg", VoteAverage: 5.1},
+		{Lang: iso6391.De, Path: "/de.jpg", VoteAverage: 5.9},
+	},
+}
+
+func TestGetMovie(t *testing.T) {
+	server := NewServer(testKey)
+	defer server.Close()
+	server.AddMovie(testMovie)
+	client := server.Client()
+
+	movie, err := client.GetMovie(testMovie.TMDBID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.TMDBID != testMovie.TMDBID || movie.IMDBID != testMovie.IMDBID || movie.VoteCount != testMovie.VoteCount {
+		t.Fatalf("Unexpected movie %+v", movie)
+	}
+	if movie.ReleaseDate.Format("2006-01-02") != testMovie.ReleaseDate {
+		t.Fatalf("Unexpected release date %v", movie.ReleaseDate)
+	}
+	if movie.Collection.ID != 0 {
+		t.Fatalf("Unexpected collection %+v", movie.Collection)
+	}
+	if len(movie.Title) != 2 || movie.Title[iso6391.Ru] != "Бойцовский клуб" {
+		t.Fatalf("Unexpected titles %v", movie.Title)
+	}
+	if len(movie.Poster) != 2 || movie.Poster[iso6391.En].Path != "/en2.jpg" || movie.Poster[iso6391.Ru].Path != "/ru.jpg" {
+		t.Fatalf("Unexpected posters %v", movie.Poster)
+	}
+
+	client.SetLangs([]iso6391.LangCode{iso6391.En, iso6391.De})
+	movie, err = client.GetMovie(testMovie.TMDBID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movie.Title) != 2 || movie.Title[iso6391.De] != "Fight Club" || movie.Poster[iso6391.De].Path != "/de.jpg" {
+		t.Fatalf("Unexpected titles %v or posters %v", movie.Title, movie.Poster)
+	}
+
+	_, err = client.GetMovie(1)
+	if err == nil {
+		t.Fatal("Expected error for unknown movie, got nil")
+	}
+
+	// Запрос с неверным ключом.
+	_, err = themoviedb.NewClientWithBaseURLs("wrong", nil, server.BaseURLs()).GetMovie(testMovie.TMDBID)
+	if err == nil {
+		t.Fatal("Expected error for wrong key, got nil")
+	}
+}
+
+func TestGetPoster(t *testing.T) {
+	server := NewServer(testKey)
+	defer server.Close()
+	image := PosterImage(1)
+	server.AddPoster("/en2.jpg", image)
+	client := server.Client()
+
+	_, err := client.GetPoster("/en2.jpg")
+	if err != themoviedb.ErrConfigure {
+		t.Fatalf("Expected ErrConfigure, got %v", err)
+	}
+	err = client.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	poster, err := client.GetPoster("/en2.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(poster, image) {
+		t.Fatal("Unexpected poster")
+	}
+	if bytes.Equal(PosterImage(1), PosterImage(2)) {
+		t.Fatal("Poster images for different numbers are equal")
+	}
+
+	_, err = client.GetPoster("/unknown.jpg")
+	if err == nil {
+		t.Fatal("Expected error for unknown poster, got nil")
+	}
+}
+
+func TestPages(t *testing.T) {
+	server := NewServer(testKey)
+	defer server.Close()
+	var ids []int
+	for i := 1; i <= PageSize+5; i++ {
+		ids = append(ids, i)
+		server.AddMovie(Movie{TMDBID: i, OriginalTitle: "Movie", OriginalLang: iso6391.En})
+	}
+	server.SetChangedMovies(ids)
+	server.SetNowPlaying(ids[:3])
+	client := server.Client()
+
+	changed, err := client.GetChangedMovies(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != PageSize || changed[0] != 1 {
+		t.Fatalf("Unexpected first page %v", changed)
+	}
+	changed, err = client.GetChangedMovies(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 5 || changed[0] != PageSize+1 {
+		t.Fatalf("Unexpected second page %v", changed)
+	}
+	_, err = client.GetChangedMovies(3)
+	if err != themoviedb.ErrPage {
+		t.Fatalf("Expected ErrPage, got %v", err)
+	}
+
+	movies, err := client.GetNowPlaying(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(movies) != 3 || movies[2].TMDBID != 3 {
+		t.Fatalf("Unexpected now playing movies %+v", movies)
+	}
+}
+
+func TestDailyExport(t *testing.T) {
+	server := NewServer(testKey)
+	defer server.Close()
+	date := time.Date(2020, time.May, 7, 0, 0, 0, 0, time.UTC)
+	server.SetDailyExport(date, []int{550, 551})
+	client := server.Client()
+
+	dir, err := ioutil.TempDir("", "themoviedbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "daily")
+
+	err = client.GetDailyExport(2020, 5, 7, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"id":551`) {
+		t.Fatalf("Unexpected daily export %q", content)
+	}
+
+	err = client.GetDailyExport(2020, 5, 8, filename+"2")
+	if err == nil {
+		t.Fatal("Expected error for missing daily export, got nil")
+	}
+	if _, err := os.Stat(filename + "2"); err == nil {
+		t.Fatal("File of failed daily export is not removed")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	server := NewServer(testKey)
+	defer server.Close()
+	server.AddMovie(testMovie)
+	client := server.Client()
+
+	// Без повторов ошибки сервера возвращаются сразу.
+	client.SetRetryPolicy(0, 0)
+	server.FailNext("/3/movie/", http.StatusTooManyRequests, 1)
+	server.FailNext("/3/movie/", http.StatusServiceUnavailable, 1)
+	_, err := client.GetMovie(testMovie.TMDBID)
+	if !errors.Is(err, themoviedb.ErrRateLimit) || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("Expected 429 error, got %v", err)
+	}
+	_, err = client.GetMovie(testMovie.TMDBID)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Expected 503 error, got %v", err)
+	}
+	_, err = client.GetMovie(testMovie.TMDBID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := server.RequestCount("/3/movie/"); count != 3 {
+		t.Fatalf("Expected 3 requests, got %d", count)
+	}
+
+	// С повторами запрос выполняется после ответов 429 и 5xx, а пауза после
+	// 429 берётся из Retry-After.
+	client.SetRetryPolicy(themoviedb.DefaultMaxRetries, ClientRetryPause)
+	server.Inject(Fault{Path: "/3/movie/", Status: http.StatusTooManyRequests, RetryAfter: 1, Count: 1})
+	server.FailNext("/3/movie/", http.StatusBadGateway, 1)
+	start := time.Now()
+	_, err = client.GetMovie(testMovie.TMDBID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Expected Retry-After pause of 1s, got %v", elapsed)
+	}
+	if count := server.RequestCount("/3/movie/"); count != 6 {
+		t.Fatalf("Expected 6 requests, got %d", count)
+	}
+	// Ошибки, которые не исправляются повтором, и исчерпанные повторы.
+	_, err = client.GetMovie(1)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected 404 error, got %v", err)
+	}
+	server.FailNext("/3/movie/", http.StatusInternalServerError, themoviedb.DefaultMaxRetries+1)
+	_, err = client.GetMovie(testMovie.TMDBID)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("Expected 500 error, got %v", err)
+	}
+	if count := server.RequestCount("/3/movie/"); count != 7+themoviedb.DefaultMaxRetries+1 {
+		t.Fatalf("Expected %d requests, got %d", 7+themoviedb.DefaultMaxRetries+1, count)
+	}
+
+	// Медленный ответ прерывается по таймауту клиента.
+	server.Inject(Fault{Delay: time.Second})
+	httpClient := &http.Client{Timeout: time.Millisecond * 100}
+	slowClient := themoviedb.NewClientWithBaseURLs(testKey, httpClient, server.BaseURLs())
+	_, err = slowClient.GetMovie(testMovie.TMDBID)
+	if err == nil {
+		t.Fatal("Expected timeout error, got nil")
+	}
+	server.ClearFaults()
+	_, err = slowClient.GetMovie(testMovie.TMDBID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Отмена контекста прерывает выполняющийся запрос и паузу перед
+	// повтором.
+	server.Inject(Fault{Path: "/3/movie/", Delay: time.Second, Count: 1})
+	server.Inject(Fault{Path: "/3/movie/", Status: http.StatusTooManyRequests, RetryAfter: 10, Count: 1})
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		start := time.Now()
+		_, err = client.GetMovieContext(ctx, testMovie.TMDBID)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+			t.Fatalf("Request is not cancelled in time (%v)", elapsed)
+		}
+	}
+}
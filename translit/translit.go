@@ -0,0 +1,137 @@
+// Пакет translit реализует транслитерацию русского текста латиницей и
+// приведение записанного латиницей текста к общему виду. Это позволяет
+// сравнивать между собой названия фильмов, записанные разными алфавитами:
+// например, "Брат 2" и "Brat 2" или "Интерстеллар" и "Interstellar".
+package translit
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Транслитерация кириллицы латиницей. Используется неформальная схема,
+// которая ближе всего к тому, как русские названия обычно пишут латиницей
+// (Zhenya, Khabarovsk, Tsoi, Yuri и т.д.).
+var cyrToLat = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	// Украинские и белорусские буквы.
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+}
+
+// Правило приведения латинского текста к общему виду: последовательность
+// from заменяется на to.
+type rule struct {
+	from string
+	to   string
+}
+
+// Правила приведения латинского текста к общему виду. Правила применяются
+// слева направо по тексту, причём в каждой позиции выбирается самое длинное
+// подходящее правило. Правила покрывают ГОСТ 7.79-2000 (ISO 9) в вариантах с
+// диакритикой (система А) и без неё (система Б), а также распространённые
+// неформальные способы записи русских слов латиницей. Часть различий
+// (например, ш и щ, е и ё, и и ы) при этом намеренно стирается.
+var latRules = buildRules([]rule{
+	// Шипящие и аффрикаты.
+	{"shch", "sh"}, {"sch", "sh"}, {"shh", "sh"}, {"š", "sh"}, {"ŝ", "sh"},
+	{"ž", "zh"}, {"č", "ch"},
+	{"tz", "ts"}, {"cz", "ts"},
+	{"kh", "h"},
+	// Буква c в английских словах читается как "с" перед e, i, y и как "к"
+	// в остальных случаях.
+	{"ch", "ch"}, {"ck", "k"}, {"ce", "se"}, {"ci", "si"}, {"cy", "si"}, {"c", "k"},
+	{"x", "ks"}, {"q", "k"}, {"w", "v"}, {"ph", "f"},
+	// Йотированные гласные. После и они записываются без й (ия - ia).
+	{"iya", "ia"}, {"ija", "ia"}, {"ya", "ya"}, {"ja", "ya"}, {"â", "ya"},
+	{"iyu", "iu"}, {"iju", "iu"}, {"yu", "yu"}, {"ju", "yu"}, {"û", "yu"},
+	{"iye", "ie"}, {"ije", "ie"}, {"ye", "e"}, {"je", "e"}, {"è", "e"},
+	{"yo", "e"}, {"jo", "e"}, {"ë", "e"},
+	// Остальные y и j соответствуют й или ы, которые не отличаются от и.
+	{"y", "i"}, {"j", "i"},
+	// Твёрдый и мягкий знаки.
+	{"'", ""}, {"`", ""}, {"ʹ", ""}, {"ʺ", ""},
+})
+
+// buildRules группирует правила по первой руне последовательности from и
+// упорядочивает их так, чтобы более длинные правила шли первыми.
+func buildRules(rules []rule) map[rune][]rule {
+	grouped := map[rune][]rule{}
+	for _, r := range rules {
+		first, _ := utf8.DecodeRuneInString(r.from)
+		grouped[first] = append(grouped[first], r)
+	}
+	for first, group := range grouped {
+		for i := 1; i < len(group); i++ {
+			for j := i; j > 0 && len(group[j].from) > len(group[j-1].from); j-- {
+				group[j], group[j-1] = group[j-1], group[j]
+			}
+		}
+		grouped[first] = group
+	}
+	return grouped
+}
+
+// ToLatin транслитерирует кириллицу в s латиницей. Заглавные буквы
+// кириллицы транслитерируются строчными латинскими. Остальные символы
+// остаются без изменений.
+func ToLatin(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		lat, ok := cyrToLat[r]
+		if !ok {
+			lower := []rune(strings.ToLower(string(r)))
+			if len(lower) == 1 {
+				lat, ok = cyrToLat[lower[0]]
+			}
+		}
+		if ok {
+			b.WriteString(lat)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Key приводит s к общему для кириллицы и латиницы виду в нижнем регистре.
+// Если ключи двух строк совпадают или близки, то эти строки, скорее всего,
+// являются записью одного и того же названия разными алфавитами или разными
+// способами транслитерации.
+func Key(s string) string {
+	lat := ToLatin(strings.ToLower(s))
+
+	var b strings.Builder
+	b.Grow(len(lat))
+	var prev rune
+	for i := 0; i < len(lat); {
+		r, size := utf8.DecodeRuneInString(lat[i:])
+		out := string(r)
+		for _, rl := range latRules[r] {
+			if strings.HasPrefix(lat[i:], rl.from) {
+				out = rl.to
+				size = len(rl.from)
+				break
+			}
+		}
+		i += size
+
+		// Удвоенные буквы схлопываются в одну (Интерстеллар - Interstelar).
+		for _, o := range out {
+			if o == prev && isLatinLetter(o) {
+				continue
+			}
+			b.WriteRune(o)
+			prev = o
+		}
+	}
+	return b.String()
+}
+
+func isLatinLetter(r rune) bool {
+	return r >= 'a' && r <= 'z'
+}
@@ -0,0 +1,50 @@
+package translit
+
+import (
+	"testing"
+)
+
+var keyTestCases = []struct {
+	variants []string
+	key      string
+}{
+	{[]string{"Брат 2", "Brat 2", "BRAT 2"}, "brat 2"},
+	{[]string{"Ирония судьбы", "Ironiya sudby", "Ironija sud'by", "Ironia sudbi"}, "ironia sudbi"},
+	{[]string{"Интерстеллар", "Interstellar", "Interstelar"}, "interstelar"},
+	{[]string{"Щука", "Shchuka", "Schuka", "Shhuka", "Ŝuka"}, "shuka"},
+	{[]string{"Ёлки", "Елки", "Yolki", "Jolki"}, "elki"},
+	{[]string{"Хроники", "Khroniki", "Hroniki"}, "hroniki"},
+	{[]string{"Жизнь", "Zhizn", "Žizn'"}, "zhizn"},
+	{[]string{"Чебурашка", "Cheburashka", "Čeburaška"}, "cheburashka"},
+	{[]string{"Цой", "Tsoy", "Tsoj", "Tzoi"}, "tsoi"},
+	{[]string{"Юность", "Yunost", "Junost'"}, "yunost"},
+}
+
+func TestKey(t *testing.T) {
+	for _, tc := range keyTestCases {
+		for _, variant := range tc.variants {
+			key := Key(variant)
+			if key != tc.key {
+				t.Errorf("Key(%q) = %q, expected %q", variant, key, tc.key)
+			}
+		}
+	}
+}
+
+func TestToLatin(t *testing.T) {
+	testCases := []struct {
+		source string
+		target string
+	}{
+		{"", ""},
+		{"Brat 2", "Brat 2"},
+		{"брат 2", "brat 2"},
+		{"Щ", "shch"},
+		{"Король Лев (2019)", "korol lev (2019)"},
+	}
+	for _, tc := range testCases {
+		if target := ToLatin(tc.source); target != tc.target {
+			t.Errorf("ToLatin(%q) = %q, expected %q", tc.source, target, tc.target)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/source-farm/movie-promo-bot/iso6391"
+	"github.com/source-farm/movie-promo-bot/sqlite"
+	"github.com/source-farm/movie-promo-bot/telegrambotapi"
+)
+
+const (
+	// Извлечение предпочитаемого языка пользователя.
+	userLangQuery = `
+SELECT lang, lang_chosen
+  FROM telegram_user
+ WHERE id = ?1;
+`
+
+	// Сохранение языка пользователя, который передаёт его Telegram клиент.
+	// Язык, выбранный пользователем командой /lang, не перезаписывается.
+	userLangUpsertQuery = `
+INSERT INTO telegram_user (id, lang)
+     VALUES (?1, ?2)
+ON CONFLICT (id) DO UPDATE SET (lang, updated_on) = (?2, datetime('now'))
+                         WHERE lang_chosen = 0;
+`
+
+	// Сохранение языка, выбранного пользователем командой /lang.
+	userLangChooseQuery = `
+INSERT INTO telegram_user (id, lang, lang_chosen)
+     VALUES (?1, ?2, 1)
+ON CONFLICT (id) DO UPDATE SET (lang, lang_chosen, updated_on) = (?2, 1, datetime('now'));
+`
+)
+
+// clientLang возвращает язык Telegram клиента пользователя в виде кода ISO
+// 639-1. Telegram передаёт язык в виде IETF тега ("en", "pt-br"). Если язык
+// клиента неизвестен, то возвращается английский.
+func clientLang(user telegrambotapi.User) iso6391.LangCode {
+	lang := strings.ToLower(user.LangCode)
+	if i := strings.Index(lang, "-"); i != -1 {
+		lang = lang[:i]
+	}
+	if lang == "" {
+		return iso6391.En
+	}
+	return lang
+}
+
+// preferredLang возвращает язык, на котором пользователю показываются
+// постеры и сообщения бота. Если пользователь не выбирал язык командой
+// /lang, то это язык его Telegram клиента. Язык пользователя хранится в
+// таблице telegram_user и обновляется при смене языка клиента.
+func preferredLang(ctx context.Context, user telegrambotapi.User) (iso6391.LangCode, error) {
+	lang := clientLang(user)
+
+	err := withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(userLangQuery)
+		if err != nil {
+			return err
+		}
+		var storedLang string
+		var chosen bool
+		err = stmt.QueryRowContext(ctx, user.ID).Scan(&storedLang, &chosen)
+		if err != nil && err != sqlite.ErrNoRows {
+			return err
+		}
+		if err == nil && (chosen || storedLang == lang) {
+			lang = storedLang
+			return nil
+		}
+		stmt, err = conn.PrepareCached(userLangUpsertQuery)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, user.ID, lang)
+		return err
+	})
+	return lang, err
+}
+
+// choosePreferredLang сохраняет язык, выбранный пользователем командой /lang.
+func choosePreferredLang(ctx context.Context, user telegrambotapi.User, lang iso6391.LangCode) error {
+	return withConn(ctx, dbPool, func(ctx context.Context, conn *sqlite.Conn) error {
+		stmt, err := conn.PrepareCached(userLangChooseQuery)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, user.ID, lang)
+		return err
+	})
+}
+
+// availableLangs возвращает через запятую языки из настроек бота.
+func availableLangs() string {
+	langs := make([]string, 0, len(botLangs))
+	for lang := range botLangs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return strings.Join(langs, ", ")
+}